@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// Exit statuses of check, following fsck.
+const (
+	checkClean      = 0
+	checkRepaired   = 1
+	checkUnrepaired = 4
+	checkFailed     = 8
+)
+
+const checkUsage = "check [-repair] [-codepage n] [-partition n | -offset bytes] image"
+
+func runCheck(args []string) (int, error) {
+	flags := newFlagSet("check", checkUsage)
+	repair := flags.Bool("repair", false, "fix the problems found")
+	codePage := flags.Int("codepage", 437, "OEM code `page` of short names, e.g. 850 or 932")
+	var imgFlags imageFlags
+	imgFlags.registerDevice(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	path := flags.Arg(0)
+	dev, closer, err := imgFlags.openDevice(path, *repair)
+	if err != nil {
+		return checkFailed, err
+	}
+	defer closer.Close()
+
+	report, err := fatfs.Check(dev, &fatfs.CheckOptions{Repair: *repair, CodePage: *codePage})
+	if report == nil {
+		return checkFailed, err
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%s: %s, %d files, %d directories, %d/%d clusters of %d bytes free\n",
+		path, report.Type, report.Files, report.Dirs, report.Free, report.Clusters, report.ClusterSize)
+	if err != nil {
+		return checkFailed, err
+	}
+
+	switch {
+	case report.OK():
+		return checkClean, nil
+	case len(report.Remaining()) == 0:
+		return checkRepaired, nil
+	default:
+		return checkUnrepaired, fmt.Errorf("%d problems left", len(report.Remaining()))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+	"github.com/spf13/afero"
+)
+
+const (
+	catUsage = "cat [-partition n | -offset bytes] [-tz zone] image path ..."
+	cpUsage  = "cp [-r] [-p] [-contiguous] [-nfc] [-sanitize] [-partition n | -offset bytes] [-tz zone] image source ... target"
+)
+
+// imagePrefix marks a cp argument as a path inside the image, as in mtools.
+const imagePrefix = "::"
+
+// location is a path on the host or in the image.
+type location struct {
+	fs    afero.Fs
+	path  string
+	image bool
+}
+
+func (l location) join(name string) location {
+	if l.image {
+		l.path = path.Join(l.path, name)
+	} else {
+		l.path = filepath.Join(l.path, name)
+	}
+	return l
+}
+
+func (l location) base() string {
+	if l.image {
+		return path.Base(l.path)
+	}
+	return filepath.Base(l.path)
+}
+
+func (l location) String() string {
+	if l.image {
+		return imagePrefix + l.path
+	}
+	return l.path
+}
+
+func runCat(args []string) (int, error) {
+	flags := newFlagSet("cat", catUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		f, err := img.fs.Open(p)
+		if err != nil {
+			return 1, fmt.Errorf("%s: %w", p, err)
+		}
+		_, err = io.Copy(os.Stdout, f)
+		f.Close()
+		if err != nil {
+			return 1, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return 0, nil
+}
+
+func runCp(args []string) (int, error) {
+	flags := newFlagSet("cp", cpUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	recursive := flags.Bool("r", false, "copy directories recursively")
+	preserve := flags.Bool("p", false, "preserve modification times")
+	contiguous := flags.Bool("contiguous", false, "allocate files copied into the image in one run of clusters")
+	var names fatfs.NamePolicy
+	flags.BoolVar(&names.NFC, "nfc", false, "normalize names copied into the image to Unicode NFC")
+	flags.BoolVar(&names.Sanitize, "sanitize", false, "replace characters FAT does not allow in names copied into the image")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 3 {
+		flags.Usage()
+		fmt.Fprintln(os.Stderr, "\npaths in the image are prefixed with", imagePrefix)
+		return 2, nil
+	}
+
+	srcArgs := flags.Args()[1 : flags.NArg()-1]
+	dstArg := flags.Arg(flags.NArg() - 1)
+	img, err := imgFlags.mount(flags.Arg(0), strings.HasPrefix(dstArg, imagePrefix))
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	imgFs, hostFs := fatfs.AsAfero(img.fs), afero.NewOsFs()
+	parse := func(arg string) location {
+		if p, ok := strings.CutPrefix(arg, imagePrefix); ok {
+			return location{fs: imgFs, path: cleanPath(p), image: true}
+		}
+		return location{fs: hostFs, path: arg}
+	}
+
+	c := copier{recursive: *recursive, preserve: *preserve, names: names}
+	if *contiguous {
+		c.contiguous = img.fs
+	}
+	dst := parse(dstArg)
+	info, err := dst.fs.Stat(dst.path)
+	into := err == nil && info.IsDir()
+	if len(srcArgs) > 1 && !into {
+		return 1, fmt.Errorf("%s: not a directory", dst)
+	}
+	if !into && dst.image {
+		parent := dst
+		parent.path = path.Dir(dst.path)
+		if dst, err = c.target(parent, dst.base()); err != nil {
+			return 1, err
+		}
+	}
+
+	status := 0
+	for _, arg := range srcArgs {
+		src := parse(arg)
+		target := dst
+		if into {
+			if target, err = c.target(dst, src.base()); err != nil {
+				fmt.Fprintln(os.Stderr, "fatfs:", err)
+				status = 1
+				continue
+			}
+		}
+		if err := c.copy(src, target); err != nil {
+			fmt.Fprintln(os.Stderr, "fatfs:", err)
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// copier copies files and directory trees between the host and the image.
+type copier struct {
+	recursive bool
+	preserve  bool
+	// names is applied to the names of files copied into the image.
+	names fatfs.NamePolicy
+	// contiguous is the image volume if files copied into it are allocated
+	// contiguously.
+	contiguous *fatfs.FatFs
+}
+
+// target returns the location of name in dir, with the name policy
+// applied if dir is in the image.
+func (c *copier) target(dir location, name string) (location, error) {
+	if !dir.image {
+		return dir.join(name), nil
+	}
+	fixed, err := c.names.Apply(name)
+	if err != nil {
+		return location{}, fmt.Errorf("%s: %w", dir.join(name), err)
+	}
+	return dir.join(fixed), nil
+}
+
+func (c *copier) copy(src, dst location) error {
+	info, err := src.fs.Stat(src.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	if info.IsDir() {
+		if !c.recursive {
+			return fmt.Errorf("%s: is a directory (not copied)", src)
+		}
+		return c.copyDir(src, dst, info)
+	}
+	return c.copyFile(src, dst, info)
+}
+
+func (c *copier) copyDir(src, dst location, info os.FileInfo) error {
+	if err := dst.fs.Mkdir(dst.path, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	dir, err := src.fs.Open(src.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	for _, fi := range infos {
+		target, err := c.target(dst, fi.Name())
+		if err != nil {
+			return err
+		}
+		if err := c.copy(src.join(fi.Name()), target); err != nil {
+			return err
+		}
+	}
+	return c.setTime(dst, info)
+}
+
+func (c *copier) copyFile(src, dst location, info os.FileInfo) error {
+	in, err := src.fs.Open(src.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	defer in.Close()
+	var out io.WriteCloser
+	if dst.image && c.contiguous != nil {
+		out, err = c.contiguous.CreateAllocated(dst.path, info.Size(), true)
+	} else {
+		out, err = dst.fs.OpenFile(dst.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	return c.setTime(dst, info)
+}
+
+func (c *copier) setTime(dst location, info os.FileInfo) error {
+	if !c.preserve {
+		return nil
+	}
+	if err := dst.fs.Chtimes(dst.path, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const defragUsage = "defrag [-n] [-compact] [-v] [-partition n | -offset bytes] image"
+
+func runDefrag(args []string) (int, error) {
+	flags := newFlagSet("defrag", defragUsage)
+	dryRun := flags.Bool("n", false, "only report fragmentation, do not change the image")
+	compact := flags.Bool("compact", false, "pack all files together so the free space is in one run")
+	verbose := flags.Bool("v", false, "list every file, not only fragmented ones")
+	var imgFlags imageFlags
+	imgFlags.registerDevice(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	path := flags.Arg(0)
+	dev, closer, err := imgFlags.openDevice(path, !*dryRun)
+	if err != nil {
+		return 1, err
+	}
+	defer closer.Close()
+
+	if *dryRun {
+		report, err := fatfs.AnalyzeFragmentation(dev, nil)
+		if err != nil {
+			return 1, err
+		}
+		printFragmentation(path, report, *verbose)
+		return 0, nil
+	}
+
+	report, err := fatfs.Defrag(dev, &fatfs.DefragOptions{Compact: *compact})
+	if report == nil {
+		return 1, err
+	}
+	if err != nil {
+		fmt.Printf("%d files moved before the error\n", report.Moved)
+		return 1, err
+	}
+	for _, f := range report.Skipped {
+		fmt.Printf("%s: %d extents, no room for %d contiguous clusters\n", f.Path, f.Extents, f.Clusters)
+	}
+	fmt.Printf("moved %d files, %d bytes\n", report.Moved, report.MovedBytes)
+	printFragmentation(path, report.After, *verbose)
+	if len(report.Skipped) > 0 {
+		return 1, fmt.Errorf("%d files left fragmented", len(report.Skipped))
+	}
+	return 0, nil
+}
+
+func printFragmentation(path string, r *fatfs.FragmentationReport, verbose bool) {
+	for _, f := range r.Files {
+		if !verbose && !f.Fragmented() {
+			continue
+		}
+		kind := ""
+		if f.Dir {
+			kind = "/"
+		}
+		fmt.Printf("%s%s: %d bytes, %d clusters, %d extents\n", f.Path, kind, f.Size, f.Clusters, f.Extents)
+	}
+	fmt.Printf("%s: %s, %d of %d files and directories fragmented, %d/%d clusters of %d bytes free in %d runs, largest %d clusters\n",
+		path, r.Type, len(r.Fragmented()), len(r.Files), r.Free, r.Clusters, r.ClusterSize, r.FreeExtents, r.LargestFree)
+}
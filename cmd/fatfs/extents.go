@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const extentsUsage = "extents [-partition n | -offset bytes] image path ..."
+
+func runExtents(args []string) (int, error) {
+	flags := newFlagSet("extents", extentsUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+	// report sectors of the image, not of the partition
+	var base uint64
+	if section, ok := img.dev.(*fatfs.SectionDevice); ok {
+		base = section.Start()
+	}
+
+	status := 0
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		x, err := img.fs.Extents(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", p, err)
+			status = 1
+			continue
+		}
+		layout := "contiguous"
+		switch {
+		case x.Fragmented:
+			layout = "fragmented"
+		case len(x.Extents) == 0:
+			layout = "empty"
+		}
+		if x.NoFatChain {
+			layout += ", no FAT chain"
+		}
+		fmt.Printf("%s: %d bytes, %d extents, %s\n", p, x.Size, len(x.Extents), layout)
+		for _, e := range x.Extents {
+			sector := base + e.Sector
+			fmt.Printf("  offset %d: clusters %d-%d, sectors %d-%d, image bytes %d-%d\n",
+				e.Offset, e.Cluster, e.Cluster+e.Clusters-1, sector, sector+e.Sectors-1,
+				sector*fatfs.SectorSize, (sector+e.Sectors)*fatfs.SectorSize-1)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const extractUsage = "extract [-include glob] [-exclude glob] [-manifest file] [-partition n | -offset bytes] [-tz zone] image dir"
+
+// globList is a flag.Value collecting repeated glob flags.
+type globList []string
+
+func (g *globList) String() string { return fmt.Sprint(*g) }
+
+func (g *globList) Set(v string) error {
+	*g = append(*g, v)
+	return nil
+}
+
+var _ flag.Value = (*globList)(nil)
+
+func runExtract(args []string) (int, error) {
+	flags := newFlagSet("extract", extractUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	var opts fatfs.ExtractOptions
+	flags.Var((*globList)(&opts.Include), "include", "only extract files matching `glob` (repeatable)")
+	flags.Var((*globList)(&opts.Exclude), "exclude", "skip files and directories matching `glob` (repeatable)")
+	manifest := flags.String("manifest", "", "write the attribute manifest to `file`, default dir.manifest.json; \"-\" for none")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	dir := flags.Arg(1)
+	switch *manifest {
+	case "":
+		opts.Manifest = filepath.Clean(dir) + ".manifest.json"
+	case "-":
+	default:
+		opts.Manifest = *manifest
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	if err := fatfs.ExtractImage(img.fs, dir, &opts); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
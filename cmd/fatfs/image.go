@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// imageFlags select the volume to work on inside an image.
+type imageFlags struct {
+	partition  int
+	offset     int64
+	tz         string
+	shortNames string
+	codePage   int
+}
+
+func (f *imageFlags) register(fs *flag.FlagSet) {
+	f.registerDevice(fs)
+	fs.StringVar(&f.tz, "tz", "", "time `zone` of the image's timestamps: Local (default), UTC or a name like Europe/Berlin")
+	fs.StringVar(&f.shortNames, "shortnames", "tail", "short name `mode` for new files: tail, notail or only (no long names)")
+	fs.IntVar(&f.codePage, "codepage", 437, "OEM code `page` of short names and the label, e.g. 850 or 932")
+}
+
+// registerDevice registers only the flags used by openDevice.
+func (f *imageFlags) registerDevice(fs *flag.FlagSet) {
+	fs.IntVar(&f.partition, "partition", 0, "use partition `n` (1-based) of the image")
+	fs.Int64Var(&f.offset, "offset", 0, "use the volume starting `bytes` into the image")
+}
+
+// parseZone loads the time zone named by a -tz flag, nil for local time.
+func parseZone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// openDevice opens the image at name, narrowed to the selected partition or
+// offset. VHD images are recognised by their extension, compressed images
+// by their contents; the latter can only be read.
+func (f *imageFlags) openDevice(name string, write bool) (fatfs.BlockDevice, io.Closer, error) {
+	if f.partition != 0 && f.offset != 0 {
+		return nil, nil, errors.New("-partition and -offset cannot be combined")
+	}
+	if f.offset%fatfs.SectorSize != 0 {
+		return nil, nil, fmt.Errorf("offset %d is not a multiple of the sector size", f.offset)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]byte, 16)
+	n, _ := io.ReadFull(file, header)
+	file.Close()
+
+	var (
+		dev    fatfs.BlockDevice
+		closer io.Closer
+	)
+	switch {
+	case fatfs.DetectCompression(header[:n]) != fatfs.CompressionNone:
+		if write {
+			return nil, nil, fmt.Errorf("%s: compressed images are read-only", name)
+		}
+		img, err := fatfs.OpenCompressedImage(name, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		dev, closer = img, img
+	case strings.EqualFold(path.Ext(name), ".vhd"):
+		img, err := fatfs.OpenVHD(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		dev, closer = img, img
+	default:
+		img, err := fatfs.NewImageFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		dev, closer = img, img
+	}
+
+	var section *fatfs.SectionDevice
+	switch {
+	case f.partition != 0:
+		section, err = fatfs.OpenPartition(dev, f.partition)
+	case f.offset != 0:
+		section, err = fatfs.NewSectionDevice(dev, uint64(f.offset)/fatfs.SectorSize, 0)
+	default:
+		return dev, closer, nil
+	}
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	return section, closer, nil
+}
+
+// image is a disk image with its volume mounted.
+type image struct {
+	fs     *fatfs.FatFs
+	dev    fatfs.BlockDevice
+	closer io.Closer
+}
+
+// mount opens the image at name and mounts its volume. Pass write for
+// commands that modify the volume.
+func (f *imageFlags) mount(name string, write bool) (*image, error) {
+	loc, err := parseZone(f.tz)
+	if err != nil {
+		return nil, err
+	}
+	shortNames, err := fatfs.ParseShortNameMode(f.shortNames)
+	if err != nil {
+		return nil, err
+	}
+	dev, closer, err := f.openDevice(name, write)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	if err := fs.MountWith(dev, &fatfs.MountOptions{CodePage: f.codePage}); err != nil {
+		closer.Close()
+		return nil, err
+	}
+	fs.SetLocation(loc)
+	fs.SetShortNameMode(shortNames)
+	return &image{fs: fs, dev: dev, closer: closer}, nil
+}
+
+// Close unmounts the volume and closes the image.
+func (img *image) Close() error {
+	err := img.fs.Unmount()
+	if cerr := img.closer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// stat is FatFs.Stat returning the package's FileInfo.
+func (img *image) stat(name string) (*fatfs.FileInfo, error) {
+	info, err := img.fs.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return info.(*fatfs.FileInfo), nil
+}
+
+// readDir lists a directory of the image.
+func (img *image) readDir(name string) ([]os.FileInfo, error) {
+	dir, err := img.fs.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return infos, nil
+}
+
+// cleanPath turns a path given on the command line into an absolute path
+// on the volume.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
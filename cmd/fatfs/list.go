@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const (
+	lsUsage   = "ls [-l] [-a] [-partition n | -offset bytes] [-tz zone] image [path ...]"
+	treeUsage = "tree [-a] [-partition n | -offset bytes] [-tz zone] image [path]"
+	statUsage = "stat [-partition n | -offset bytes] [-tz zone] image path ..."
+	dfUsage   = "df [-partition n | -offset bytes] [-tz zone] image"
+)
+
+// attrString renders FAT attributes in the style of DOS attrib.
+func attrString(attr fatfs.FileAttr) string {
+	b := []byte("-----")
+	for i, a := range []struct {
+		attr fatfs.FileAttr
+		c    byte
+	}{
+		{fatfs.AttrDirectory, 'd'},
+		{fatfs.AttrReadOnly, 'r'},
+		{fatfs.AttrHidden, 'h'},
+		{fatfs.AttrSystem, 's'},
+		{fatfs.AttrArchive, 'a'},
+	} {
+		if attr&a.attr != 0 {
+			b[i] = a.c
+		}
+	}
+	return string(b)
+}
+
+// hidden reports whether ls and tree skip the entry without -a.
+func hidden(info os.FileInfo) bool {
+	fi, ok := info.(*fatfs.FileInfo)
+	return ok && fi.Attr()&(fatfs.AttrHidden|fatfs.AttrSystem) != 0
+}
+
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return strings.ToLower(infos[i].Name()) < strings.ToLower(infos[j].Name())
+	})
+}
+
+func printEntry(info os.FileInfo, long bool) {
+	if !long {
+		fmt.Println(info.Name())
+		return
+	}
+	var attr fatfs.FileAttr
+	if fi, ok := info.(*fatfs.FileInfo); ok {
+		attr = fi.Attr()
+	}
+	fmt.Printf("%s %10d %s %s\n", attrString(attr), info.Size(),
+		info.ModTime().Format("2006-01-02 15:04:05"), info.Name())
+}
+
+func runLs(args []string) (int, error) {
+	flags := newFlagSet("ls", lsUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	long := flags.Bool("l", false, "show attributes, size and modification time")
+	all := flags.Bool("a", false, "show hidden and system files")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	paths := flags.Args()[1:]
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	status := 0
+	for i, p := range paths {
+		p = cleanPath(p)
+		info, err := img.stat(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fatfs:", err)
+			status = 1
+			continue
+		}
+		if !info.IsDir() {
+			printEntry(info, *long)
+			continue
+		}
+		infos, err := img.readDir(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fatfs:", err)
+			status = 1
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", p)
+		}
+		sortInfos(infos)
+		for _, info := range infos {
+			if *all || !hidden(info) {
+				printEntry(info, *long)
+			}
+		}
+	}
+	return status, nil
+}
+
+func runTree(args []string) (int, error) {
+	flags := newFlagSet("tree", treeUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	all := flags.Bool("a", false, "show hidden and system files")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	root := cleanPath(flags.Arg(1))
+	fmt.Println(root)
+	var dirs, files int
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		infos, err := img.readDir(dir)
+		if err != nil {
+			return err
+		}
+		sortInfos(infos)
+		var shown []os.FileInfo
+		for _, info := range infos {
+			if *all || !hidden(info) {
+				shown = append(shown, info)
+			}
+		}
+		for i, info := range shown {
+			branch, indent := "├── ", "│   "
+			if i == len(shown)-1 {
+				branch, indent = "└── ", "    "
+			}
+			fmt.Println(prefix + branch + info.Name())
+			if !info.IsDir() {
+				files++
+				continue
+			}
+			dirs++
+			if err := walk(path.Join(dir, info.Name()), prefix+indent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return 1, err
+	}
+	fmt.Printf("\n%d directories, %d files\n", dirs, files)
+	return 0, nil
+}
+
+func runStat(args []string) (int, error) {
+	flags := newFlagSet("stat", statUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	status := 0
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		info, err := img.stat(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fatfs:", err)
+			status = 1
+			continue
+		}
+		kind := "regular file"
+		if info.IsDir() {
+			kind = "directory"
+		}
+		fmt.Printf("  Path: %s\n", p)
+		fmt.Printf("  Type: %s\n", kind)
+		fmt.Printf("  Size: %d\n", info.Size())
+		fmt.Printf("  Attr: %s\n", attrString(info.Attr()))
+		fmt.Printf("  Mode: %s\n", info.Mode())
+		st := info.Sys().(*fatfs.FileStat)
+		if st.ShortName != "" {
+			fmt.Printf(" Short: %s\n", st.ShortName)
+		}
+		fmt.Printf(" Start: cluster %d\n", st.Cluster)
+		fmt.Printf("Modify: %s\n", info.ModTime().Format("2006-01-02 15:04:05"))
+		if !st.Created.IsZero() {
+			fmt.Printf("Create: %s\n", st.Created.Format("2006-01-02 15:04:05"))
+		}
+	}
+	return status, nil
+}
+
+func runDf(args []string) (int, error) {
+	flags := newFlagSet("df", dfUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	st, err := img.fs.Statfs()
+	if err != nil {
+		return 1, err
+	}
+	label, serial, err := img.fs.Label()
+	if err != nil {
+		return 1, err
+	}
+	fmt.Printf("Type:    %s\n", st.Type)
+	fmt.Printf("Label:   %s\n", label)
+	fmt.Printf("Serial:  %04X-%04X\n", serial>>16, serial&0xFFFF)
+	fmt.Printf("Cluster: %d bytes\n", st.ClusterSize)
+	fmt.Printf("Size:    %d bytes\n", st.Total)
+	fmt.Printf("Used:    %d bytes\n", st.Total-st.Free)
+	fmt.Printf("Free:    %d bytes\n", st.Free)
+	return 0, nil
+}
@@ -0,0 +1,78 @@
+// Command fatfs inspects and modifies FAT and exFAT disk images.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a fatfs subcommand. run returns the exit status.
+type command struct {
+	usage string
+	run   func(args []string) (int, error)
+}
+
+var commands = map[string]command{
+	"attrib":   {attribUsage, runAttrib},
+	"cat":      {catUsage, runCat},
+	"check":    {checkUsage, runCheck},
+	"cp":       {cpUsage, runCp},
+	"defrag":   {defragUsage, runDefrag},
+	"df":       {dfUsage, runDf},
+	"extents":  {extentsUsage, runExtents},
+	"extract":  {extractUsage, runExtract},
+	"label":    {labelUsage, runLabel},
+	"ls":       {lsUsage, runLs},
+	"mkdir":    {mkdirUsage, runMkdir},
+	"minimize": {minimizeUsage, runMinimize},
+	"mkimage":  {mkimageUsage, runMkimage},
+	"mv":       {mvUsage, runMv},
+	"resize":   {resizeUsage, runResize},
+	"rm":       {rmUsage, runRm},
+	"stat":     {statUsage, runStat},
+	"touch":    {touchUsage, runTouch},
+	"tree":     {treeUsage, runTree},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: fatfs <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  fatfs", commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "fatfs: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	status, err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fatfs:", err)
+	}
+	os.Exit(status)
+}
+
+// newFlagSet returns a flag set for a command with the given usage line.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: fatfs", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const minimizeUsage = "minimize [-type t] [-cluster n] [-sfd] [-partition n | -offset bytes] [-tz zone] [-shortnames mode] [-codepage n] image output"
+
+func runMinimize(args []string) (int, error) {
+	flags := newFlagSet("minimize", minimizeUsage)
+	var cluster sizeFlag
+	flags.Var(&cluster, "cluster", "cluster `size` in bytes, default the one giving the smallest image")
+	typ := flags.String("type", "", "filesystem `type`: fat12, fat16, fat32 or exfat, default the one giving the smallest image")
+	sfd := flags.Bool("sfd", false, "leave out the partition table even if the image has one")
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	var opts fatfs.BuildOptions
+	var err error
+	if opts.Format.Type, err = parseType(*typ); err != nil {
+		return 2, err
+	}
+	if opts.Format.Location, err = parseZone(imgFlags.tz); err != nil {
+		return 2, err
+	}
+	if opts.ShortNames, err = fatfs.ParseShortNameMode(imgFlags.shortNames); err != nil {
+		return 2, err
+	}
+	opts.Format.ClusterSize = uint32(cluster)
+	opts.CodePage = imgFlags.codePage
+
+	name, out := flags.Arg(0), flags.Arg(1)
+	if a, err := os.Stat(name); err == nil {
+		if b, err := os.Stat(out); err == nil && os.SameFile(a, b) {
+			return 1, fmt.Errorf("%s: the output must be a new file", out)
+		}
+	}
+	img, err := imgFlags.mount(name, false)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	// keep the label, serial number and layout of the image
+	if opts.Label, opts.Format.Serial, err = img.fs.Label(); err != nil {
+		return 1, err
+	}
+	opts.Format.NoPartitionTable = *sfd
+	if imgFlags.partition == 0 && imgFlags.offset == 0 {
+		parts, err := fatfs.ReadPartitions(img.dev)
+		if err != nil {
+			return 1, err
+		}
+		opts.Format.NoPartitionTable = opts.Format.NoPartitionTable || len(parts) == 0
+	}
+
+	src := fatfs.AsIO(img.fs)
+	format, size, err := fatfs.MinimalFormat(src, &opts)
+	if err != nil {
+		return 1, err
+	}
+	opts.Format = *format
+
+	f, err := os.Create(out)
+	if err != nil {
+		return 1, err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 1, err
+	}
+	dst, err := fatfs.NewImageFile(out)
+	if err != nil {
+		return 1, err
+	}
+	defer dst.Close()
+	if err := fatfs.BuildImage(dst, src, &opts); err != nil {
+		return 1, err
+	}
+
+	report, err := fatfs.Check(dst, &fatfs.CheckOptions{CodePage: opts.CodePage})
+	if err != nil {
+		return 1, err
+	}
+	if !report.OK() {
+		return 1, fmt.Errorf("%s: %d problems in the new image", out, len(report.Problems))
+	}
+	fmt.Printf("%s: %s, %d clusters of %d bytes, %d bytes (was %d)\n",
+		out, report.Type, report.Clusters, report.ClusterSize, size, img.dev.GetSectorCount()*fatfs.SectorSize)
+	return 0, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const mkimageUsage = "mkimage [-size n] [-type t] [-cluster n] [-label l] [-serial xxxx-xxxx] [-tz zone] [-shortnames mode] [-codepage n] [-nfc] [-sanitize] [-sfd] [-hidden glob] [-system glob] [-readonly glob] dir image"
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix,
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n-1] | 0x20 {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+		if shift != 0 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 || v > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v << shift, nil
+}
+
+// sizeFlag is a flag.Value holding a size accepted by parseSize.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string { return strconv.FormatInt(int64(*s), 10) }
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	*s = sizeFlag(n)
+	return err
+}
+
+func parseType(s string) (fatfs.Type, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return 0, nil
+	case "fat12":
+		return fatfs.TypeFAT12, nil
+	case "fat16":
+		return fatfs.TypeFAT16, nil
+	case "fat32":
+		return fatfs.TypeFAT32, nil
+	case "exfat":
+		return fatfs.TypeEXFAT, nil
+	}
+	return 0, fmt.Errorf("unknown filesystem type %q", s)
+}
+
+// parseSerial parses a volume serial number written as XXXX-XXXX or as a
+// plain hexadecimal number.
+func parseSerial(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.Replace(s, "-", "", 1), 16, 32)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("invalid serial number %q", s)
+	}
+	return uint32(v), nil
+}
+
+// attrRules is a flag.Value collecting attribute rules for one attribute.
+type attrRules struct {
+	rules *[]fatfs.AttrRule
+	attr  fatfs.FileAttr
+}
+
+func (a attrRules) String() string { return "" }
+
+func (a attrRules) Set(pattern string) error {
+	*a.rules = append(*a.rules, fatfs.AttrRule{Pattern: pattern, Attr: a.attr})
+	return nil
+}
+
+func runMkimage(args []string) (int, error) {
+	flags := newFlagSet("mkimage", mkimageUsage)
+	var opts fatfs.BuildOptions
+	var size, cluster, extra sizeFlag
+	flags.Var(&size, "size", "image `size`, e.g. 256M; default fits the tree")
+	flags.Var(&extra, "extra", "free `space` to leave when fitting the image to the tree")
+	flags.Var(&cluster, "cluster", "cluster `size` in bytes, default depends on the volume size")
+	typ := flags.String("type", "", "filesystem `type`: fat12, fat16, fat32 or exfat, default depends on the size")
+	flags.StringVar(&opts.Label, "label", "", "volume `label`")
+	serial := flags.String("serial", "", "volume `serial` number, default derived from the time (see SOURCE_DATE_EPOCH)")
+	tz := flags.String("tz", "", "time `zone` to write timestamps in: Local (default), UTC or a name like Europe/Berlin")
+	shortNames := flags.String("shortnames", "tail", "short name `mode`: tail, notail or only (no long names)")
+	flags.IntVar(&opts.CodePage, "codepage", 437, "OEM code `page` of short names and the label, e.g. 850 or 932")
+	flags.BoolVar(&opts.Names.NFC, "nfc", false, "normalize names to Unicode NFC, as macOS hosts give them decomposed")
+	flags.BoolVar(&opts.Names.Sanitize, "sanitize", false, "replace characters FAT does not allow instead of failing")
+	flags.BoolVar(&opts.Format.NoPartitionTable, "sfd", false, "format the whole image without a partition table")
+	flags.Var(attrRules{&opts.Attrs, fatfs.AttrHidden}, "hidden", "mark files matching `glob` hidden (repeatable)")
+	flags.Var(attrRules{&opts.Attrs, fatfs.AttrSystem}, "system", "mark files matching `glob` system (repeatable)")
+	flags.Var(attrRules{&opts.Attrs, fatfs.AttrReadOnly}, "readonly", "mark files matching `glob` read-only (repeatable)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	var err error
+	if opts.Format.Type, err = parseType(*typ); err != nil {
+		return 2, err
+	}
+	if opts.Format.Location, err = parseZone(*tz); err != nil {
+		return 2, err
+	}
+	if opts.ShortNames, err = fatfs.ParseShortNameMode(*shortNames); err != nil {
+		return 2, err
+	}
+	if *serial != "" {
+		if opts.Format.Serial, err = parseSerial(*serial); err != nil {
+			return 2, err
+		}
+	}
+	opts.Format.ClusterSize = uint32(cluster)
+	opts.ExtraSpace = int64(extra)
+
+	dir, name := flags.Arg(0), flags.Arg(1)
+	if info, err := os.Stat(dir); err != nil {
+		return 1, err
+	} else if !info.IsDir() {
+		return 1, fmt.Errorf("%s: not a directory", dir)
+	}
+	src := os.DirFS(dir)
+	if size == 0 {
+		n, err := fatfs.EstimateImageSize(src, &opts)
+		if err != nil {
+			return 1, err
+		}
+		size = sizeFlag(n)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return 1, err
+	}
+	err = f.Truncate(int64(size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 1, err
+	}
+	img, err := fatfs.NewImageFile(name)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	if err := fatfs.BuildImage(img, src, &opts); err != nil {
+		return 1, err
+	}
+	fmt.Printf("%s: %d bytes\n", name, size)
+	return 0, nil
+}
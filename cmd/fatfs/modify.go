@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const (
+	mvUsage     = "mv [-partition n | -offset bytes] [-tz zone] image source ... target"
+	rmUsage     = "rm [-r] [-f] [-partition n | -offset bytes] [-tz zone] image path ..."
+	mkdirUsage  = "mkdir [-p] [-partition n | -offset bytes] [-tz zone] image path ..."
+	touchUsage  = "touch [-d time] [-partition n | -offset bytes] [-tz zone] image path ..."
+	attribUsage = "attrib [-partition n | -offset bytes] [-tz zone] image [+-rhsa ...] path ..."
+	labelUsage  = "label [-partition n | -offset bytes] [-tz zone] image [new-label]"
+)
+
+func runMv(args []string) (int, error) {
+	flags := newFlagSet("mv", mvUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 3 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), true)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	srcs := flags.Args()[1 : flags.NArg()-1]
+	dst := cleanPath(flags.Arg(flags.NArg() - 1))
+	info, err := img.fs.Stat(dst)
+	into := err == nil && info.IsDir()
+	if len(srcs) > 1 && !into {
+		return 1, fmt.Errorf("%s: not a directory", dst)
+	}
+
+	status := 0
+	for _, src := range srcs {
+		src = cleanPath(src)
+		target := dst
+		if into {
+			target = path.Join(dst, path.Base(src))
+		}
+		if err := img.fs.Rename(src, target); err != nil {
+			fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", src, err)
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+func runRm(args []string) (int, error) {
+	flags := newFlagSet("rm", rmUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	recursive := flags.Bool("r", false, "remove directories and their contents")
+	force := flags.Bool("f", false, "ignore paths that do not exist")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), true)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	status := 0
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		if p == "/" {
+			fmt.Fprintln(os.Stderr, "fatfs: refusing to remove the root directory")
+			status = 1
+			continue
+		}
+		if *recursive {
+			err = img.fs.RemoveAll(p)
+		} else {
+			err = img.fs.Remove(p)
+		}
+		if err != nil && !(*force && errors.Is(err, os.ErrNotExist)) {
+			fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", p, err)
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+func runMkdir(args []string) (int, error) {
+	flags := newFlagSet("mkdir", mkdirUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	parents := flags.Bool("p", false, "create missing parents, existing directories are not an error")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), true)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	status := 0
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		if *parents {
+			err = img.fs.MkdirAll(p, 0o755)
+		} else {
+			err = img.fs.Mkdir(p, 0o755)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", p, err)
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// touchLayouts are the time formats accepted by touch -d.
+var touchLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseTouchTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range touchLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want e.g. 2006-01-02 15:04:05", s)
+}
+
+func runTouch(args []string) (int, error) {
+	flags := newFlagSet("touch", touchUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	date := flags.String("d", "", "use `time` instead of the current time, in the image's time zone unless given")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), true)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	mtime := time.Now()
+	if *date != "" {
+		// a time without a zone is in the image's time zone
+		if mtime, err = parseTouchTime(*date, img.fs.Location()); err != nil {
+			return 2, err
+		}
+	}
+
+	status := 0
+	for _, p := range flags.Args()[1:] {
+		p = cleanPath(p)
+		if err := touch(img.fs, p, mtime); err != nil {
+			fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", p, err)
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// touch creates name if it does not exist and sets its modification time.
+func touch(fs *fatfs.FatFs, name string, mtime time.Time) error {
+	if _, err := fs.Stat(name); errors.Is(err, os.ErrNotExist) {
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return fs.Chtimes(name, mtime, mtime)
+}
+
+// attribFlags maps the letters of attrib arguments to attributes.
+var attribFlags = map[byte]fatfs.FileAttr{
+	'r': fatfs.AttrReadOnly,
+	'h': fatfs.AttrHidden,
+	's': fatfs.AttrSystem,
+	'a': fatfs.AttrArchive,
+}
+
+// parseAttrib parses an attrib argument such as "+r" or "-hs". ok is false
+// if arg is not one.
+func parseAttrib(arg string) (attr, mask fatfs.FileAttr, ok bool) {
+	if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') {
+		return 0, 0, false
+	}
+	for i := 1; i < len(arg); i++ {
+		a, found := attribFlags[arg[i]|0x20]
+		if !found {
+			return 0, 0, false
+		}
+		mask |= a
+	}
+	if arg[0] == '+' {
+		attr = mask
+	}
+	return attr, mask, true
+}
+
+func runAttrib(args []string) (int, error) {
+	flags := newFlagSet("attrib", attribUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	// leading +x/-x arguments change attributes, without any only show them
+	var set, mask fatfs.FileAttr
+	paths := flags.Args()[1:]
+	for len(paths) > 0 {
+		a, m, ok := parseAttrib(paths[0])
+		if !ok {
+			break
+		}
+		set, mask = set&^m|a, mask|m
+		paths = paths[1:]
+	}
+	if len(paths) == 0 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	img, err := imgFlags.mount(flags.Arg(0), mask != 0)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	status := 0
+	for _, p := range paths {
+		p = cleanPath(p)
+		if mask != 0 {
+			if err := img.fs.SetAttr(p, set, mask); err != nil {
+				fmt.Fprintf(os.Stderr, "fatfs: %s: %v\n", p, err)
+				status = 1
+				continue
+			}
+		}
+		info, err := img.stat(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fatfs:", err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s %s\n", attrString(info.Attr()), p)
+	}
+	return status, nil
+}
+
+func runLabel(args []string) (int, error) {
+	flags := newFlagSet("label", labelUsage)
+	var imgFlags imageFlags
+	imgFlags.register(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2, nil
+	}
+
+	write := flags.NArg() == 2
+	img, err := imgFlags.mount(flags.Arg(0), write)
+	if err != nil {
+		return 1, err
+	}
+	defer img.Close()
+
+	if write {
+		if err := img.fs.SetLabel(flags.Arg(1)); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	label, _, err := img.fs.Label()
+	if err != nil {
+		return 1, err
+	}
+	fmt.Println(label)
+	return 0, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+const resizeUsage = "resize [-size bytes | -min] [-n] [-partition n | -offset bytes] image"
+
+func runResize(args []string) (int, error) {
+	flags := newFlagSet("resize", resizeUsage)
+	var size sizeFlag
+	flags.Var(&size, "size", "grow the image file to `bytes` (k, m, g suffixes) first, then the volume to fill it")
+	shrink := flags.Bool("min", false, "shrink the volume to the files on it and cut the image file after it")
+	dryRun := flags.Bool("n", false, "only report how far the volume can be resized")
+	var imgFlags imageFlags
+	imgFlags.registerDevice(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 1 || size != 0 && *shrink {
+		flags.Usage()
+		return 2, nil
+	}
+
+	name := flags.Arg(0)
+	raw := !strings.EqualFold(path.Ext(name), ".vhd")
+	if size != 0 {
+		if !raw {
+			return 1, fmt.Errorf("%s: -size only works on raw image files", name)
+		}
+		if size%fatfs.SectorSize != 0 {
+			return 1, fmt.Errorf("size %d is not a multiple of the sector size", size)
+		}
+		st, err := os.Stat(name)
+		if err != nil {
+			return 1, err
+		}
+		if int64(size) < st.Size() {
+			return 1, fmt.Errorf("%s: size %d is smaller than the image, use -min to shrink it", name, size)
+		}
+		if !*dryRun {
+			if err := os.Truncate(name, int64(size)); err != nil {
+				return 1, err
+			}
+		}
+	}
+
+	// The partition table is part of the resize, so open the whole image
+	// and let Resize find the partition.
+	opts := &fatfs.ResizeOptions{Partition: imgFlags.partition}
+	imgFlags.partition = 0
+	dev, closer, err := imgFlags.openDevice(name, !*dryRun)
+	if err != nil {
+		return 1, err
+	}
+	defer closer.Close()
+
+	rng, err := fatfs.ResizeLimits(dev, opts)
+	if err != nil {
+		return 1, err
+	}
+	if *dryRun {
+		fmt.Printf("%s: volume of %s at sector %d, can be resized from %s to %s\n", name,
+			sectors(rng.Sectors), rng.Start, sectors(rng.Min), sectors(rng.Max))
+		if rng.DeviceMin < dev.GetSectorCount() {
+			fmt.Printf("%s: shrunk, the image can be cut to %s\n", name, sectors(rng.DeviceMin))
+		}
+		return 0, nil
+	}
+
+	target := rng.Max
+	if *shrink {
+		target = rng.Min
+	}
+	if err := fatfs.Resize(dev, target, opts); err != nil {
+		return 1, err
+	}
+	fmt.Printf("%s: resized volume from %s to %s\n", name, sectors(rng.Sectors), sectors(target))
+
+	if !*shrink || rng.DeviceMin >= dev.GetSectorCount() {
+		return 0, nil
+	}
+	if !raw {
+		fmt.Printf("%s: the image can be cut to %s\n", name, sectors(rng.DeviceMin))
+		return 0, nil
+	}
+	// move the backup GPT, if any, to the new end before cutting the file
+	end, err := fatfs.NewSectionDevice(dev, 0, rng.DeviceMin)
+	if err != nil {
+		return 1, err
+	}
+	if err := fatfs.Resize(end, target, opts); err != nil {
+		return 1, err
+	}
+	if err := closer.Close(); err != nil {
+		return 1, err
+	}
+	cut := imgFlags.offset + int64(rng.DeviceMin)*fatfs.SectorSize
+	if err := os.Truncate(name, cut); err != nil {
+		return 1, fmt.Errorf("%s: cutting the image: %w", name, err)
+	}
+	fmt.Printf("%s: cut image to %d bytes\n", name, cut)
+	return 0, nil
+}
+
+// sectors formats a number of sectors as bytes.
+func sectors(n uint64) string {
+	return fmt.Sprintf("%d bytes", n*fatfs.SectorSize)
+}
@@ -0,0 +1,76 @@
+package fatfs
+
+/*
+#include "ff.h"
+
+FSIZE_t fatfs_tell(FIL* fp);
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Allocate makes the file at least size bytes long, allocating its clusters
+// now so that writes up to size cannot run out of space. The content of the
+// added space is undefined and the file position is kept. The file must be
+// open for writing.
+//
+// With contiguous the clusters are allocated as one run, as needed by
+// loaders that read a file without following the FAT. This only works on an
+// empty file and fails with FileResultDenied if there is no free run large
+// enough. Truncating the file afterwards keeps it contiguous.
+func (f *FatFile) Allocate(size int64, contiguous bool) error {
+	Logger.Println("CALL Allocate", f.info.name, size, contiguous)
+	if f.info.IsDir() {
+		return FileResultInvalidObject
+	}
+	cur := int64(f.fil.obj.objsize)
+	if contiguous {
+		if cur != 0 {
+			return errors.New("contiguous allocation needs an empty file")
+		}
+		if size == 0 {
+			return nil
+		}
+		err := errval(C.f_expand(f.fil, C.FSIZE_t(size), 1))
+		if errors.Is(err, FileResultDenied) {
+			return fmt.Errorf("no contiguous free space for %d bytes: %w", size, err)
+		}
+		return err
+	}
+	if size <= cur {
+		return nil
+	}
+
+	// seeking beyond the end of a file open for writing extends it
+	pos := C.fatfs_tell(f.fil)
+	if err := errval(C.f_lseek(f.fil, C.FSIZE_t(size))); err != nil {
+		return err
+	}
+	if err := errval(C.f_lseek(f.fil, pos)); err != nil {
+		return err
+	}
+	if int64(f.fil.obj.objsize) < size {
+		return errors.New("volume is full")
+	}
+	return nil
+}
+
+// CreateAllocated creates or truncates the file name like Create and then
+// allocates size bytes for it with Allocate. If the allocation fails, the
+// file is removed.
+func (f *FatFs) CreateAllocated(name string, size int64, contiguous bool) (*FatFile, error) {
+	Logger.Println("CALL CreateAllocated", name, size, contiguous)
+	file, err := f.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Allocate(size, contiguous); err != nil {
+		file.Close()
+		f.Remove(name)
+		return nil, err
+	}
+	return file, nil
+}
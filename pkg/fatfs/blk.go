@@ -9,3 +9,10 @@ type BlockDevice interface {
 	Initialize() error
 	Status() error
 }
+
+// Syncer is implemented by BlockDevices that can make previous writes
+// durable. FatFs asks for this (CTRL_SYNC) whenever it finishes updating
+// the volume, e.g. on f_sync, f_close and directory changes.
+type Syncer interface {
+	Sync() error
+}
@@ -0,0 +1,440 @@
+package fatfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// AttrRule sets attributes on the files of a built image whose path matches
+// Pattern. Patterns use path.Match syntax; one without a slash matches the
+// base name anywhere in the tree, one with a slash matches the whole path
+// relative to the root, e.g. "boot/*.bin".
+type AttrRule struct {
+	Pattern string
+	Attr    FileAttr
+}
+
+// matchGlob matches a slash-separated path relative to the root against a
+// pattern as described for AttrRule.
+func matchGlob(pattern, name string) (bool, error) {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	return path.Match(pattern, name)
+}
+
+// BuildOptions controls BuildImage and EstimateImageSize.
+type BuildOptions struct {
+	// Format is the layout of the new volume.
+	Format FormatOptions
+	// Label is the volume label, empty for none.
+	Label string
+	// Attrs are applied in order to every file and directory; all matching
+	// rules add their attributes.
+	Attrs []AttrRule
+	// ExtraSpace is the free space in bytes EstimateImageSize leaves on top
+	// of what the tree needs.
+	ExtraSpace int64
+	// ShortNames is how short names are made on FAT volumes.
+	ShortNames ShortNameMode
+	// CodePage is the OEM code page of short names and the label, see
+	// MountOptions.
+	CodePage int
+	// Names is applied to every name of the tree. Names that are invalid
+	// after it, or that then collide with another name of their directory,
+	// are an error.
+	Names NamePolicy
+}
+
+// BuildImage formats dst and copies the tree src into it. Unless set in
+// opts, the FAT12/16 root directory is made large enough for the root of
+// src. Modification times are preserved where src provides them, and
+// attributes where src is another volume (see AsIO); symbolic links to
+// files are followed, any other non-regular file is an error.
+//
+// Timestamps are written in opts.Format.Location. Entries are written in
+// lexical order and all other timestamps come from opts.Format.Clock, so
+// with a fixed clock, a fixed serial or SOURCE_DATE_EPOCH set, the same
+// tree always gives the same image. dst must not be mounted.
+func BuildImage(dst BlockDevice, src fs.FS, opts *BuildOptions) error {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	format := opts.Format
+	if format.RootEntries == 0 && format.Type != TypeFAT32 && format.Type != TypeEXFAT {
+		ents, err := fs.ReadDir(src, ".")
+		if err != nil {
+			return err
+		}
+		slots := 0
+		for _, ent := range ents {
+			slots += fatSlots(ent.Name())
+		}
+		format.RootEntries = rootEntries(slots)
+	}
+	if err := Format(dst, &format); err != nil {
+		return err
+	}
+
+	fatfs, err := mountFree(dst, &MountOptions{CodePage: opts.CodePage})
+	if err != nil {
+		return err
+	}
+	fatfs.SetClock(opts.Format.Clock)
+	fatfs.SetLocation(opts.Format.Location)
+	fatfs.SetShortNameMode(opts.ShortNames)
+	b := &builder{fs: fatfs, src: src, opts: opts, dsts: map[string]string{".": ""}, used: make(map[string]string)}
+	err = b.build()
+	if uerr := fatfs.Unmount(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// mountFree mounts blk on the first unused drive number.
+func mountFree(blk BlockDevice, opts *MountOptions) (*FatFs, error) {
+	for _, pdrv := range freeDrives() {
+		fs, err := NewFatFs(int(pdrv))
+		if err != nil {
+			return nil, err
+		}
+		// another mount may have taken the drive since
+		if err := fs.MountWith(blk, opts); errors.Is(err, ErrDriveInUse) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+	return nil, errors.New("all drives are in use")
+}
+
+type builder struct {
+	fs   *FatFs
+	src  fs.FS
+	opts *BuildOptions
+	// dirs are finished last, after their contents were written.
+	dirs []dirTimes
+	// dsts maps directories of src to their path on the volume, which
+	// differs when opts.Names changed a name.
+	dsts map[string]string
+	// used maps the upper-case volume paths written so far to their source
+	// path, to detect names that collide on FAT.
+	used map[string]string
+}
+
+type dirTimes struct {
+	name, dst string
+	info      fs.FileInfo
+}
+
+// dstPath returns the path on the volume for the entry name of src.
+func (b *builder) dstPath(name string) (string, error) {
+	dir, base := path.Split(name)
+	parent := b.dsts[path.Clean(dir)]
+	base, err := b.opts.Names.Apply(base)
+	if err != nil {
+		return "", err
+	}
+	dst := parent + "/" + base
+	key := strings.ToUpper(dst)
+	if prev, ok := b.used[key]; ok {
+		return "", fmt.Errorf("name collides with %s on the volume", prev)
+	}
+	b.used[key] = name
+	return dst, nil
+}
+
+func (b *builder) build() error {
+	if b.opts.Label != "" {
+		if err := b.fs.SetLabel(b.opts.Label); err != nil {
+			return fmt.Errorf("failed to set label: %w", err)
+		}
+	}
+	err := fs.WalkDir(b.src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := fs.Stat(b.src, name)
+		if err != nil {
+			return err
+		}
+		dst, err := b.dstPath(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		switch {
+		case info.IsDir() && d.IsDir():
+			if err := b.fs.Mkdir(dst, 0o755); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			b.dsts[name] = dst
+			b.dirs = append(b.dirs, dirTimes{name, dst, info})
+			return nil
+		case info.IsDir():
+			return fmt.Errorf("%s: symbolic links to directories are not supported", name)
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("%s: unsupported file type %s", name, info.Mode().Type())
+		}
+		if err := b.copyFile(name, dst); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return b.finish(name, dst, info)
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range b.dirs {
+		if err := b.finish(d.name, d.dst, d.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) copyFile(name, dst string) error {
+	in, err := b.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := b.fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// finish sets the modification time and attributes of name, written to
+// dst.
+func (b *builder) finish(name, dst string, info fs.FileInfo) error {
+	if mtime := info.ModTime(); !mtime.IsZero() {
+		if err := b.fs.Chtimes(dst, mtime, mtime); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	var attr, mask FileAttr
+	// a tree on another volume brings its attributes along
+	if fi, ok := info.(interface{ Attr() FileAttr }); ok {
+		mask = AttrReadOnly | AttrHidden | AttrSystem | AttrArchive
+		attr = fi.Attr() & mask
+	}
+	for _, r := range b.opts.Attrs {
+		ok, err := matchGlob(r.Pattern, name)
+		if err != nil {
+			return fmt.Errorf("bad attribute pattern %q: %w", r.Pattern, err)
+		}
+		if ok {
+			attr |= r.Attr
+			mask |= r.Attr
+		}
+	}
+	attr &^= AttrDirectory
+	if mask &^= AttrDirectory; mask != 0 {
+		if err := b.fs.SetAttr(dst, attr, mask); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// treeSize is what a tree needs on a volume, independent of the cluster
+// size.
+type treeSize struct {
+	files []int64
+	// fatSlots and exfatSlots are the directory entries per directory,
+	// including dot entries on FAT. The root directory comes first.
+	fatSlots   []int
+	exfatSlots []int
+}
+
+func measureTree(src fs.FS) (*treeSize, error) {
+	t := &treeSize{}
+	var measure func(dir string) error
+	measure = func(dir string) error {
+		ents, err := fs.ReadDir(src, dir)
+		if err != nil {
+			return err
+		}
+		fat, exfat := 0, 0
+		if dir != "." {
+			fat = 2
+		}
+		i := len(t.fatSlots)
+		t.fatSlots = append(t.fatSlots, 0)
+		t.exfatSlots = append(t.exfatSlots, 0)
+		for _, ent := range ents {
+			n := len(utf16.Encode([]rune(ent.Name())))
+			fat += fatSlots(ent.Name())
+			exfat += 2 + (n+14)/15
+
+			name := path.Join(dir, ent.Name())
+			info, err := fs.Stat(src, name)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if !ent.IsDir() {
+					return fmt.Errorf("%s: symbolic links to directories are not supported", name)
+				}
+				if err := measure(name); err != nil {
+					return err
+				}
+				continue
+			}
+			t.files = append(t.files, info.Size())
+		}
+		t.fatSlots[i], t.exfatSlots[i] = fat, exfat
+		return nil
+	}
+	if err := measure("."); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// fatSlots returns the number of FAT directory entries for name. Every
+// name is assumed to need an LFN, valid short names are rare.
+func fatSlots(name string) int {
+	return 1 + (len(utf16.Encode([]rune(name)))+12)/13
+}
+
+// rootEntries returns the default FAT12/16 root directory size for a root
+// of slots entries, within the 32768 entries f_mkfs accepts.
+func rootEntries(slots int) uint32 {
+	return uint32(min(32768, max(512, (slots+15)/16*16)))
+}
+
+// clusters returns the number of clusters of csize bytes the tree uses.
+func (t *treeSize) clusters(typ Type, csize uint64) uint64 {
+	var n uint64
+	for _, size := range t.files {
+		n += (uint64(size) + csize - 1) / csize
+	}
+	slots := t.fatSlots
+	if typ == TypeEXFAT {
+		slots = t.exfatSlots
+	}
+	for _, s := range slots {
+		n += max(1, (uint64(s)*dirEntrySize+csize-1)/csize)
+	}
+	return n
+}
+
+// autoClusterSectors mirrors the cluster size f_mkfs picks for a volume of
+// the given number of sectors.
+func autoClusterSectors(typ Type, sectors uint64) uint64 {
+	switch typ {
+	case TypeEXFAT:
+		switch {
+		case sectors >= 0x4000000:
+			return 256
+		case sectors >= 0x80000:
+			return 64
+		}
+		return 8
+	case TypeFAT32:
+		pau := uint64(1)
+		for _, c := range []uint64{1, 2, 4, 8, 16, 32} {
+			if c > sectors/0x20000 {
+				break
+			}
+			pau <<= 1
+		}
+		return pau
+	}
+	pau := uint64(1)
+	for _, c := range []uint64{1, 4, 16, 64, 256, 512} {
+		if c > sectors/0x1000 {
+			break
+		}
+		pau <<= 1
+	}
+	return pau
+}
+
+// EstimateImageSize returns a device size in bytes, rounded up to a MiB,
+// that holds the tree src when formatted with opts.Format, plus
+// opts.ExtraSpace and a little headroom.
+func EstimateImageSize(src fs.FS, opts *BuildOptions) (int64, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	tree, err := measureTree(src)
+	if err != nil {
+		return 0, err
+	}
+
+	nfats := uint64(max(opts.Format.NumFATs, 1))
+	nroot := uint64(opts.Format.RootEntries)
+	if nroot == 0 {
+		nroot = uint64(rootEntries(tree.fatSlots[0]))
+	}
+
+	// the cluster size depends on the volume size, iterate until the
+	// volume is large enough for the clusters it gets
+	var sectors uint64
+	for {
+		typ := opts.Format.Type
+		switch {
+		case typ == 0 && sectors >= 0x4000000:
+			typ = TypeEXFAT
+		case typ == 0 && sectors >= 0x400000:
+			typ = TypeFAT32
+		case typ == 0 || typ == TypeFAT12:
+			typ = TypeFAT16
+		}
+		csect := uint64(opts.Format.ClusterSize) / SectorSize
+		if csect == 0 {
+			csect = autoClusterSectors(typ, sectors)
+		}
+		csize := csect * SectorSize
+		nclst := tree.clusters(typ, csize)
+		nclst += nclst/20 + 16 + (uint64(opts.ExtraSpace)+csize-1)/csize
+		if typ == TypeFAT32 && nclst <= maxFAT16 {
+			nclst = maxFAT16 + 1
+		}
+
+		// partition table, boot sectors and FATs with room for alignment
+		need := 2048 + nclst*csect
+		switch typ {
+		case TypeEXFAT:
+			bitmap := (nclst + 7) / 8
+			upcase := uint64(6 * 1024)
+			need += 24 + (nclst*4+SectorSize-1)/SectorSize +
+				((bitmap+csize-1)/csize+(upcase+csize-1)/csize)*csect
+			// f_mkfs makes no smaller exFAT volume, and starts the
+			// partition at the second track
+			floor := uint64(0x1000)
+			if !opts.Format.NoPartitionTable {
+				floor += 63
+			}
+			need = max(need, floor)
+		case TypeFAT32:
+			need += 32 + nfats*((nclst+2)*4+SectorSize-1)/SectorSize
+		default:
+			need += 1 + nfats*((nclst+2)*2+SectorSize-1)/SectorSize +
+				nroot*dirEntrySize/SectorSize
+		}
+		if need <= sectors {
+			break
+		}
+		sectors = need
+	}
+
+	const mib = 1 << 20
+	return int64((sectors*SectorSize + mib - 1) / mib * mib), nil
+}
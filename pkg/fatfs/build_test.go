@@ -0,0 +1,37 @@
+package fatfs_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// An image of the estimated size holds the tree, also where f_mkfs needs
+// more than the tree does.
+func TestEstimateImageSize(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format fatfs.FormatOptions
+		tree   fstest.MapFS
+	}{
+		{"fat16", fatfs.FormatOptions{}, testTree()},
+		{"exfat-empty", fatfs.FormatOptions{Type: fatfs.TypeEXFAT}, fstest.MapFS{}},
+		{"exfat-empty-nopart", fatfs.FormatOptions{Type: fatfs.TypeEXFAT, NoPartitionTable: true}, fstest.MapFS{}},
+		{"exfat", fatfs.FormatOptions{Type: fatfs.TypeEXFAT}, testTree()},
+		{"fat32", fatfs.FormatOptions{Type: fatfs.TypeFAT32}, testTree()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &fatfs.BuildOptions{Format: tc.format}
+			size, err := fatfs.EstimateImageSize(tc.tree, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev := fatfs.NewMemDevice(size)
+			if err := fatfs.BuildImage(dev, tc.tree, opts); err != nil {
+				t.Fatalf("image of %d bytes: %v", size, err)
+			}
+			checkTree(t, dev, tc.tree)
+		})
+	}
+}
@@ -32,14 +32,23 @@ FSIZE_t fatfs_tell(FIL* fp) {
     return f_tell(fp);
 }
 
+// The current drive is per thread, so select it in the same call.
+FRESULT getcwd_drive(const TCHAR* drv, TCHAR* buff, UINT len) {
+	FRESULT res = f_chdrive(drv);
+	if (res == FR_OK) res = f_getcwd(buff, len);
+	return res;
+}
+
 */
 import "C"
 import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"os"
-	"path/filepath"
+	pathpkg "path"
 	"strings"
 	"time"
 	"unsafe"
@@ -61,6 +70,9 @@ type FatFile struct {
 	fs  *FatFs
 	fil *C.FIL
 	dir *C.FF_DIR
+	// clmt is the cluster link map table in fast seek mode, allocated in C
+	// as FatFs keeps a pointer to it.
+	clmt *C.DWORD
 
 	info FileInfo
 
@@ -73,6 +85,7 @@ type FileInfo struct {
 	isDir   bool
 	modTime time.Time
 	mode    os.FileMode
+	attr    FileAttr
 	sys     interface{}
 }
 
@@ -83,6 +96,54 @@ func (fi FileInfo) ModTime() time.Time { return fi.modTime }
 func (fi FileInfo) Mode() os.FileMode  { return fi.mode }
 func (fi FileInfo) Sys() interface{}   { return fi.sys }
 
+// Attr returns the FAT attributes of the file.
+func (fi FileInfo) Attr() FileAttr { return fi.attr }
+
+// Type and Info make FileInfo an fs.DirEntry, as returned by Walk.
+func (fi FileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi FileInfo) Info() (fs.FileInfo, error) { return &fi, nil }
+
+// FileStat is the FAT directory entry of a file, returned by the Sys method
+// of the FileInfo of a file on a FatFs volume.
+type FileStat struct {
+	Attr FileAttr
+	// ShortName is the 8.3 name, empty on exFAT which has none.
+	ShortName string
+	Created   time.Time
+	Modified  time.Time
+	// Cluster is the first cluster of the file, 0 if no cluster is
+	// allocated.
+	Cluster uint32
+}
+
+// newFileInfo converts a FILINFO filled in by FatFs.
+func newFileInfo(info *C.FILINFO, loc *time.Location) *FileInfo {
+	attr := FileAttr(info.fattrib)
+	mode := os.FileMode(0o777)
+	if attr&AttrReadOnly != 0 {
+		mode = 0o555
+	}
+	if attr&AttrDirectory != 0 {
+		mode |= os.ModeDir
+	}
+	modTime := fatTime(uint16(info.fdate), uint16(info.ftime), loc)
+	return &FileInfo{
+		name:    C.GoString(&info.fname[0]),
+		size:    int64(info.fsize),
+		isDir:   attr&AttrDirectory != 0,
+		modTime: modTime,
+		mode:    mode,
+		attr:    attr,
+		sys: &FileStat{
+			Attr:      attr,
+			ShortName: C.GoString(&info.altname[0]),
+			Created:   fatTime(uint16(info.crdate), uint16(info.crtime), loc),
+			Modified:  modTime,
+			Cluster:   uint32(info.fclust),
+		},
+	}
+}
+
 var _ os.FileInfo = FileInfo{}
 
 // NewFatFs allocates a new FATFS struct in C.
@@ -105,19 +166,49 @@ func NewFatFs(volume int) (*FatFs, error) {
 }
 
 func (f *FatFs) Name() string {
-	fmt.Println("CALL Name")
+	Logger.Println("CALL Name")
 	return "FatFs"
 }
 
-// Mount calls f_mount internally.
+// MountOptions controls MountWith.
+type MountOptions struct {
+	// CodePage is the OEM code page of short names and labels: 437 (US,
+	// the default for zero), 720, 737, 771, 775, 850 (Western Europe), 852,
+	// 855, 857, 860, 861, 862, 863, 864, 865, 866, 869, 932 (Japanese),
+	// 936 (Simplified Chinese), 949 (Korean) or 950 (Traditional Chinese).
+	CodePage int
+}
+
+// Mount calls f_mount internally. It fails with ErrDriveInUse when another
+// FatFs or device holds the drive number.
 func (f *FatFs) Mount(blk BlockDevice) error {
+	return f.MountWith(blk, nil)
+}
+
+// MountWith mounts blk like Mount, with options.
+func (f *FatFs) MountWith(blk BlockDevice, opts *MountOptions) error {
+	if opts == nil {
+		opts = &MountOptions{}
+	}
+	if err := claimDrive(f.volNumber, blk, f); err != nil {
+		return err
+	}
+	cp := opts.CodePage
+	if cp == 0 {
+		cp = 437
+	}
+	if cp < 0 || cp > 0xFFFF || errval(C.f_setcp(C.WORD(cp))) != nil {
+		releaseDrive(f.volNumber, f)
+		return fmt.Errorf("unsupported code page: %d", cp)
+	}
+	f.fs.codepage = C.WORD(cp)
+
 	cpath := C.CString(f.volPrefix)
 	defer C.free(unsafe.Pointer(cpath))
 
-	RegisterBlockDevice(f.volNumber, blk)
-
 	res := C.f_mount(f.fs, (*C.TCHAR)(unsafe.Pointer(cpath)), C.BYTE(0))
 	if res != 0 {
+		releaseDrive(f.volNumber, f)
 		return fmt.Errorf("f_mount error code: %d", res)
 	}
 
@@ -128,6 +219,10 @@ func (f *FatFs) Mount(blk BlockDevice) error {
 }
 
 func (f *FatFs) Unmount() error {
+	// leave the drive alone if another FatFs mounted it
+	if !ownsDrive(f.volNumber, f) {
+		return nil
+	}
 	for _, file := range f.openFiles {
 		file.Close() // TODO: handle errors
 	}
@@ -140,38 +235,64 @@ func (f *FatFs) Unmount() error {
 		return fmt.Errorf("f_unmount error code: %d", res)
 	}
 
-	UnregisterBlockDevice(f.volNumber)
+	releaseDrive(f.volNumber, f)
+	setDriveTime(f.volNumber, func(t *driveTime) { *t = driveTime{} })
+	setDriveShortNames(f.volNumber, ShortNameTail)
 	return nil
 }
 
+// Chmod sets or clears the read-only attribute, FAT has no other
+// permissions. A file is read-only when mode has no owner write bit.
 func (f *FatFs) Chmod(name string, mode os.FileMode) error {
-	fmt.Println("STUB Chmod", name, mode)
-	// return os.ErrPermission
-	return nil
+	Logger.Println("CALL Chmod", name, mode)
+	var attr FileAttr
+	if mode&0o200 == 0 {
+		attr = AttrReadOnly
+	}
+	return f.SetAttr(name, attr, AttrReadOnly)
+}
+
+// SetAttr changes the attributes of a file: those in mask are set to their
+// value in attr. Only AttrReadOnly, AttrHidden, AttrSystem and AttrArchive
+// can be changed.
+func (f *FatFs) SetAttr(name string, attr, mask FileAttr) error {
+	Logger.Println("CALL SetAttr", name, attr, mask)
+	cpath := C.CString(f.fatPath(name))
+	defer C.free(unsafe.Pointer(cpath))
+
+	return errval(C.f_chmod(cpath, C.BYTE(attr), C.BYTE(mask)))
 }
 
 func (f *FatFs) Chown(name string, uid, gid int) error {
-	fmt.Println("STUB Chown", name, uid, gid)
+	Logger.Println("STUB Chown", name, uid, gid)
 	// return os.ErrPermission
 	return nil
 }
 
+// Chtimes sets the modification time of a file. FAT does not store access
+// times, so atime is ignored.
 func (f *FatFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	fmt.Println("STUB Chtimes", name, atime, mtime)
-	return nil
+	Logger.Println("CALL Chtimes", name, atime, mtime)
+	cpath := C.CString(f.fatPath(name))
+	defer C.free(unsafe.Pointer(cpath))
+
+	info := C.FILINFO{}
+	date, tm := toFatTime(mtime, f.Location())
+	info.fdate, info.ftime = C.WORD(date), C.WORD(tm)
+	return errval(C.f_utime(cpath, &info))
 }
 
 func (f *FatFs) Open(path string) (*FatFile, error) {
-	fmt.Println("CALL Open", path)
+	Logger.Println("CALL Open", path)
 	return f.OpenFile(path, os.O_RDONLY, 0o644)
 }
 
 func (f *FatFs) OpenFile(path string, flags int, perm os.FileMode) (*FatFile, error) {
-	fmt.Println("CALL OpenFile", path, flags, uint32(perm))
+	Logger.Println("CALL OpenFile", path, flags, uint32(perm))
 	file := &FatFile{fs: f}
 	file.writeAppendMode = isWriteMode(flags) && isAppendMode(flags)
 
-	cpath := C.CString(f.volPrefix + path)
+	cpath := C.CString(f.fatPath(path))
 	defer C.free(unsafe.Pointer(cpath))
 
 	isDir := false
@@ -182,18 +303,18 @@ func (f *FatFs) OpenFile(path string, flags int, perm os.FileMode) (*FatFile, er
 	}
 
 	var errno C.FRESULT
-	if path == "/" || isDir {
-		fmt.Println("Opening directory:", path)
+	if isDir {
+		Logger.Println("Opening directory:", path)
 		file.dir = C.allocate_dir()
 		if file.dir == nil {
 			return nil, fmt.Errorf("failed to allocate DIR")
 		}
 		errno = C.f_opendir(file.dir, (*C.TCHAR)(unsafe.Pointer(cpath)))
 	} else {
-		fmt.Println("Opening file:", path)
+		Logger.Println("Opening file:", path)
 		file.fil = C.allocate_fil()
 		if file.fil == nil {
-			fmt.Println("Failed to allocate FIL")
+			Logger.Println("Failed to allocate FIL")
 			return nil, fmt.Errorf("failed to allocate FIL")
 		}
 		errno = C.f_open(file.fil, (*C.TCHAR)(unsafe.Pointer(cpath)), translateFlags(flags))
@@ -201,7 +322,7 @@ func (f *FatFs) OpenFile(path string, flags int, perm os.FileMode) (*FatFile, er
 
 	// check to make sure f_open/f_opendir didn't produce an error
 	if err := errval(errno); err != nil {
-		fmt.Println("f_open/f_opendir error:", err)
+		Logger.Println("f_open/f_opendir error:", err)
 		if file.dir != nil {
 			C.free(unsafe.Pointer(file.dir))
 			file.dir = nil
@@ -214,12 +335,12 @@ func (f *FatFs) OpenFile(path string, flags int, perm os.FileMode) (*FatFile, er
 	}
 
 	if file.info.name == "" {
-		fmt.Println("File info not found, getting from path")
+		Logger.Println("File info not found, getting from path")
 
 		// fill in the file info
 		infos, err = f.Stat(path)
 		if err != nil {
-			fmt.Println("OpenFile Stat error:", err)
+			Logger.Println("OpenFile Stat error:", err)
 			return nil, err
 		}
 		file.info = *infos.(*FileInfo)
@@ -232,100 +353,177 @@ func (f *FatFs) OpenFile(path string, flags int, perm os.FileMode) (*FatFile, er
 }
 
 func (f *FatFs) Create(name string) (afero.File, error) {
-	fmt.Println("CALL Create", name)
+	Logger.Println("CALL Create", name)
 	return f.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
 }
 
 func (f *FatFs) Remove(name string) error {
-	fmt.Println("CALL Remove", name)
+	Logger.Println("CALL Remove", name)
 
-	cpath := C.CString(f.volPrefix + name)
+	cpath := C.CString(f.fatPath(name))
 	defer C.free(unsafe.Pointer(cpath))
 
 	return errval(C.f_unlink(cpath))
 }
 
+// RemoveAll removes path and everything it contains. It is not an error if
+// path does not exist.
 func (f *FatFs) RemoveAll(path string) error {
-	if info, err := f.Stat(path); err == nil && !info.IsDir() {
+	Logger.Println("CALL RemoveAll", path)
+	info, err := f.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
 		return f.Remove(path)
 	}
 
-	fmt.Println("STUB RemoveAll (dir)", path)
-	return os.ErrInvalid
+	dir, err := f.Open(path)
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := f.RemoveAll(pathpkg.Join(path, info.Name())); err != nil {
+			return err
+		}
+	}
+	return f.Remove(path)
 }
 
+// Rename renames (moves) oldname to newname, which must not exist.
 func (f *FatFs) Rename(oldname, newname string) error {
-	fmt.Println("STUB Rename")
-	return nil
+	Logger.Println("CALL Rename", oldname, newname)
+	cold := C.CString(f.fatPath(oldname))
+	defer C.free(unsafe.Pointer(cold))
+	cnew := C.CString(f.fatPath(newname))
+	defer C.free(unsafe.Pointer(cnew))
+
+	return errval(C.f_rename(cold, cnew))
 }
 
+// Mkdir creates a directory. FAT has no permissions, perm is ignored.
 func (f *FatFs) Mkdir(name string, perm os.FileMode) error {
-	fmt.Println("STUB Mkdir", name, perm)
-	return nil
+	Logger.Println("CALL Mkdir", name, perm)
+	cpath := C.CString(f.fatPath(name))
+	defer C.free(unsafe.Pointer(cpath))
+
+	return errval(C.f_mkdir(cpath))
 }
 
+// MkdirAll creates the directory path and any missing parents, like
+// os.MkdirAll. It is not an error if path is a directory already.
 func (f *FatFs) MkdirAll(path string, perm os.FileMode) error {
-	fmt.Println("CALL MkdirAll", path, perm)
+	Logger.Println("CALL MkdirAll", path, perm)
+	path = pathpkg.Clean(path)
 
-	var err error
-	path, err = filepath.Abs(path)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
+	info, err := f.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("failed to create directory %s: not a directory", path)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check directory %s: %w", path, err)
 	}
 
-	// Split the path into components
-	currentPath := ""
-	for _, part := range strings.Split(path, "/") {
-		if part == "" {
-			continue
+	if parent := pathpkg.Dir(path); parent != path {
+		if err := f.MkdirAll(parent, perm); err != nil {
+			return err
 		}
+	}
+	Logger.Println("Creating directory:", path)
+	if err := f.Mkdir(path, perm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", path, err)
+	}
+	return nil
+}
 
-		// Build the current path incrementally
-		if currentPath == "" {
-			currentPath = part
-		} else {
-			currentPath += "/" + part
-		}
+// fatPath returns name as a FatFs path on the volume. Names are cleaned
+// like path.Clean; those starting with a slash are absolute, the others
+// are relative to the current directory.
+func (f *FatFs) fatPath(name string) string {
+	return f.volPrefix + pathpkg.Clean(name)
+}
 
-		// Check if the directory exists
-		_, err := f.Stat(currentPath)
-		if err != nil {
-			// If the error is not "does not exist", return the error
-			if !os.IsNotExist(err) {
-				return fmt.Errorf("failed to check directory %s: %w", currentPath, err)
-			}
+// abs returns the cleaned absolute path of name.
+func (f *FatFs) abs(name string) (string, error) {
+	if pathpkg.IsAbs(name) {
+		return pathpkg.Clean(name), nil
+	}
+	wd, err := f.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return pathpkg.Join(wd, name), nil
+}
 
-			// Directory does not exist; attempt to create it
-			fmt.Println("Creating directory:", currentPath)
-			err = f.Mkdir(currentPath, perm)
-			if err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", currentPath, err)
-			}
+// Chdir changes the current directory of the volume, which relative names
+// are resolved against. It is the root directory after mounting.
+func (f *FatFs) Chdir(dir string) error {
+	Logger.Println("CALL Chdir", dir)
+	cpath := C.CString(f.fatPath(dir))
+	defer C.free(unsafe.Pointer(cpath))
+
+	return errval(C.f_chdir(cpath))
+}
+
+// Getwd returns the absolute path of the current directory of the volume.
+func (f *FatFs) Getwd() (string, error) {
+	Logger.Println("CALL Getwd")
+	cpath := C.CString(f.volPrefix)
+	defer C.free(unsafe.Pointer(cpath))
+
+	for size := 256; ; size *= 2 {
+		buf := make([]C.TCHAR, size)
+		err := errval(C.getcwd_drive(cpath, &buf[0], C.UINT(size)))
+		if errors.Is(err, FileResultNotEnoughCore) && size < 1<<16 {
+			continue
 		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimPrefix(C.GoString(&buf[0]), f.volPrefix), nil
 	}
-
-	return nil
 }
 
 func (f *FatFs) Stat(path string) (os.FileInfo, error) {
-	fmt.Printf("CALL Stat [%s]\n", path)
-	if path == "/" || path == "." || path == "" {
+	Logger.Printf("CALL Stat [%s]\n", path)
+	path = pathpkg.Clean(path)
+	if base := pathpkg.Base(path); base == "." || base == ".." {
+		// FatFs cannot stat the directory such a path ends in
+		abs, err := f.abs(path)
+		if err != nil {
+			return nil, err
+		}
+		path = abs
+	}
+	if path == "/" {
 		info := FileInfo{
 			name:    "/",
 			size:    int64(512 * 1024 * 1024),
 			isDir:   true,
 			modTime: time.Unix(0, 0),
 			mode:    os.ModeDir | os.ModePerm | os.ModeDevice,
+			attr:    AttrDirectory,
+			sys:     &FileStat{Attr: AttrDirectory},
 		}
 		return &info, nil
 	}
 
-	cpath := C.CString(f.volPrefix + path)
+	cpath := C.CString(f.fatPath(path))
 	defer C.free(unsafe.Pointer(cpath))
 
 	info := C.FILINFO{}
 	if err := errval(C.f_stat(cpath, &info)); err != nil {
-		fmt.Println("f_stat error:", err)
+		Logger.Println("f_stat error:", err)
 		if errors.Is(err, FileResultNoFile) {
 			return nil, os.ErrNotExist
 		} else if errors.Is(err, FileResultInvalidObject) {
@@ -334,16 +532,67 @@ func (f *FatFs) Stat(path string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	fname := C.GoString(&info.fname[0])
-	infos := FileInfo{
-		name:    fname,
-		size:    int64(info.fsize),
-		isDir:   info.fattrib&C.AM_DIR != 0,
-		modTime: time.Unix(0, 0),
-		mode:    os.ModePerm,
+	return newFileInfo(&info, f.Location()), nil
+}
+
+// Label returns the volume label and the volume serial number.
+func (f *FatFs) Label() (string, uint32, error) {
+	Logger.Println("CALL Label")
+	cpath := C.CString(f.volPrefix)
+	defer C.free(unsafe.Pointer(cpath))
+
+	// large enough for 11 exFAT label characters in any encoding
+	var label [34]C.TCHAR
+	var serial C.DWORD
+	if err := errval(C.f_getlabel(cpath, &label[0], &serial)); err != nil {
+		return "", 0, err
 	}
+	return C.GoString(&label[0]), uint32(serial), nil
+}
+
+// SetLabel changes the volume label, an empty label removes it.
+func (f *FatFs) SetLabel(label string) error {
+	Logger.Println("CALL SetLabel", label)
+	clabel := C.CString(f.volPrefix + label)
+	defer C.free(unsafe.Pointer(clabel))
+
+	return errval(C.f_setlabel(clabel))
+}
+
+// VolumeStat describes the space on a mounted volume.
+type VolumeStat struct {
+	Type        Type
+	ClusterSize uint64
+	// Total and Free are the size of the data area and the free space in it,
+	// in bytes.
+	Total uint64
+	Free  uint64
+}
 
-	return &infos, nil
+// CodePage returns the OEM code page of the volume.
+func (f *FatFs) CodePage() int {
+	return int(f.fs.codepage)
+}
+
+// Statfs returns the type and size of the volume and how much of it is
+// free. Counting free space may need a scan of the whole FAT.
+func (f *FatFs) Statfs() (*VolumeStat, error) {
+	Logger.Println("CALL Statfs")
+	cpath := C.CString(f.volPrefix)
+	defer C.free(unsafe.Pointer(cpath))
+
+	var free C.DWORD
+	var fs *C.FATFS
+	if err := errval(C.f_getfree(cpath, &free, &fs)); err != nil {
+		return nil, err
+	}
+	csize := uint64(fs.csize) * SectorSize
+	return &VolumeStat{
+		Type:        Type(fs.fs_type),
+		ClusterSize: csize,
+		Total:       uint64(fs.n_fatent-2) * csize,
+		Free:        uint64(free) * csize,
+	}, nil
 }
 
 // File methods
@@ -353,68 +602,96 @@ func (f *FatFile) Name() string {
 	return f.info.name
 }
 
-func (f *FatFile) readDir() (infos []os.FileInfo, err error) {
+// next reads the next directory entry, nil at the end of the directory.
+func (f *FatFile) next() (*FileInfo, error) {
 	if !f.info.IsDir() {
 		return nil, FileResultInvalidObject
 	}
-	for {
-		info := C.FILINFO{}
-		if err := errval(C.f_readdir(f.dir, &info)); err != nil {
-			return nil, err
-		}
-		fname := C.GoString(&info.fname[0])
-		if fname == "" {
-			return infos, nil
-		}
+	info := C.FILINFO{}
+	if err := errval(C.f_readdir(f.dir, &info)); err != nil {
+		return nil, err
+	}
+	if info.fname[0] == 0 {
+		return nil, nil
+	}
+	return newFileInfo(&info, f.fs.Location()), nil
+}
 
-		infos = append(infos, &FileInfo{
-			name:    fname,
-			size:    int64(info.fsize),
-			isDir:   info.fattrib&C.AM_DIR != 0,
-			modTime: time.Unix(0, 0),
-			mode:    os.ModePerm,
-		})
+// Entries returns an iterator over the directory entries from the current
+// position to the end, reading one entry at a time. Iteration stops after
+// the first error.
+func (f *FatFile) Entries() iter.Seq2[*FileInfo, error] {
+	return func(yield func(*FileInfo, error) bool) {
+		for {
+			info, err := f.next()
+			if info == nil && err == nil {
+				return
+			}
+			if !yield(info, err) || err != nil {
+				return
+			}
+		}
 	}
 }
 
+// Readdir reads the next count entries of the directory, like
+// os.File.Readdir: with count > 0 it returns at most count entries and
+// io.EOF at the end of the directory, otherwise all remaining entries.
 func (f *FatFile) Readdir(count int) ([]os.FileInfo, error) {
-	fmt.Println("CALL Readdir", count)
-	res, err := f.readDir()
-	if err != nil {
-		return nil, err
-	}
-	if count > 0 {
-		if len(res) > count {
-			res = res[:count]
+	Logger.Println("CALL Readdir", count)
+	var infos []os.FileInfo
+	for count <= 0 || len(infos) < count {
+		info, err := f.next()
+		if err != nil {
+			return infos, err
+		}
+		if info == nil {
+			if count > 0 && len(infos) == 0 {
+				return nil, io.EOF
+			}
+			break
 		}
+		infos = append(infos, info)
 	}
-	return res, nil
+	return infos, nil
 }
 
+// Readdirnames is Readdir returning only the names.
 func (f *FatFile) Readdirnames(n int) (names []string, err error) {
 	infos, err := f.Readdir(n)
-	if err != nil {
-		return nil, err
-	}
 	for _, info := range infos {
 		names = append(names, info.Name())
 	}
-	return names, nil
+	return names, err
+}
+
+// ReadDir is Readdir returning fs.DirEntry values, it implements
+// fs.ReadDirFile.
+func (f *FatFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
 }
 
 // Read from a file
 func (f *FatFile) Read(data []byte) (int, error) {
-	// fmt.Println("CALL Read", len(data))
+	// Logger.Println("CALL Read", len(data))
 	if f.info.IsDir() {
 		return 0, FileResultInvalidObject
 	}
+	if len(data) == 0 {
+		return 0, nil
+	}
 	var br, btw C.UINT = 0, C.UINT(len(data))
 	res := C.f_read(f.fil, unsafe.Pointer(&data[0]), C.UINT(len(data)), &br)
 	if res != 0 {
-		fmt.Println("f_read error code:", errval(res))
+		Logger.Println("f_read error code:", errval(res))
 		return 0, fmt.Errorf("f_read error code: %d", res)
 	}
-	fmt.Println("f_read bytes read:", br)
+	Logger.Println("f_read bytes read:", br)
 	if br == 0 && btw > 0 {
 		return 0, io.EOF
 	}
@@ -423,10 +700,13 @@ func (f *FatFile) Read(data []byte) (int, error) {
 
 // Write to a file
 func (f *FatFile) Write(buf []byte) (int, error) {
-	// fmt.Println("CALL Write", len(buf))
+	// Logger.Println("CALL Write", len(buf))
 	if f.info.IsDir() {
 		return 0, FileResultInvalidObject
 	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
 
 	bufptr := unsafe.Pointer(&buf[0])
 	var bw, btw C.UINT = 0, C.UINT(len(buf))
@@ -436,7 +716,7 @@ func (f *FatFile) Write(buf []byte) (int, error) {
 	}
 
 	if bw < btw {
-		fmt.Printf("DEBUG: Volume Full %d < %d\n", bw, btw)
+		Logger.Printf("DEBUG: Volume Full %d < %d\n", bw, btw)
 		return int(bw), errors.New("volume is full")
 	}
 
@@ -444,10 +724,13 @@ func (f *FatFile) Write(buf []byte) (int, error) {
 }
 
 func (f *FatFile) WriteAt(buf []byte, offset int64) (n int, err error) {
-	// fmt.Println("CALL WriteAt", len(buf), offset)
+	// Logger.Println("CALL WriteAt", len(buf), offset)
 	if f.info.IsDir() {
 		return 0, FileResultInvalidObject
 	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
 
 	oldPos := C.fatfs_tell(f.fil)
 	defer C.f_lseek(f.fil, oldPos)
@@ -474,22 +757,32 @@ func (f *FatFile) WriteString(s string) (n int, err error) {
 	return f.Write([]byte(s))
 }
 
-// Seek changes the position of the file
+// Seek changes the position of the file. A directory can only be rewound,
+// with Seek(0, io.SeekStart).
 func (f *FatFile) Seek(offset int64, whence int) (ret int64, err error) {
+	if f.info.IsDir() {
+		if offset != 0 || whence != io.SeekStart {
+			return -1, FileResultInvalidParameter
+		}
+		if err := errval(C.f_readdir(f.dir, nil)); err != nil {
+			return -1, err
+		}
+		return 0, nil
+	}
 	switch whence {
 	case io.SeekStart:
 		// pass
-		fmt.Println("SEEK_START", offset)
+		Logger.Println("SEEK_START", offset)
 	case io.SeekCurrent:
 		offset += int64(C.fatfs_tell(f.fil))
-		fmt.Println("SEEK_CURRENT", offset)
+		Logger.Println("SEEK_CURRENT", offset)
 	case io.SeekEnd:
 		if f.writeAppendMode {
 			offset += int64(C.fatfs_tell(f.fil))
-			fmt.Println("SEEK_END_APPEND", offset)
+			Logger.Println("SEEK_END_APPEND", offset)
 		} else {
 			offset += f.info.size
-			fmt.Println("SEEK_END", offset)
+			Logger.Println("SEEK_END", offset)
 		}
 	default:
 		return -1, FileResultInvalidParameter
@@ -505,6 +798,9 @@ func (f *FatFile) ReadAt(buf []byte, offset int64) (n int, err error) {
 	if f.info.IsDir() {
 		return 0, FileResultInvalidObject
 	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	bufptr := unsafe.Pointer(&buf[0])
 	var br, btr C.UINT = 0, C.UINT(len(buf))
 	errno := C.f_lseek(f.fil, C.FSIZE_t(offset))
@@ -515,8 +811,9 @@ func (f *FatFile) ReadAt(buf []byte, offset int64) (n int, err error) {
 	if err := errval(errno); err != nil {
 		return int(br), err
 	}
-	if br == 0 && btr > 0 {
-		return 0, io.EOF
+	// unlike Read, ReadAt must explain a short read
+	if br < btr {
+		return int(br), io.EOF
 	}
 	return int(br), nil
 }
@@ -534,6 +831,8 @@ func (f *FatFile) Sync() error {
 //
 // Returns a negative error code on failure.
 func (f *FatFile) Truncate(size int64) error {
+	// the link map would no longer match the file
+	f.DisableFastSeek()
 	// seek then f_truncate
 	errno := C.f_lseek(f.fil, C.FSIZE_t(size))
 	if err := errval(errno); err != nil {
@@ -549,7 +848,7 @@ func (f *FatFile) Truncate(size int64) error {
 
 // Close the file
 func (f *FatFile) Close() error {
-	fmt.Println("CALL Close", f.info.name)
+	Logger.Println("CALL Close", f.info.name)
 
 	delete(f.fs.openFiles, f.info.name)
 
@@ -561,5 +860,6 @@ func (f *FatFile) Close() error {
 			errno = C.f_close(f.fil)
 		}
 	}
+	f.DisableFastSeek()
 	return errval(errno)
 }
@@ -0,0 +1,850 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+)
+
+// ProblemKind classifies the problems Check finds.
+type ProblemKind int
+
+const (
+	// ProblemBootSector is a damaged boot sector, boot checksum or backup
+	// boot sector.
+	ProblemBootSector ProblemKind = iota + 1
+	// ProblemFATMismatch means the FAT copies disagree.
+	ProblemFATMismatch
+	// ProblemBadChain is a cluster chain that loops, leaves the volume or
+	// runs into a free or bad cluster.
+	ProblemBadChain
+	// ProblemCrossLinked is a cluster claimed by more than one file.
+	ProblemCrossLinked
+	// ProblemLostChain is allocated space no file refers to.
+	ProblemLostChain
+	// ProblemSizeMismatch is a file whose size does not match its cluster
+	// chain.
+	ProblemSizeMismatch
+	// ProblemBadEntry is a malformed directory entry.
+	ProblemBadEntry
+	// ProblemBitmap is an exFAT allocation bitmap that disagrees with the
+	// files on the volume.
+	ProblemBitmap
+	// ProblemUpcase is a damaged exFAT up-case table.
+	ProblemUpcase
+	// ProblemFreeCount is a wrong free cluster count in the FAT32 FSInfo
+	// sector.
+	ProblemFreeCount
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemBootSector:
+		return "boot sector"
+	case ProblemFATMismatch:
+		return "FAT mismatch"
+	case ProblemBadChain:
+		return "bad chain"
+	case ProblemCrossLinked:
+		return "cross-linked"
+	case ProblemLostChain:
+		return "lost chain"
+	case ProblemSizeMismatch:
+		return "size mismatch"
+	case ProblemBadEntry:
+		return "bad entry"
+	case ProblemBitmap:
+		return "bitmap"
+	case ProblemUpcase:
+		return "up-case table"
+	case ProblemFreeCount:
+		return "free count"
+	default:
+		return "invalid/unknown"
+	}
+}
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind ProblemKind
+	// Path is the file or directory concerned, empty for problems with the
+	// volume structures.
+	Path string
+	// Cluster is the cluster concerned, if any.
+	Cluster uint32
+	Message string
+	// Repaired is set if Check fixed the problem.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Kind.String() + ": "
+	if p.Path != "" {
+		s += p.Path + ": "
+	}
+	s += p.Message
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// CheckOptions controls Check.
+type CheckOptions struct {
+	// Repair fixes the problems found. Without it the device is not
+	// written to.
+	Repair bool
+	// Partition selects the partition (1-based) to check, 0 checks the
+	// volume FatFs would mount.
+	Partition int
+	// CodePage is the OEM code page of short names, see MountOptions. It
+	// tells double byte characters from invalid characters.
+	CodePage int
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Type        Type
+	ClusterSize uint64
+	Clusters    uint32
+	// Free is the number of free clusters, as Check leaves the volume.
+	Free  uint32
+	Files int
+	Dirs  int
+
+	Problems []Problem
+}
+
+// OK reports whether the volume was consistent.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Remaining returns the problems that were not repaired.
+func (r *CheckReport) Remaining() []Problem {
+	var remaining []Problem
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
+
+// Check verifies the FAT or exFAT volume on blk: boot sectors, FAT copies,
+// cluster chains (cross-links, lost chains, loops and size mismatches),
+// directory entries, the exFAT allocation bitmap and up-case table, and the
+// FAT32 FSInfo free count. With opts.Repair set, it fixes what it can:
+// chains are truncated where they go wrong, file sizes clamped to their
+// chains, lost chains freed and broken entries deleted. Entries whose only
+// fault is a character of their short name are reported but left alone.
+//
+// blk must not be mounted. An error is only returned if no volume can be
+// found or the device fails, problems with the volume end up in the report.
+func Check(blk BlockDevice, opts *CheckOptions) (*CheckReport, error) {
+	if opts == nil {
+		opts = &CheckOptions{}
+	}
+	v, err := openVolume(blk, opts.Partition)
+	if err != nil {
+		return nil, err
+	}
+	v.codePage = opts.CodePage
+	c := &checker{
+		v:      v,
+		repair: opts.Repair,
+		owner:  make([]int32, uint64(v.nclst)+2),
+		owners: []string{""},
+		report: &CheckReport{Type: v.typ, ClusterSize: v.clusterBytes(), Clusters: v.nclst},
+	}
+	if err := c.run(); err != nil {
+		return c.report, err
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	v      *volume
+	repair bool
+	report *CheckReport
+
+	// owner maps every cluster to the index in owners of the file using
+	// it, 0 for none.
+	owner  []int32
+	owners []string
+
+	upcase []uint16
+}
+
+func (c *checker) problem(kind ProblemKind, path string, cluster uint32, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Kind:     kind,
+		Path:     path,
+		Cluster:  cluster,
+		Message:  fmt.Sprintf(format, args...),
+		Repaired: c.repair,
+	})
+}
+
+// unrepairable records a problem Check cannot fix.
+func (c *checker) unrepairable(kind ProblemKind, path string, cluster uint32, format string, args ...any) {
+	c.problem(kind, path, cluster, format, args...)
+	c.keepUnrepaired(true)
+}
+
+// keepUnrepaired marks the last problem as not repaired if cut is set, for
+// chains of volume structures Check does not truncate.
+func (c *checker) keepUnrepaired(cut bool) {
+	if cut {
+		c.report.Problems[len(c.report.Problems)-1].Repaired = false
+	}
+}
+
+func (c *checker) run() error {
+	v := c.v
+	if err := c.checkBoot(); err != nil {
+		return err
+	}
+	if err := c.checkFATCopies(); err != nil {
+		return err
+	}
+
+	if v.typ == TypeEXFAT {
+		if err := c.checkExFATMetadata(); err != nil {
+			return err
+		}
+	}
+
+	var root *dirData
+	var err error
+	if v.typ == TypeFAT12 || v.typ == TypeFAT16 {
+		root, err = v.readDir(v.rootSectors())
+	} else {
+		clusters, cut := c.claim(c.newOwner("/"), v.rootCluster, 0)
+		if len(clusters) == 0 {
+			c.unrepairable(ProblemBadChain, "/", v.rootCluster, "root directory has no clusters")
+			return nil
+		}
+		c.endChain(clusters, cut)
+		root, err = v.readDir(v.clusterSectors(clusters))
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.checkDir("/", root, 0, 0); err != nil {
+		return err
+	}
+
+	if v.typ == TypeEXFAT {
+		if err := c.checkBitmap(); err != nil {
+			return err
+		}
+	} else {
+		c.checkLostChains()
+	}
+	if c.repair {
+		if err := v.flushFAT(); err != nil {
+			return err
+		}
+	}
+
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if c.owner[cl] == 0 && (v.typ == TypeEXFAT || v.fatEntry(cl) == 0) {
+			c.report.Free++
+		}
+	}
+	if v.typ == TypeFAT32 {
+		return c.checkFSInfo()
+	}
+	return nil
+}
+
+func (c *checker) checkBoot() error {
+	v := c.v
+	if v.typ == TypeEXFAT {
+		return c.checkExFATBoot()
+	}
+	if v.typ != TypeFAT32 {
+		return nil
+	}
+
+	boot, err := v.read(v.base, 1)
+	if err != nil {
+		return err
+	}
+	backup := uint64(binary.LittleEndian.Uint16(boot[50:]))
+	if backup == 0 || backup == 0xFFFF {
+		return nil
+	}
+	backupSect, err := v.read(v.base+backup, 1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(boot, backupSect) {
+		c.problem(ProblemBootSector, "", 0, "backup boot sector differs from the boot sector")
+		if c.repair {
+			return v.write(v.base+backup, boot)
+		}
+	}
+	return nil
+}
+
+// checkExFATBoot verifies the checksum of the main and backup boot regions
+// (sectors 0-11 and 12-23 of the volume).
+func (c *checker) checkExFATBoot() error {
+	v := c.v
+	region, err := v.read(v.base, 24)
+	if err != nil {
+		return err
+	}
+	main, backup := region[:12*v.ssize], region[12*v.ssize:]
+	mainOK, backupOK := exfatBootSumOK(main, v.ssize), exfatBootSumOK(backup, v.ssize)
+
+	switch {
+	case mainOK && backupOK && !bytes.Equal(main, backup):
+		c.problem(ProblemBootSector, "", 0, "backup boot region differs from the main boot region")
+		if c.repair {
+			return v.write(v.base+12, main)
+		}
+	case mainOK && !backupOK:
+		c.problem(ProblemBootSector, "", 0, "bad backup boot region checksum")
+		if c.repair {
+			return v.write(v.base+12, main)
+		}
+	case !mainOK && backupOK:
+		c.problem(ProblemBootSector, "", 0, "bad boot region checksum, the backup is intact")
+		if c.repair {
+			return v.write(v.base, backup)
+		}
+	case !mainOK:
+		// the volume parsed, so trust the main region and fix its checksum
+		c.problem(ProblemBootSector, "", 0, "bad boot region checksum in both copies")
+		if c.repair {
+			setExFATBootSum(main, v.ssize)
+			return v.write(v.base, main)
+		}
+	}
+	return nil
+}
+
+func exfatBootSum(region []byte, ssize uint64) uint32 {
+	var sum uint32
+	for i, b := range region[:11*ssize] {
+		// volume flags and percent in use change without updating the sum
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+		sum = sum<<31 | sum>>1
+		sum += uint32(b)
+	}
+	return sum
+}
+
+func exfatBootSumOK(region []byte, ssize uint64) bool {
+	sum := exfatBootSum(region, ssize)
+	for i := 11 * ssize; i < 12*ssize; i += 4 {
+		if binary.LittleEndian.Uint32(region[i:]) != sum {
+			return false
+		}
+	}
+	return true
+}
+
+func setExFATBootSum(region []byte, ssize uint64) {
+	sum := exfatBootSum(region, ssize)
+	for i := 11 * ssize; i < 12*ssize; i += 4 {
+		binary.LittleEndian.PutUint32(region[i:], sum)
+	}
+}
+
+// checkFATCopies compares the second FAT, if any, with the first one, which
+// is what FatFs reads.
+func (c *checker) checkFATCopies() error {
+	v := c.v
+	if v.nfats < 2 {
+		return nil
+	}
+	second, err := v.read(v.fatStart+v.fatSize, v.fatSize)
+	if err != nil {
+		return err
+	}
+	differ := 0
+	for s := uint64(0); s < v.fatSize; s++ {
+		if !bytes.Equal(v.fat[s*v.ssize:(s+1)*v.ssize], second[s*v.ssize:(s+1)*v.ssize]) {
+			differ++
+			if c.repair {
+				v.fatDirty[s] = true
+			}
+		}
+	}
+	if differ > 0 {
+		c.problem(ProblemFATMismatch, "", 0, "%d sectors of the second FAT differ from the first", differ)
+	}
+	return nil
+}
+
+// checkExFATMetadata claims the bitmap and up-case table clusters and
+// verifies the up-case table.
+func (c *checker) checkExFATMetadata() error {
+	v := c.v
+	need := (uint64(v.nclst) + 7) / 8
+	clusters, cut := c.claim(c.newOwner("<allocation bitmap>"), v.bitmapCluster, 0)
+	c.keepUnrepaired(cut)
+	if v.bitmapSize < need || uint64(len(clusters))*v.clusterBytes() < need {
+		c.unrepairable(ProblemBitmap, "", v.bitmapCluster, "allocation bitmap too small for %d clusters", v.nclst)
+	}
+
+	table, sum, err := v.readUpcase()
+	if err == nil && sum == v.upcaseSum {
+		c.upcase = table
+		_, cut := c.claim(c.newOwner("<up-case table>"), v.upcaseCluster, 0)
+		c.keepUnrepaired(cut)
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("checksum %#08x, expected %#08x", sum, v.upcaseSum)
+	}
+	if v.validCluster(v.upcaseCluster) {
+		_, cut := c.claim(c.newOwner("<up-case table>"), v.upcaseCluster, 0)
+		c.keepUnrepaired(cut)
+	}
+	// check the file name hashes against the table FatFs uses
+	c.upcase = defaultUpcaseTable()
+	c.problem(ProblemUpcase, "", v.upcaseCluster, "bad up-case table: %v", err)
+	if !c.repair {
+		return nil
+	}
+	return c.rewriteUpcase()
+}
+
+// rewriteUpcase replaces a damaged up-case table with the one f_mkfs
+// writes, if it fits in the clusters the old table used.
+func (c *checker) rewriteUpcase() error {
+	v := c.v
+	data, sum := defaultUpcase()
+	clusters, err := v.chain(v.upcaseCluster)
+	if !v.validCluster(v.upcaseCluster) || err != nil || uint64(len(clusters))*v.clusterBytes() < uint64(len(data)) {
+		c.keepUnrepaired(true)
+		return nil
+	}
+	buf := make([]byte, uint64(len(clusters))*v.clusterBytes())
+	copy(buf, data)
+	for i, s := range v.clusterSectors(clusters) {
+		if err := v.write(s, buf[uint64(i)*v.ssize:uint64(i+1)*v.ssize]); err != nil {
+			return err
+		}
+	}
+
+	// update the up-case table entry in the root directory
+	root, err := v.chain(v.rootCluster)
+	if err != nil {
+		return err
+	}
+	d, err := v.readDir(v.clusterSectors(root))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < d.entries(); i++ {
+		if ent := d.entry(i); ent[0] == exfatUpcase {
+			binary.LittleEndian.PutUint32(ent[4:], sum)
+			binary.LittleEndian.PutUint64(ent[24:], uint64(len(data)))
+			d.dirty = true
+			break
+		}
+	}
+	if err := v.writeDir(d); err != nil {
+		return err
+	}
+	v.upcaseSum, v.upcaseSize = sum, uint64(len(data))
+	c.upcase, _, err = v.readUpcase()
+	return err
+}
+
+func (c *checker) newOwner(path string) int32 {
+	c.owners = append(c.owners, path)
+	return int32(len(c.owners) - 1)
+}
+
+// claim marks the clusters of a chain as used by owner and returns them. A
+// non-zero contiguous is the length of an exFAT chain without FAT entries.
+// The walk stops early where the chain goes wrong, recording a problem and
+// reporting the chain as cut: the clusters returned are the part of the
+// chain that can be kept.
+func (c *checker) claim(owner int32, first uint32, contiguous uint64) (clusters []uint32, cut bool) {
+	v := c.v
+	name := c.owners[owner]
+	for cl := first; ; {
+		if !v.validCluster(cl) {
+			c.problem(ProblemBadChain, name, cl, "chain leads to invalid cluster %d", cl)
+			return clusters, true
+		}
+		if other := c.owner[cl]; other == owner {
+			c.problem(ProblemBadChain, name, cl, "chain loops back to cluster %d", cl)
+			return clusters, true
+		} else if other != 0 {
+			c.problem(ProblemCrossLinked, name, cl, "cluster %d is also used by %s", cl, c.owners[other])
+			return clusters, true
+		}
+		c.owner[cl] = owner
+		clusters = append(clusters, cl)
+
+		if contiguous != 0 {
+			if uint64(len(clusters)) == contiguous {
+				return clusters, false
+			}
+			cl++
+			continue
+		}
+		next := v.fatEntry(cl)
+		switch {
+		case v.isEOC(next):
+			return clusters, false
+		case next == 0:
+			c.problem(ProblemBadChain, name, cl, "chain runs into a free cluster")
+			return clusters, true
+		case next == v.badCluster():
+			c.problem(ProblemBadChain, name, cl, "chain runs into a bad cluster")
+			return clusters, true
+		}
+		cl = next
+	}
+}
+
+// endChain terminates a chain claim had to cut short at its last good
+// cluster.
+func (c *checker) endChain(clusters []uint32, cut bool) {
+	if cut && c.repair {
+		c.v.setFATEntry(clusters[len(clusters)-1], c.v.eoc())
+	}
+}
+
+// release frees the clusters cut off from a chain. Without repairs they
+// stay with the file that still links to them.
+func (c *checker) release(clusters []uint32) {
+	if !c.repair {
+		return
+	}
+	for _, cl := range clusters {
+		c.owner[cl] = 0
+		c.v.setFATEntry(cl, 0)
+	}
+}
+
+// checkDir checks the entries of a directory and recurses into its
+// subdirectories. self and parent are the first clusters of the directory
+// and its parent, as its dot entries should record them.
+func (c *checker) checkDir(dir string, d *dirData, self, parent uint32) error {
+	v := c.v
+	ents, issues := v.parseDir(d, c.upcase)
+	for _, issue := range issues {
+		p := dir
+		if issue.name != "" {
+			p = path.Join(dir, issue.name)
+		}
+		if issue.keep {
+			c.unrepairable(ProblemBadEntry, p, 0, "%s", issue.msg)
+			continue
+		}
+		c.problem(ProblemBadEntry, p, 0, "%s", issue.msg)
+		if !c.repair {
+			continue
+		}
+		if issue.fixable {
+			v.fixEntrySet(d, issue.first, issue.n, c.upcase)
+		} else {
+			v.deleteEntry(d, issue.first, issue.n)
+		}
+	}
+
+	type subdir struct {
+		path     string
+		clusters []uint32
+	}
+	var subdirs []subdir
+	for i := range ents {
+		e := &ents[i]
+		if e.name == "." || e.name == ".." {
+			c.checkDotEntry(dir, d, e, self, parent)
+			continue
+		}
+
+		p := path.Join(dir, e.name)
+		clusters, ok := c.checkEntry(p, d, e)
+		if !ok {
+			continue
+		}
+		if e.isDir() {
+			c.report.Dirs++
+			subdirs = append(subdirs, subdir{p, clusters})
+		} else {
+			c.report.Files++
+		}
+	}
+	if c.repair {
+		if err := v.writeDir(d); err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range subdirs {
+		sd, err := v.readDir(v.clusterSectors(sub.clusters))
+		if err != nil {
+			return err
+		}
+		if err := c.checkDir(sub.path, sd, sub.clusters[0], self); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkDotEntry(dir string, d *dirData, e *dirEnt, self, parent uint32) {
+	want := self
+	if e.name == ".." {
+		want = parent
+	}
+	if self == 0 {
+		c.problem(ProblemBadEntry, dir, 0, "dot entry in the root directory")
+		if c.repair {
+			c.v.deleteEntry(d, e.first, e.n)
+		}
+		return
+	}
+	if e.cluster != want {
+		c.problem(ProblemBadEntry, dir, e.cluster, "%q entry points to cluster %d instead of %d", e.name, e.cluster, want)
+		if c.repair {
+			e.cluster = want
+			c.v.setEntry(d, e)
+		}
+	}
+}
+
+// checkEntry claims the clusters of a file or directory and checks them
+// against its size. It returns the clusters of a directory to descend into,
+// or false if the entry was dropped.
+func (c *checker) checkEntry(p string, d *dirData, e *dirEnt) ([]uint32, bool) {
+	v := c.v
+	cb := v.clusterBytes()
+
+	if e.cluster == 0 {
+		if e.isDir() {
+			c.problem(ProblemBadEntry, p, 0, "directory without clusters")
+			if c.repair {
+				v.deleteEntry(d, e.first, e.n)
+			}
+			return nil, false
+		}
+		if e.size != 0 {
+			c.problem(ProblemSizeMismatch, p, 0, "file of %d bytes without clusters", e.size)
+			if c.repair {
+				e.size, e.validSize = 0, 0
+				v.setEntry(d, e)
+			}
+		}
+		return nil, true
+	}
+
+	var contiguous uint64
+	if e.noFatChain {
+		contiguous = (e.size + cb - 1) / cb
+		if contiguous == 0 {
+			contiguous = 1
+		}
+	}
+	clusters, cut := c.claim(c.newOwner(p), e.cluster, contiguous)
+	changed := false
+	if len(clusters) == 0 {
+		if e.isDir() {
+			if c.repair {
+				v.deleteEntry(d, e.first, e.n)
+			}
+			return nil, false
+		}
+		e.cluster, e.size, e.validSize, e.noFatChain = 0, 0, 0, false
+		changed = true
+	} else if !e.noFatChain {
+		c.endChain(clusters, cut)
+	}
+
+	n := uint64(len(clusters))
+	if e.isDir() {
+		if v.typ == TypeEXFAT && e.size != n*cb {
+			c.problem(ProblemSizeMismatch, p, e.cluster, "directory size %d, its chain holds %d bytes", e.size, n*cb)
+			e.size, e.validSize = n*cb, n*cb
+			changed = true
+		} else if v.typ != TypeEXFAT && e.size != 0 {
+			c.problem(ProblemSizeMismatch, p, e.cluster, "directory has a size of %d", e.size)
+			e.size = 0
+			changed = true
+		}
+	} else if need := (e.size + cb - 1) / cb; n > need {
+		c.problem(ProblemSizeMismatch, p, e.cluster, "chain of %d clusters for a file of %d bytes", n, e.size)
+		if need == 0 {
+			c.release(clusters)
+			clusters = nil
+			e.cluster, e.noFatChain = 0, false
+			changed = true
+		} else {
+			if c.repair && !e.noFatChain {
+				v.setFATEntry(clusters[need-1], v.eoc())
+			}
+			c.release(clusters[need:])
+			clusters = clusters[:need]
+		}
+	} else if n < need {
+		c.problem(ProblemSizeMismatch, p, e.cluster, "file size %d, its chain holds %d bytes", e.size, n*cb)
+		e.size = n * cb
+		changed = true
+	}
+	if e.validSize > e.size {
+		c.problem(ProblemSizeMismatch, p, e.cluster, "valid data length %d beyond the file size %d", e.validSize, e.size)
+		e.validSize = e.size
+		changed = true
+	}
+
+	if changed && c.repair {
+		v.setEntry(d, e)
+	}
+	return clusters, len(clusters) > 0 || !e.isDir()
+}
+
+// checkLostChains finds clusters in use in the FAT that no file owns.
+func (c *checker) checkLostChains() {
+	v := c.v
+	lost := func(cl uint32) bool {
+		if c.owner[cl] != 0 {
+			return false
+		}
+		val := v.fatEntry(cl)
+		return val != 0 && val != v.badCluster()
+	}
+
+	// a lost cluster another lost cluster links to is not the head of a
+	// chain
+	linked := make(map[uint32]bool)
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if lost(cl) {
+			linked[v.fatEntry(cl)] = true
+		}
+	}
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if !lost(cl) || linked[cl] {
+			continue
+		}
+		n := 0
+		for next := cl; v.validCluster(next) && lost(next); n++ {
+			val := v.fatEntry(next)
+			c.owner[next] = -1
+			next = val
+		}
+		c.problem(ProblemLostChain, "", cl, "lost chain of %d clusters", n)
+	}
+
+	// whatever is left are lost loops
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if lost(cl) {
+			c.problem(ProblemLostChain, "", cl, "lost chain looping back on itself")
+			for next := cl; v.validCluster(next) && lost(next); {
+				val := v.fatEntry(next)
+				c.owner[next] = -1
+				next = val
+			}
+		}
+	}
+
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if c.owner[cl] == -1 {
+			c.owner[cl] = 0
+			if c.repair {
+				v.setFATEntry(cl, 0)
+			}
+		}
+	}
+}
+
+// checkBitmap compares the exFAT allocation bitmap with the clusters in use.
+func (c *checker) checkBitmap() error {
+	v := c.v
+	bitmap, clusters, err := v.readBitmap()
+	if err != nil {
+		c.unrepairable(ProblemBitmap, "", v.bitmapCluster, "cannot read the allocation bitmap: %v", err)
+		return nil
+	}
+	if uint64(len(bitmap))*8 < uint64(v.nclst) {
+		return nil
+	}
+
+	var lost, unmarked int
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		i := cl - 2
+		set := bitmap[i/8]&(1<<(i%8)) != 0
+		used := c.owner[cl] != 0
+		switch {
+		case set && !used:
+			lost++
+			bitmap[i/8] &^= 1 << (i % 8)
+		case !set && used:
+			unmarked++
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	if lost > 0 {
+		c.problem(ProblemLostChain, "", 0, "%d clusters marked in use but not used by any file", lost)
+	}
+	if unmarked > 0 {
+		c.problem(ProblemBitmap, "", 0, "%d clusters in use but marked free", unmarked)
+	}
+	if (lost > 0 || unmarked > 0) && c.repair {
+		for i, s := range v.clusterSectors(clusters) {
+			if err := v.write(s, bitmap[uint64(i)*v.ssize:uint64(i+1)*v.ssize]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkFSInfo compares the FAT32 FSInfo free count and next free hint with
+// the FAT.
+func (c *checker) checkFSInfo() error {
+	v := c.v
+	if v.fsinfo == 0 {
+		return nil
+	}
+	fsi, err := v.read(v.fsinfo, 1)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(fsi[0:]) != 0x41615252 ||
+		binary.LittleEndian.Uint32(fsi[484:]) != 0x61417272 ||
+		binary.LittleEndian.Uint32(fsi[508:]) != 0xAA550000 {
+		c.problem(ProblemFreeCount, "", 0, "bad FSInfo sector signature")
+		if !c.repair {
+			return nil
+		}
+		clear(fsi)
+		binary.LittleEndian.PutUint32(fsi[0:], 0x41615252)
+		binary.LittleEndian.PutUint32(fsi[484:], 0x61417272)
+		binary.LittleEndian.PutUint32(fsi[492:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(fsi[508:], 0xAA550000)
+		binary.LittleEndian.PutUint32(fsi[488:], c.report.Free)
+		return v.write(v.fsinfo, fsi)
+	}
+
+	changed := false
+	if free := binary.LittleEndian.Uint32(fsi[488:]); free != 0xFFFFFFFF && free != c.report.Free {
+		c.problem(ProblemFreeCount, "", 0, "FSInfo free count is %d, counted %d", free, c.report.Free)
+		binary.LittleEndian.PutUint32(fsi[488:], c.report.Free)
+		changed = true
+	}
+	if next := binary.LittleEndian.Uint32(fsi[492:]); next != 0xFFFFFFFF && !v.validCluster(next) {
+		c.problem(ProblemFreeCount, "", 0, "FSInfo next free cluster %d out of range", next)
+		binary.LittleEndian.PutUint32(fsi[492:], 0xFFFFFFFF)
+		changed = true
+	}
+	if changed && c.repair {
+		return v.write(v.fsinfo, fsi)
+	}
+	return nil
+}
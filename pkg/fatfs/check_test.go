@@ -0,0 +1,68 @@
+package fatfs_test
+
+import (
+	iofs "io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// Shift-JIS 表 (95 5C) and ソ (83 5C) end in the byte of a backslash, which
+// is only invalid on its own.
+func TestCheckDBCSShortNames(t *testing.T) {
+	src := fstest.MapFS{
+		"表.txt":   {Data: []byte("table")},
+		"ソフト.txt": {Data: []byte("soft")},
+	}
+	dev := fatfs.NewMemDevice(36 << 20)
+	opts := &fatfs.BuildOptions{Format: fatfs.FormatOptions{Type: fatfs.TypeFAT32}, CodePage: 932}
+	if err := fatfs.BuildImage(dev, src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fatfs.Check(dev, &fatfs.CheckOptions{CodePage: 932})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Files != 2 {
+		t.Fatalf("fresh image: %d files, problems %v", report.Files, report.Problems)
+	}
+
+	// in a code page without double byte characters the names look wrong,
+	// but repairing must not lose the files
+	report, err = fatfs.Check(dev, &fatfs.CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		if p.Kind != fatfs.ProblemBadEntry || p.Repaired {
+			t.Errorf("unexpected problem with code page 437: %v", p)
+		}
+	}
+	report, err = fatfs.Check(dev, &fatfs.CheckOptions{CodePage: 932})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Files != 2 {
+		t.Fatalf("after repair: %d files, problems %v", report.Files, report.Problems)
+	}
+
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MountWith(dev, &fatfs.MountOptions{CodePage: 932}); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+	for name, f := range src {
+		got, err := iofs.ReadFile(fatfs.AsIO(fs), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(f.Data) {
+			t.Errorf("%s: got %q, want %q", name, got, f.Data)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fatfs
+
+/*
+#include "ff.h"
+*/
+import "C"
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clock returns the current time for new timestamps on a volume: creation
+// and modification times, and the seed of serial numbers and GPT GUIDs when
+// formatting.
+type Clock func() time.Time
+
+// DefaultClock is the clock of volumes without one of their own. It returns
+// the time in the SOURCE_DATE_EPOCH environment variable when that is set,
+// for reproducible builds, and the wall clock otherwise.
+func DefaultClock() time.Time {
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Now()
+}
+
+// driveTime is how a drive reads the clock and encodes times, and who set
+// it.
+type driveTime struct {
+	clock Clock
+	loc   *time.Location
+	owner any
+}
+
+var (
+	timeMu     sync.RWMutex
+	driveTimes = make(map[uint8]driveTime)
+)
+
+// setDriveTime changes the clock and location of a drive, nil fields
+// restore DefaultClock and time.Local.
+func setDriveTime(pdrv uint8, update func(t *driveTime)) {
+	timeMu.Lock()
+	defer timeMu.Unlock()
+	t := driveTimes[pdrv]
+	update(&t)
+	if t.clock == nil && t.loc == nil {
+		delete(driveTimes, pdrv)
+	} else {
+		driveTimes[pdrv] = t
+	}
+}
+
+func driveClock(pdrv uint8) (Clock, *time.Location) {
+	timeMu.RLock()
+	defer timeMu.RUnlock()
+	t := driveTimes[pdrv]
+	if t.clock == nil {
+		t.clock = DefaultClock
+	}
+	if t.loc == nil {
+		t.loc = time.Local
+	}
+	return t.clock, t.loc
+}
+
+// driveLocation returns the time zone timestamps on a drive are in.
+func driveLocation(pdrv uint8) *time.Location {
+	_, loc := driveClock(pdrv)
+	return loc
+}
+
+// SetClock sets the clock used for timestamps written to the volume, nil
+// restores DefaultClock. It applies until the volume is unmounted.
+func (f *FatFs) SetClock(clock Clock) {
+	setDriveTime(f.volNumber, func(t *driveTime) { t.clock, t.owner = clock, f })
+}
+
+// SetLocation sets the time zone of the volume's timestamps, nil restores
+// time.Local. FAT stores local times without a zone, so this decides both
+// how times are written and how FileInfo.ModTime reads them; a device that
+// expects local time in Berlin wants time.LoadLocation("Europe/Berlin")
+// even when the image is built on a server running in UTC. It applies
+// until the volume is unmounted.
+func (f *FatFs) SetLocation(loc *time.Location) {
+	setDriveTime(f.volNumber, func(t *driveTime) { t.loc, t.owner = loc, f })
+}
+
+// Location returns the time zone of the volume's timestamps.
+func (f *FatFs) Location() *time.Location {
+	return driveLocation(f.volNumber)
+}
+
+//export Go_getFatTime
+func Go_getFatTime(pdrv C.BYTE) C.DWORD {
+	clock, loc := driveClock(uint8(pdrv))
+	date, tm := toFatTime(clock(), loc)
+	return C.DWORD(date)<<16 | C.DWORD(tm)
+}
@@ -3,6 +3,7 @@ package fatfs
 import (
 	"io/fs"
 	"os"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -29,10 +30,39 @@ type FatIO struct {
 	*FatFs
 }
 
-var _ fs.FS = (*FatIO)(nil)
+var (
+	_ fs.FS     = (*FatIO)(nil)
+	_ fs.GlobFS = (*FatIO)(nil)
+)
 
+// Open opens a file by its io/fs name, "." being the root directory.
+// FatFs also takes backslashes as separators, io/fs names must not. Large
+// files are opened in fast seek mode, for random access as by
+// http.FileServer.
 func (f *FatIO) Open(name string) (fs.File, error) {
-	return f.FatFs.Open(name)
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	// io/fs paths are relative to the root, not the current directory
+	file, err := f.FatFs.Open("/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !file.info.IsDir() && file.info.Size() >= fastSeekMin {
+		// without it reads only take longer
+		_ = file.EnableFastSeek()
+	}
+	return file, nil
+}
+
+// Glob implements fs.GlobFS using FatFs.Glob, so matching is
+// case-insensitive.
+func (f *FatIO) Glob(pattern string) ([]string, error) {
+	matches, err := f.FatFs.Glob("/" + pattern)
+	for i, m := range matches {
+		matches[i] = strings.TrimPrefix(m, "/")
+	}
+	return matches, err
 }
 
 func AsIO(f *FatFs) *FatIO {
@@ -0,0 +1,658 @@
+package fatfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Compression identifies the container format of a compressed image.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionXZ
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionXZ:
+		return "xz"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "invalid/unknown"
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression sniffs the compression format from the first bytes of
+// an image. CompressionNone is returned for anything it does not recognise.
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(header, xzMagic):
+		return CompressionXZ
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+const (
+	defaultCompressedChunkSize = 256 * 1024
+	defaultCompressedCacheSize = 64 * 1024 * 1024
+)
+
+// CompressedImageOptions tunes how a CompressedImage decompresses data. A nil
+// *CompressedImageOptions selects the defaults.
+type CompressedImageOptions struct {
+	// ChunkSize is the unit in which decompressed data is cached. Defaults to
+	// 256 KiB.
+	ChunkSize int
+	// CacheSize bounds the memory used for decompressed chunks. Defaults to
+	// 64 MiB.
+	CacheSize int
+}
+
+// assert that CompressedImage implements the BlockDevice interface
+var _ BlockDevice = (*CompressedImage)(nil)
+
+// CompressedImage is a read-only BlockDevice over a gzip, xz or zstd
+// compressed raw image.
+//
+// On open a seek index of independently decodable units is built: gzip
+// members, xz blocks and zstd frames. Reads decompress only the unit they
+// fall into, from its start, and keep recently used chunks in a bounded LRU
+// cache. Images made of many small units (bgzip, xz -T, pzstd) therefore give
+// fast random access, while single-unit images fall back to decompressing on
+// demand, restarting the stream on backward seeks that miss the cache.
+//
+// xz and zstd images are indexed from their headers alone. gzip has no
+// index, so opening one decompresses it once, discarding the output, to find
+// the member boundaries and the total size.
+type CompressedImage struct {
+	file   *os.File
+	format Compression
+	frames []compressedFrame
+	size   int64
+
+	chunkSize int
+	cache     *chunkCache
+
+	// the decoder of the frame currently being streamed
+	dec      io.Reader
+	decClose func()
+	decFrame int
+	decChunk int64 // next chunk index the decoder will produce
+}
+
+// compressedFrame is an independently decodable unit of the image.
+type compressedFrame struct {
+	cOff, cLen int64 // position in the compressed file
+	uOff, uLen int64 // position in the decompressed image
+
+	// xz blocks only
+	xzDictCap int
+}
+
+// OpenCompressedImage opens the compressed image at path and builds its seek
+// index. The compression format is detected from the file contents.
+func OpenCompressedImage(path string, opts *CompressedImageOptions) (*CompressedImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &CompressedImage{
+		file:      f,
+		chunkSize: defaultCompressedChunkSize,
+		decFrame:  -1,
+	}
+	cacheSize := defaultCompressedCacheSize
+	if opts != nil {
+		if opts.ChunkSize > 0 {
+			img.chunkSize = (opts.ChunkSize + sectorSize - 1) / sectorSize * sectorSize
+		}
+		if opts.CacheSize > 0 {
+			cacheSize = opts.CacheSize
+		}
+	}
+	img.cache = newChunkCache(max(cacheSize/img.chunkSize, 1))
+
+	if err := img.buildIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return img, nil
+}
+
+// Format returns the compression format of the image.
+func (img *CompressedImage) Format() Compression {
+	return img.format
+}
+
+// Size returns the decompressed size of the image in bytes.
+func (img *CompressedImage) Size() int64 {
+	return img.size
+}
+
+func (img *CompressedImage) buildIndex() error {
+	info, err := img.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 6)
+	n, _ := img.file.ReadAt(header, 0)
+	img.format = DetectCompression(header[:n])
+
+	switch img.format {
+	case CompressionGzip:
+		err = img.indexGzip()
+	case CompressionXZ:
+		err = img.indexXZ(info.Size())
+	case CompressionZstd:
+		err = img.indexZstd(info.Size())
+	default:
+		return errors.New("unrecognised compression format")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to index %s image: %w", img.format, err)
+	}
+
+	for _, fr := range img.frames {
+		img.size += fr.uLen
+	}
+	return nil
+}
+
+// indexGzip decompresses every member once to learn where it starts and how
+// much data it holds.
+func (img *CompressedImage) indexGzip() error {
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(img.file, 0, 1<<62))}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var uOff int64
+	start := int64(0)
+	for {
+		zr.Multistream(false)
+		n, err := io.Copy(io.Discard, zr)
+		if err != nil {
+			return err
+		}
+		img.frames = append(img.frames, compressedFrame{
+			cOff: start, cLen: cr.n - start,
+			uOff: uOff, uLen: n,
+		})
+		uOff += n
+		start = cr.n
+
+		if err := zr.Reset(cr); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// indexZstd walks the frame and block headers without decompressing, except
+// for frames that do not record their content size.
+func (img *CompressedImage) indexZstd(fileSize int64) error {
+	var uOff int64
+	for off := int64(0); off < fileSize; {
+		var hdr [18]byte
+		n, err := img.file.ReadAt(hdr[:], off)
+		if n < 8 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		magic := binary.LittleEndian.Uint32(hdr[0:])
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			// skippable frame, e.g. a seek table
+			off += 8 + int64(binary.LittleEndian.Uint32(hdr[4:]))
+			continue
+		}
+		if magic != 0xFD2FB528 {
+			return fmt.Errorf("bad frame magic %08x at offset %d", magic, off)
+		}
+
+		desc := hdr[4]
+		pos := 5
+		singleSegment := desc&0x20 != 0
+		if !singleSegment {
+			pos++ // window descriptor
+		}
+		pos += []int{0, 1, 2, 4}[desc&0x03] // dictionary id
+		fcsSize := []int{0, 2, 4, 8}[desc>>6]
+		if fcsSize == 0 && singleSegment {
+			fcsSize = 1
+		}
+
+		contentSize := int64(-1)
+		switch fcsSize {
+		case 1:
+			contentSize = int64(hdr[pos])
+		case 2:
+			contentSize = int64(binary.LittleEndian.Uint16(hdr[pos:])) + 256
+		case 4:
+			contentSize = int64(binary.LittleEndian.Uint32(hdr[pos:]))
+		case 8:
+			contentSize = int64(binary.LittleEndian.Uint64(hdr[pos:]))
+		}
+		pos += fcsSize
+
+		// skip over the blocks to find the end of the frame
+		end := off + int64(pos)
+	blocks:
+		for {
+			var bh [3]byte
+			if _, err := img.file.ReadAt(bh[:], end); err != nil {
+				return fmt.Errorf("truncated frame at offset %d: %w", off, err)
+			}
+			v := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+			end += 3
+			switch (v >> 1) & 3 {
+			case 1: // RLE, a single byte repeated
+				end++
+			case 3:
+				return fmt.Errorf("reserved block type at offset %d", end-3)
+			default:
+				end += int64(v >> 3)
+			}
+			if v&1 != 0 {
+				break blocks
+			}
+		}
+		if desc&0x04 != 0 {
+			end += 4 // content checksum
+		}
+
+		fr := compressedFrame{cOff: off, cLen: end - off, uOff: uOff, uLen: contentSize}
+		if contentSize < 0 {
+			dec, err := zstd.NewReader(io.NewSectionReader(img.file, fr.cOff, fr.cLen), zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			fr.uLen, err = io.Copy(io.Discard, dec)
+			dec.Close()
+			if err != nil {
+				return err
+			}
+		}
+		img.frames = append(img.frames, fr)
+		uOff += fr.uLen
+		off = end
+	}
+	return nil
+}
+
+// indexXZ reads the stream index at the end of the file to locate every
+// block. Blocks that only use the LZMA2 filter can be decoded on their own;
+// anything else falls back to decoding the stream as a single unit.
+func (img *CompressedImage) indexXZ(fileSize int64) error {
+	if frames, err := img.readXZIndex(fileSize); err == nil {
+		img.frames = frames
+		return nil
+	}
+
+	// unusual layout (several streams, BCJ filters, ...), count the hard way
+	xr, err := xz.NewReader(io.NewSectionReader(img.file, 0, fileSize))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, xr)
+	if err != nil {
+		return err
+	}
+	img.frames = []compressedFrame{{cOff: 0, cLen: fileSize, uOff: 0, uLen: n}}
+	return nil
+}
+
+func (img *CompressedImage) readXZIndex(fileSize int64) ([]compressedFrame, error) {
+	const headerSize = 12
+	var footer [headerSize]byte
+	if fileSize < 2*headerSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := img.file.ReadAt(footer[:], fileSize-headerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[10:], []byte("YZ")) {
+		return nil, errors.New("missing stream footer (stream padding is not supported)")
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[0:]) {
+		return nil, errors.New("bad stream footer checksum")
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+	indexOff := fileSize - headerSize - indexSize
+	if indexOff < headerSize {
+		return nil, errors.New("bad index size")
+	}
+
+	index := make([]byte, indexSize)
+	if _, err := img.file.ReadAt(index, indexOff); err != nil {
+		return nil, err
+	}
+	if index[0] != 0 {
+		return nil, errors.New("bad index indicator")
+	}
+	rd := bytes.NewReader(index[1:])
+	records, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []compressedFrame
+	cOff, uOff := int64(headerSize), int64(0)
+	for i := uint64(0); i < records; i++ {
+		unpadded, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, err
+		}
+		uLen, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, err
+		}
+		fr := compressedFrame{
+			cOff: cOff, cLen: int64(unpadded),
+			uOff: uOff, uLen: int64(uLen),
+		}
+		if fr.xzDictCap, err = img.xzBlockDictCap(cOff); err != nil {
+			return nil, err
+		}
+		frames = append(frames, fr)
+		cOff += (int64(unpadded) + 3) &^ 3
+		uOff += int64(uLen)
+	}
+	if cOff != indexOff {
+		return nil, errors.New("index does not describe a single stream")
+	}
+	return frames, nil
+}
+
+// xzBlockDictCap parses the block header at off and returns the LZMA2
+// dictionary size, failing if the block uses any other filter.
+func (img *CompressedImage) xzBlockDictCap(off int64) (int, error) {
+	var size [1]byte
+	if _, err := img.file.ReadAt(size[:], off); err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, (int(size[0])+1)*4)
+	if _, err := img.file.ReadAt(hdr, off); err != nil {
+		return 0, err
+	}
+	flags := hdr[1]
+	if flags&0x03 != 0 {
+		return 0, errors.New("block uses more than one filter")
+	}
+	rd := bytes.NewReader(hdr[2:])
+	if flags&0x40 != 0 {
+		binary.ReadUvarint(rd) // compressed size
+	}
+	if flags&0x80 != 0 {
+		binary.ReadUvarint(rd) // uncompressed size
+	}
+	id, _ := binary.ReadUvarint(rd)
+	propSize, _ := binary.ReadUvarint(rd)
+	prop, err := rd.ReadByte()
+	if err != nil || id != 0x21 || propSize != 1 || prop > 40 {
+		return 0, errors.New("block does not use a plain LZMA2 filter")
+	}
+	if prop == 40 {
+		return lzma.MaxDictCap, nil
+	}
+	return int(2|(prop&1)) << (prop/2 + 11), nil
+}
+
+// openFrame starts a decoder at the beginning of a frame.
+func (img *CompressedImage) openFrame(fr compressedFrame) (io.Reader, func(), error) {
+	src := io.NewSectionReader(img.file, fr.cOff, fr.cLen)
+	switch img.format {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bufio.NewReader(src))
+		if err != nil {
+			return nil, nil, err
+		}
+		zr.Multistream(false)
+		return zr, func() { zr.Close() }, nil
+	case CompressionZstd:
+		dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dec, dec.Close, nil
+	case CompressionXZ:
+		if fr.xzDictCap == 0 {
+			xr, err := xz.NewReader(bufio.NewReader(src))
+			if err != nil {
+				return nil, nil, err
+			}
+			return xr, func() {}, nil
+		}
+		var size [1]byte
+		if _, err := src.ReadAt(size[:], 0); err != nil {
+			return nil, nil, err
+		}
+		hdrLen := (int64(size[0]) + 1) * 4
+		data := io.NewSectionReader(img.file, fr.cOff+hdrLen, fr.cLen-hdrLen)
+		// a block never refers back further than its own contents
+		dictCap := max(min(int64(fr.xzDictCap), fr.uLen), lzma.MinDictCap)
+		lr, err := lzma.Reader2Config{DictCap: int(dictCap)}.NewReader2(bufio.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return lr, func() {}, nil
+	}
+	return nil, nil, errors.New("unsupported compression format")
+}
+
+// chunk returns chunk idx of frame fi, decoding it if it is not cached.
+func (img *CompressedImage) chunk(fi int, idx int64) ([]byte, error) {
+	key := chunkKey{fi, idx}
+	if data, ok := img.cache.get(key); ok {
+		return data, nil
+	}
+
+	if img.decFrame != fi || img.decChunk > idx {
+		img.closeDecoder()
+		dec, closer, err := img.openFrame(img.frames[fi])
+		if err != nil {
+			return nil, err
+		}
+		img.dec, img.decClose, img.decFrame, img.decChunk = dec, closer, fi, 0
+	}
+
+	fr := img.frames[fi]
+	for {
+		n := min(int64(img.chunkSize), fr.uLen-img.decChunk*int64(img.chunkSize))
+		data := make([]byte, n)
+		if _, err := io.ReadFull(img.dec, data); err != nil {
+			img.closeDecoder()
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		img.cache.put(chunkKey{fi, img.decChunk}, data)
+		img.decChunk++
+		if img.decChunk > idx {
+			return data, nil
+		}
+	}
+}
+
+func (img *CompressedImage) closeDecoder() {
+	if img.decClose != nil {
+		img.decClose()
+	}
+	img.dec, img.decClose, img.decFrame, img.decChunk = nil, nil, -1, 0
+}
+
+// Initialize reports the same as Status, the index is built when the image
+// is opened.
+func (img *CompressedImage) Initialize() error {
+	return img.Status()
+}
+
+// Status reports whether the image is still open. An open image always
+// reports FileResultWriteProtected so FatFs refuses writes up front.
+func (img *CompressedImage) Status() error {
+	if img.file == nil {
+		return fmt.Errorf("file is not open")
+	}
+	return FileResultWriteProtected
+}
+
+// ReadSectors reads `count` sectors from the decompressed image at the
+// sector index `sector` into the buffer `buff`.
+func (img *CompressedImage) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	if img.file == nil {
+		return fmt.Errorf("file is not open")
+	}
+	off := int64(sector * sectorSize)
+	length := int64(count) * sectorSize
+	if int64(len(buff)) < length {
+		return fmt.Errorf("buffer too small: need %d bytes, got %d", length, len(buff))
+	}
+	if off+length > img.size {
+		return fmt.Errorf("access beyond end of image: sector %d, count %d", sector, count)
+	}
+
+	for done := int64(0); done < length; {
+		pos := off + done
+		fi := sort.Search(len(img.frames), func(i int) bool {
+			return img.frames[i].uOff+img.frames[i].uLen > pos
+		})
+		rel := pos - img.frames[fi].uOff
+		data, err := img.chunk(fi, rel/int64(img.chunkSize))
+		if err != nil {
+			return err
+		}
+		done += int64(copy(buff[done:length], data[rel%int64(img.chunkSize):]))
+	}
+	return nil
+}
+
+// WriteSectors always fails, compressed images are read-only.
+func (img *CompressedImage) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	return fmt.Errorf("compressed image is read-only: %w", FileResultWriteProtected)
+}
+
+// GetSectorSize returns the sector size of the image.
+func (img *CompressedImage) GetSectorSize() uint64 {
+	return sectorSize
+}
+
+// GetSectorCount returns the number of sectors in the decompressed image.
+func (img *CompressedImage) GetSectorCount() uint64 {
+	return uint64(img.size / sectorSize)
+}
+
+// Close releases the decoder, the cache and the underlying file.
+func (img *CompressedImage) Close() error {
+	if img.file == nil {
+		return nil
+	}
+	img.closeDecoder()
+	img.cache = newChunkCache(1)
+	err := img.file.Close()
+	img.file = nil
+	return err
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+type chunkKey struct {
+	frame int
+	index int64
+}
+
+type chunkEntry struct {
+	key  chunkKey
+	data []byte
+}
+
+// chunkCache is a small LRU cache of decompressed chunks.
+type chunkCache struct {
+	limit int
+	order *list.List
+	items map[chunkKey]*list.Element
+}
+
+func newChunkCache(limit int) *chunkCache {
+	return &chunkCache{
+		limit: limit,
+		order: list.New(),
+		items: make(map[chunkKey]*list.Element),
+	}
+}
+
+func (c *chunkCache) get(key chunkKey) ([]byte, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*chunkEntry).data, true
+}
+
+func (c *chunkCache) put(key chunkKey, data []byte) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*chunkEntry).data = data
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&chunkEntry{key, data})
+	for c.order.Len() > c.limit {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*chunkEntry).key)
+	}
+}
@@ -0,0 +1,150 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// unit is how much of the image each gzip member, xz block or zstd frame
+// holds, so that the seek index has several entries.
+const unit = 512 << 10
+
+// testImage returns a small formatted image holding testTree.
+func testImage(t *testing.T) []byte {
+	t.Helper()
+	dev := fatfs.NewMemDevice(4 << 20)
+	if err := fatfs.BuildImage(dev, testTree(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return dev.Bytes()
+}
+
+// testCompressed writes the compressed image data, opens it with a cache
+// of a few small chunks and checks it against the raw image.
+func testCompressed(t *testing.T, raw, data []byte, format fatfs.Compression) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := fatfs.DetectCompression(data); got != format {
+		t.Fatalf("detected %v", got)
+	}
+	img, err := fatfs.OpenCompressedImage(path, &fatfs.CompressedImageOptions{ChunkSize: 64 << 10, CacheSize: 256 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Format() != format || img.Size() != int64(len(raw)) {
+		t.Fatalf("%v image of %d bytes, want %v of %d", img.Format(), img.Size(), format, len(raw))
+	}
+
+	// random reads, many across units and evicting cached chunks, then
+	// backwards
+	rng := rand.New(rand.NewSource(1))
+	sectors := uint64(len(raw) / 512)
+	buf := make([]byte, 64*512)
+	read := func(sector uint64, count uint32) {
+		if err := img.ReadSectors(sector, count, buf); err != nil {
+			t.Fatal(err)
+		}
+		if want := raw[sector*512 : (sector+uint64(count))*512]; !bytes.Equal(buf[:len(want)], want) {
+			t.Fatalf("sectors %d+%d differ", sector, count)
+		}
+	}
+	for range 200 {
+		count := uint32(1 + rng.Intn(64))
+		read(uint64(rng.Int63n(int64(sectors-uint64(count)))), count)
+	}
+	for sector := sectors - 64; sector < sectors; sector -= 64 {
+		read(sector, 64)
+	}
+	read(unit/512-1, 2)
+	if err := img.ReadSectors(sectors, 1, buf); err == nil {
+		t.Error("read past the end succeeded")
+	}
+
+	// the image is read-only, and tells FatFs so
+	if err := img.Status(); !errors.Is(err, fatfs.FileResultWriteProtected) {
+		t.Errorf("status: %v", err)
+	}
+	if err := img.WriteSectors(0, 1, buf); !errors.Is(err, fatfs.FileResultWriteProtected) {
+		t.Errorf("write: %v", err)
+	}
+	checkTree(t, img, testTree())
+	mounted(t, img, func(fs *fatfs.FatFs) {
+		if _, err := fs.Create("new"); err == nil {
+			t.Error("created a file on a compressed image")
+		}
+	})
+}
+
+func TestCompressedGzip(t *testing.T) {
+	raw := testImage(t)
+	// one member per unit, as bgzip writes
+	var members bytes.Buffer
+	for off := 0; off < len(raw); off += unit {
+		zw := gzip.NewWriter(&members)
+		zw.Write(raw[off:min(off+unit, len(raw))])
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("members", func(t *testing.T) { testCompressed(t, raw, members.Bytes(), fatfs.CompressionGzip) })
+
+	// and a single member, decompressed on demand
+	var single bytes.Buffer
+	zw := gzip.NewWriter(&single)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("single", func(t *testing.T) { testCompressed(t, raw, single.Bytes(), fatfs.CompressionGzip) })
+}
+
+func TestCompressedXZ(t *testing.T) {
+	raw := testImage(t)
+	// several blocks, as xz -T writes
+	var buf bytes.Buffer
+	xw, err := xz.WriterConfig{BlockSize: unit}.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(raw)
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testCompressed(t, raw, buf.Bytes(), fatfs.CompressionXZ)
+}
+
+func TestCompressedZstd(t *testing.T) {
+	raw := testImage(t)
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// frames that record their size, as pzstd writes, and one streamed
+	// frame that does not
+	var data []byte
+	for off := 0; off < len(raw)-unit; off += unit {
+		data = enc.EncodeAll(raw[off:off+unit], data)
+	}
+	var last bytes.Buffer
+	enc.Reset(&last)
+	enc.Write(raw[len(raw)-unit:])
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, last.Bytes()...)
+	testCompressed(t, raw, data, fatfs.CompressionZstd)
+}
@@ -0,0 +1,757 @@
+package fatfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// DefragOptions controls AnalyzeFragmentation and Defrag.
+type DefragOptions struct {
+	// Partition selects the partition (1-based) to work on, 0 the volume
+	// FatFs would mount.
+	Partition int
+	// Compact makes Defrag move every file, packing the files together so
+	// that the free space ends up in as few runs as possible. Without it
+	// only fragmented files are moved, unless there is no room to make
+	// them contiguous otherwise.
+	Compact bool
+}
+
+// FileFragmentation describes how a file or directory is laid out.
+type FileFragmentation struct {
+	Path string
+	Dir  bool
+	Size uint64
+	// Clusters is the number of clusters allocated to the file.
+	Clusters uint32
+	// Extents is the number of runs of consecutive clusters, 0 for files
+	// without clusters.
+	Extents int
+}
+
+// Fragmented reports whether the file is stored in more than one run.
+func (f FileFragmentation) Fragmented() bool {
+	return f.Extents > 1
+}
+
+// FragmentationReport is the result of AnalyzeFragmentation.
+type FragmentationReport struct {
+	Type        Type
+	ClusterSize uint64
+	Clusters    uint32
+	Free        uint32
+	// FreeExtents is the number of runs of free clusters and LargestFree
+	// the length of the longest one, in clusters. The largest file that
+	// can be written contiguously is LargestFree*ClusterSize bytes.
+	FreeExtents int
+	LargestFree uint32
+
+	// Files lists every file and directory on the volume, except the root
+	// directory, in directory order.
+	Files []FileFragmentation
+}
+
+// Fragmented returns the files and directories stored in more than one run.
+func (r *FragmentationReport) Fragmented() []FileFragmentation {
+	var frag []FileFragmentation
+	for _, f := range r.Files {
+		if f.Fragmented() {
+			frag = append(frag, f)
+		}
+	}
+	return frag
+}
+
+// DefragReport is the result of Defrag.
+type DefragReport struct {
+	// Moved is the number of files Defrag moved and MovedBytes the size of
+	// the clusters it copied.
+	Moved      int
+	MovedBytes uint64
+	// Skipped lists the files left fragmented, as there was no room to
+	// make them contiguous.
+	Skipped []FileFragmentation
+	// Before and After describe the volume before and after Defrag.
+	Before, After *FragmentationReport
+}
+
+// AnalyzeFragmentation reports how fragmented the files and the free space
+// of the FAT or exFAT volume on blk are. blk must not be mounted.
+func AnalyzeFragmentation(blk BlockDevice, opts *DefragOptions) (*FragmentationReport, error) {
+	if opts == nil {
+		opts = &DefragOptions{}
+	}
+	v, err := openVolume(blk, opts.Partition)
+	if err != nil {
+		return nil, err
+	}
+	d := &defragger{v: v}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	return d.report, nil
+}
+
+// Defrag rewrites the fragmented files of the FAT or exFAT volume on blk so
+// that each is stored in a single run of clusters. It first tries to move
+// only the fragmented files, largest first into the smallest run of free
+// space (or of their own clusters) that holds them; if that leaves files
+// fragmented, or with opts.Compact, it packs all files together instead.
+// Directories are not moved, nor are clusters no file refers to. Files that
+// still do not fit are left fragmented and listed in the report. On exFAT
+// the contiguous files Defrag moved are marked as having no FAT chain, as
+// FatFs does for contiguous files.
+//
+// Data is moved a cluster at a time: the cluster is copied, the FAT (or
+// directory entry) is switched to the copy and only then is the old cluster
+// freed, so an interrupted Defrag leaves at worst a lost cluster for Check
+// to free. Defrag refuses to work on a volume with broken or cross-linked
+// chains; repair it with Check first. blk must not be mounted.
+func Defrag(blk BlockDevice, opts *DefragOptions) (*DefragReport, error) {
+	if opts == nil {
+		opts = &DefragOptions{}
+	}
+	v, err := openVolume(blk, opts.Partition)
+	if err != nil {
+		return nil, err
+	}
+	d := &defragger{v: v}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	report := &DefragReport{Before: d.report}
+
+	var target map[uint32]uint32
+	if !opts.Compact {
+		var fit bool
+		target, fit = d.layout(false)
+		if !fit {
+			target = nil
+		}
+	}
+	if target == nil {
+		target, _ = d.layout(true)
+	}
+	if err := d.run(target); err != nil {
+		report.Moved, report.MovedBytes = d.moved(), d.movedClusters*v.clusterBytes()
+		return report, err
+	}
+	if err := d.finish(); err != nil {
+		return report, err
+	}
+	report.Moved, report.MovedBytes = d.moved(), d.movedClusters*v.clusterBytes()
+
+	if err := d.scan(); err != nil {
+		return report, err
+	}
+	report.After = d.report
+	for _, f := range d.report.Files {
+		if f.Fragmented() && !f.Dir {
+			report.Skipped = append(report.Skipped, f)
+		}
+	}
+	return report, nil
+}
+
+// defragger holds the state of AnalyzeFragmentation, Defrag and Resize.
+type defragger struct {
+	v      *volume
+	report *FragmentationReport
+
+	// exFAT allocation bitmap and the clusters holding it.
+	bitmap         []byte
+	bitmapClusters []uint32
+
+	// files are the files, directories and volume structures that can be
+	// moved. owner maps a cluster to the index in files of its user plus
+	// one, -1 for clusters used otherwise and 0 for free ones; pos gives
+	// the index of a cluster in its user's chain.
+	files []*defragFile
+	owner []int32
+	pos   []uint32
+
+	movedClusters uint64
+}
+
+// moveKind tells what a defragFile is, which decides what points to its
+// first cluster.
+type moveKind int
+
+const (
+	moveFile moveKind = iota
+	moveDir
+	moveRoot   // FAT32 or exFAT root directory, found in the boot sector
+	moveUpcase // exFAT up-case table, found in the root directory
+)
+
+// defragFile is something Defrag or Resize may move.
+type defragFile struct {
+	FileFragmentation
+	kind moveKind
+	// parent is the directory holding the entry, nil for the fixed root
+	// directory of FAT12/16 and for the volume structures.
+	parent   *defragFile
+	ent      dirEnt
+	clusters []uint32
+	// subdirs are the subdirectories of a FAT directory, whose ".."
+	// entries point to it.
+	subdirs []*defragFile
+	moved   bool
+}
+
+// free reports whether cluster cl is free.
+func (d *defragger) free(cl uint32) bool {
+	if d.v.typ == TypeEXFAT {
+		i := cl - 2
+		return d.bitmap[i/8]&(1<<(i%8)) == 0
+	}
+	return d.v.fatEntry(cl) == 0
+}
+
+// scan walks the volume, recording the layout of every file and of the
+// free space.
+func (d *defragger) scan() error {
+	v := d.v
+	d.report = &FragmentationReport{Type: v.typ, ClusterSize: v.clusterBytes(), Clusters: v.nclst}
+	d.files = nil
+	d.owner = make([]int32, uint64(v.nclst)+2)
+	d.pos = make([]uint32, uint64(v.nclst)+2)
+
+	var root *defragFile
+	if v.typ != TypeFAT12 && v.typ != TypeFAT16 {
+		root = &defragFile{kind: moveRoot, FileFragmentation: FileFragmentation{Path: "/", Dir: true}}
+		if err := d.claim(root, "/", v.rootCluster, 0); err != nil {
+			return err
+		}
+	}
+	if v.typ == TypeEXFAT {
+		bitmap, clusters, err := v.readBitmap()
+		if err != nil {
+			return err
+		}
+		d.bitmap, d.bitmapClusters = bitmap, clusters
+		if uint64(len(d.bitmap))*8 < uint64(v.nclst) {
+			return fmt.Errorf("%w: allocation bitmap too small for %d clusters", FileResultIntErr, v.nclst)
+		}
+		for _, cl := range clusters {
+			if d.owner[cl] != 0 {
+				return fmt.Errorf("<allocation bitmap>: %w: cluster %d is cross-linked", FileResultIntErr, cl)
+			}
+			d.owner[cl] = -1
+		}
+		upcase := &defragFile{kind: moveUpcase, parent: root, FileFragmentation: FileFragmentation{Path: "<up-case table>"}}
+		if err := d.claim(upcase, "<up-case table>", v.upcaseCluster, 0); err != nil {
+			return err
+		}
+	}
+	if err := d.scanDir("/", root); err != nil {
+		return err
+	}
+
+	// clusters in use that no file refers to (lost chains, bad clusters)
+	// stay where they are
+	var (
+		n    uint32
+		runs int
+	)
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if d.owner[cl] == 0 && !d.free(cl) {
+			d.owner[cl] = -1
+		}
+		if d.owner[cl] == 0 {
+			d.report.Free++
+			if n == 0 {
+				runs++
+			}
+			n++
+			d.report.LargestFree = max(d.report.LargestFree, n)
+		} else {
+			n = 0
+		}
+	}
+	d.report.FreeExtents = runs
+	return nil
+}
+
+// claim records f with the chain starting at first, marking its clusters.
+// A non-zero count is the length of an exFAT chain without FAT entries.
+func (d *defragger) claim(f *defragFile, name string, first uint32, count uint64) error {
+	v := d.v
+	var (
+		clusters []uint32
+		err      error
+	)
+	if count != 0 {
+		last := first + uint32(count) - 1
+		if !v.validCluster(first) || !v.validCluster(last) {
+			return fmt.Errorf("%s: %w: clusters %d-%d out of range", name, FileResultIntErr, first, last)
+		}
+		clusters = contiguous(first, count)
+	} else if clusters, err = v.chain(first); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	owner := int32(len(d.files) + 1)
+	for i, cl := range clusters {
+		if d.owner[cl] != 0 {
+			return fmt.Errorf("%s: %w: cluster %d is cross-linked", name, FileResultIntErr, cl)
+		}
+		d.owner[cl] = owner
+		d.pos[cl] = uint32(i)
+	}
+	f.clusters = clusters
+	d.files = append(d.files, f)
+	return nil
+}
+
+// dirSectors returns the sectors of the directory dir, nil standing for
+// the fixed root directory.
+func (d *defragger) dirSectors(dir *defragFile) []uint64 {
+	if dir == nil {
+		return d.v.rootSectors()
+	}
+	return d.v.clusterSectors(dir.clusters)
+}
+
+func (d *defragger) scanDir(dir string, parent *defragFile) error {
+	v := d.v
+	data, err := v.readDir(d.dirSectors(parent))
+	if err != nil {
+		return err
+	}
+	// malformed entries are left to Check, their clusters stay where they
+	// are
+	ents, _ := v.parseDir(data, nil)
+
+	var subdirs []*defragFile
+	cb := v.clusterBytes()
+	for _, e := range ents {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		p := path.Join(dir, e.name)
+		info := FileFragmentation{Path: p, Dir: e.isDir(), Size: e.size}
+		if e.cluster == 0 {
+			d.report.Files = append(d.report.Files, info)
+			continue
+		}
+
+		var n uint64
+		if e.noFatChain {
+			n = max((e.size+cb-1)/cb, 1)
+		}
+		f := &defragFile{kind: moveFile, parent: parent, ent: e}
+		if e.isDir() {
+			f.kind = moveDir
+		}
+		if err := d.claim(f, p, e.cluster, n); err != nil {
+			return err
+		}
+		info.Clusters = uint32(len(f.clusters))
+		info.Extents = countExtents(f.clusters)
+		f.FileFragmentation = info
+		d.report.Files = append(d.report.Files, info)
+		if e.isDir() {
+			subdirs = append(subdirs, f)
+		}
+	}
+	if parent != nil && v.typ != TypeEXFAT {
+		parent.subdirs = subdirs
+	}
+
+	for _, sub := range subdirs {
+		if err := d.scanDir(sub.Path, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countExtents returns the number of runs of consecutive clusters.
+func countExtents(clusters []uint32) int {
+	n := 0
+	for i, cl := range clusters {
+		if i == 0 || cl != clusters[i-1]+1 {
+			n++
+		}
+	}
+	return n
+}
+
+type clusterRun struct {
+	start, n uint32
+}
+
+// layout plans where files go, returning the new place of every cluster
+// that moves. With all set every file is placed, otherwise only the
+// fragmented ones, around the contiguous files. Files are placed largest
+// first into the smallest run of free clusters or clusters of files being
+// placed that holds them; fit reports whether every file found room.
+func (d *defragger) layout(all bool) (target map[uint32]uint32, fit bool) {
+	v := d.v
+	var movers []*defragFile
+	for _, f := range d.files {
+		if f.kind == moveFile && (all || f.Fragmented()) {
+			movers = append(movers, f)
+		}
+	}
+	// largest first, they need the longest runs
+	sort.SliceStable(movers, func(i, j int) bool {
+		return len(movers[i].clusters) > len(movers[j].clusters)
+	})
+
+	fit = true
+	for {
+		moving := make([]bool, len(d.files)+1)
+		for _, f := range movers {
+			moving[d.owner[f.clusters[0]]] = true
+		}
+		var runs []clusterRun
+		for cl := uint32(2); cl < v.nclst+2; cl++ {
+			if o := d.owner[cl]; o < 0 || o > 0 && !moving[o] {
+				continue
+			}
+			if k := len(runs) - 1; k >= 0 && runs[k].start+runs[k].n == cl {
+				runs[k].n++
+			} else {
+				runs = append(runs, clusterRun{cl, 1})
+			}
+		}
+
+		target = map[uint32]uint32{}
+		stuck := -1
+		for i, f := range movers {
+			n := uint32(len(f.clusters))
+			best := -1
+			for j, r := range runs {
+				if r.n >= n && (best < 0 || r.n < runs[best].n) {
+					best = j
+				}
+			}
+			if best < 0 {
+				stuck = i
+				break
+			}
+			r := &runs[best]
+			for k, cl := range f.clusters {
+				if dst := r.start + uint32(k); dst != cl {
+					target[cl] = dst
+				}
+			}
+			r.start += n
+			r.n -= n
+		}
+		if stuck < 0 {
+			return target, fit
+		}
+		// a file that fits nowhere keeps its clusters, which changes the
+		// runs the others can use, so start over without it
+		fit = false
+		movers = append(movers[:stuck:stuck], movers[stuck+1:]...)
+	}
+}
+
+// moved returns the number of files moved so far.
+func (d *defragger) moved() int {
+	n := 0
+	for _, f := range d.files {
+		if f.moved && f.kind == moveFile {
+			n++
+		}
+	}
+	return n
+}
+
+// run moves every cluster in target to its new place. Moves form chains,
+// where a cluster's new place is still taken by a cluster yet to move, and
+// cycles; a chain is moved from its end, a cycle through a free cluster
+// outside the plan.
+func (d *defragger) run(target map[uint32]uint32) error {
+	taken := make(map[uint32]bool, len(target))
+	for _, dst := range target {
+		taken[dst] = true
+	}
+	// go through the files in order, for a predictable result
+	var sources []uint32
+	for _, f := range d.files {
+		for _, cl := range f.clusters {
+			if _, ok := target[cl]; ok {
+				sources = append(sources, cl)
+			}
+		}
+	}
+
+	for _, src := range sources {
+		if _, ok := target[src]; !ok {
+			continue // moved as part of an earlier chain
+		}
+		chain := []uint32{src}
+		cycle := false
+		for cl := target[src]; ; cl = target[cl] {
+			if cl == src {
+				cycle = true
+				break
+			}
+			if _, ok := target[cl]; !ok {
+				break
+			}
+			chain = append(chain, cl)
+		}
+
+		if !cycle {
+			for i := len(chain) - 1; i >= 0; i-- {
+				if err := d.moveCluster(chain[i], target[chain[i]]); err != nil {
+					return err
+				}
+				delete(target, chain[i])
+			}
+			continue
+		}
+
+		tmp := d.spare(taken)
+		if tmp == 0 {
+			return fmt.Errorf("%w: no free cluster to move cluster %d through", FileResultDenied, src)
+		}
+		dst := target[src]
+		if err := d.moveCluster(src, tmp); err != nil {
+			return err
+		}
+		delete(target, src)
+		for i := len(chain) - 1; i > 0; i-- {
+			if err := d.moveCluster(chain[i], target[chain[i]]); err != nil {
+				return err
+			}
+			delete(target, chain[i])
+		}
+		if err := d.moveCluster(tmp, dst); err != nil {
+			return err
+		}
+		d.movedClusters--
+	}
+	return nil
+}
+
+// spare returns a free cluster no planned move needs, 0 if there is none.
+func (d *defragger) spare(taken map[uint32]bool) uint32 {
+	for cl := d.v.nclst + 1; cl >= 2; cl-- {
+		if d.owner[cl] == 0 && !taken[cl] {
+			return cl
+		}
+	}
+	return 0
+}
+
+// moveCluster moves cluster src of a file, directory or volume structure
+// to the free cluster dst.
+func (d *defragger) moveCluster(src, dst uint32) error {
+	v := d.v
+	f := d.files[d.owner[src]-1]
+	i := d.pos[src]
+	if f.ent.noFatChain {
+		// moving a cluster of a file without a FAT chain needs one
+		if err := d.setChain(f, false); err != nil {
+			return err
+		}
+	}
+	fatDir := f.kind == moveDir && v.typ != TypeEXFAT
+
+	data, err := v.read(v.clusterSector(src), v.csize)
+	if err != nil {
+		return err
+	}
+	if fatDir && i == 0 {
+		setDotEntry(data, ".          ", dst, v.typ)
+	}
+	if err := v.write(v.clusterSector(dst), data); err != nil {
+		return err
+	}
+
+	// allocate the copy, link to it, then free the original
+	v.setFATEntry(dst, v.fatEntry(src))
+	if err := v.flushFAT(); err != nil {
+		return err
+	}
+	if v.typ == TypeEXFAT {
+		if err := d.setBitmap(dst, true); err != nil {
+			return err
+		}
+	}
+	if i == 0 {
+		f.clusters[0] = dst
+		if err := d.writeEntry(f); err != nil {
+			f.clusters[0] = src
+			return err
+		}
+		if fatDir {
+			if err := d.setParentEntries(f.subdirs, dst); err != nil {
+				return err
+			}
+		}
+	} else {
+		v.setFATEntry(f.clusters[i-1], dst)
+		if err := v.flushFAT(); err != nil {
+			return err
+		}
+	}
+	v.setFATEntry(src, 0)
+	if err := v.flushFAT(); err != nil {
+		return err
+	}
+	if v.typ == TypeEXFAT {
+		if err := d.setBitmap(src, false); err != nil {
+			return err
+		}
+	}
+
+	f.clusters[i] = dst
+	f.moved = true
+	d.owner[dst], d.owner[src] = d.owner[src], 0
+	d.pos[dst] = i
+	d.movedClusters++
+	return nil
+}
+
+// setDotEntry points the dot entry name ("." or "..", padded to 11
+// characters) at the start of a FAT directory's first cluster to cl.
+func setDotEntry(data []byte, name string, cl uint32, typ Type) bool {
+	for i := 0; i < 2 && (i+1)*dirEntrySize <= len(data); i++ {
+		ent := data[i*dirEntrySize : (i+1)*dirEntrySize]
+		if string(ent[:11]) != name {
+			continue
+		}
+		binary.LittleEndian.PutUint16(ent[26:], uint16(cl))
+		if typ == TypeFAT32 {
+			binary.LittleEndian.PutUint16(ent[20:], uint16(cl>>16))
+		}
+		return true
+	}
+	return false
+}
+
+// setParentEntries points the ".." entries of subdirs to cl.
+func (d *defragger) setParentEntries(subdirs []*defragFile, cl uint32) error {
+	v := d.v
+	for _, sub := range subdirs {
+		sector := v.clusterSector(sub.clusters[0])
+		data, err := v.read(sector, 1)
+		if err != nil {
+			return err
+		}
+		if setDotEntry(data, "..         ", cl, v.typ) {
+			if err := v.write(sector, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finish marks the contiguous exFAT files Defrag moved as having no FAT
+// chain and clears the FAT entries they no longer need.
+func (d *defragger) finish() error {
+	if d.v.typ != TypeEXFAT {
+		return nil
+	}
+	cb := d.v.clusterBytes()
+	for _, f := range d.files {
+		n := uint64(len(f.clusters))
+		if f.kind != moveFile && f.kind != moveDir {
+			continue
+		}
+		if f.moved && countExtents(f.clusters) == 1 && max((f.ent.size+cb-1)/cb, 1) == n {
+			if err := d.setChain(f, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setChain switches an exFAT file between a FAT chain and none. The FAT
+// chain is written before the entry is switched to it, and cleared after
+// the entry is switched away from it.
+func (d *defragger) setChain(f *defragFile, noFatChain bool) error {
+	v := d.v
+	if !noFatChain {
+		for k, cl := range f.clusters {
+			if k == len(f.clusters)-1 {
+				v.setFATEntry(cl, v.eoc())
+			} else {
+				v.setFATEntry(cl, f.clusters[k+1])
+			}
+		}
+		if err := v.flushFAT(); err != nil {
+			return err
+		}
+	}
+	f.ent.noFatChain = noFatChain
+	if err := d.writeEntry(f); err != nil {
+		return err
+	}
+	if noFatChain {
+		for _, cl := range f.clusters {
+			v.setFATEntry(cl, 0)
+		}
+		return v.flushFAT()
+	}
+	return nil
+}
+
+// writeEntry points whatever refers to f to its first cluster: its
+// directory entry, which also records the chain flag, or for the volume
+// structures the boot sector or root directory.
+func (d *defragger) writeEntry(f *defragFile) error {
+	v := d.v
+	first := f.clusters[0]
+	switch f.kind {
+	case moveRoot:
+		err := v.updateBoot(func(boot []byte) {
+			if v.typ == TypeEXFAT {
+				binary.LittleEndian.PutUint32(boot[96:], first)
+			} else {
+				binary.LittleEndian.PutUint32(boot[44:], first)
+			}
+		})
+		if err == nil {
+			v.rootCluster = first
+		}
+		return err
+	case moveUpcase:
+		dir, err := v.readDir(d.dirSectors(f.parent))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < dir.entries(); i++ {
+			if ent := dir.entry(i); ent[0] == exfatUpcase {
+				binary.LittleEndian.PutUint32(ent[20:], first)
+				dir.dirty = true
+			}
+		}
+		v.upcaseCluster = first
+		return v.writeDir(dir)
+	}
+
+	dir, err := v.readDir(d.dirSectors(f.parent))
+	if err != nil {
+		return err
+	}
+	f.ent.cluster = first
+	v.setEntry(dir, &f.ent)
+	return v.writeDir(dir)
+}
+
+// setBitmap marks cluster cl as used or free in the exFAT allocation bitmap
+// and writes the changed sector.
+func (d *defragger) setBitmap(cl uint32, used bool) error {
+	v := d.v
+	i := cl - 2
+	if used {
+		d.bitmap[i/8] |= 1 << (i % 8)
+	} else {
+		d.bitmap[i/8] &^= 1 << (i % 8)
+	}
+	s := uint64(i/8) / v.ssize
+	sector := v.clusterSector(d.bitmapClusters[s/v.csize]) + s%v.csize
+	return v.write(sector, d.bitmap[s*v.ssize:(s+1)*v.ssize])
+}
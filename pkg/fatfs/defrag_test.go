@@ -0,0 +1,157 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs/fatfstest"
+)
+
+// fragment builds tree on a fresh device and adds files written a chunk at
+// a time in turn, with every other one removed afterwards, so that both the
+// files kept and the free space between them are fragmented.
+func fragment(t *testing.T, format fatfs.FormatOptions, size int64, tree fstest.MapFS) *fatfs.MemDevice {
+	t.Helper()
+	dev := fatfs.NewMemDevice(size)
+	if err := fatfs.BuildImage(dev, tree, &fatfs.BuildOptions{Format: format}); err != nil {
+		t.Fatal(err)
+	}
+	mounted(t, dev, func(fs *fatfs.FatFs) {
+		if err := fs.MkdirAll("frag/deep", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		var files []*fatfs.FatFile
+		var names []string
+		for i := range 8 {
+			name := fmt.Sprintf("frag/%d.bin", i)
+			if i%2 == 1 {
+				name = fmt.Sprintf("frag/deep/%d.bin", i)
+			}
+			f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, f)
+			names = append(names, name)
+		}
+		data := make([][]byte, len(files))
+		for round := range 12 {
+			for i, f := range files {
+				chunk := bytes.Repeat([]byte{byte(i), byte(round)}, 3000+i*100)
+				if _, err := f.Write(chunk); err != nil {
+					t.Fatal(err)
+				}
+				data[i] = append(data[i], chunk...)
+			}
+		}
+		for i, f := range files {
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 0 {
+				if err := fs.Remove(names[i]); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				tree[names[i]] = &fstest.MapFile{Data: data[i]}
+			}
+		}
+	})
+	return dev
+}
+
+var defragTests = []struct {
+	name   string
+	format fatfs.FormatOptions
+	size   int64
+}{
+	{"fat16", fatfs.FormatOptions{Type: fatfs.TypeFAT16, ClusterSize: 2048}, 16 << 20},
+	{"fat32", fatfs.FormatOptions{Type: fatfs.TypeFAT32, ClusterSize: 512}, 40 << 20},
+	{"exfat", fatfs.FormatOptions{Type: fatfs.TypeEXFAT, ClusterSize: 4096}, 8 << 20},
+}
+
+func TestDefrag(t *testing.T) {
+	for _, tc := range defragTests {
+		for _, compact := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/compact=%v", tc.name, compact), func(t *testing.T) {
+				tree := cloneTree(testTree())
+				dev := fragment(t, tc.format, tc.size, tree)
+				before, err := fatfs.AnalyzeFragmentation(dev, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(before.Fragmented()) == 0 {
+					t.Fatal("no fragmented files to start with")
+				}
+
+				report, err := fatfs.Defrag(dev, &fatfs.DefragOptions{Compact: compact})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Moved == 0 || len(report.Skipped) != 0 {
+					t.Errorf("moved %d files, skipped %v", report.Moved, report.Skipped)
+				}
+				for _, f := range report.After.Fragmented() {
+					if !f.Dir {
+						t.Errorf("%s still in %d extents", f.Path, f.Extents)
+					}
+				}
+				// directories stay where they are, so compacting need not
+				// join all the free space
+				if compact && report.After.LargestFree < before.LargestFree {
+					t.Errorf("largest free run of %d clusters after compacting, %d before", report.After.LargestFree, before.LargestFree)
+				}
+				checkTree(t, dev, tree)
+
+				after, err := fatfs.AnalyzeFragmentation(dev, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if after.Free != before.Free {
+					t.Errorf("%d free clusters after defragmenting, %d before", after.Free, before.Free)
+				}
+			})
+		}
+	}
+}
+
+// An interrupted Defrag loses at most a cluster, which Check frees, and
+// never the contents of a file.
+func TestDefragInterrupted(t *testing.T) {
+	for _, tc := range defragTests {
+		t.Run(tc.name, func(t *testing.T) {
+			tree := cloneTree(testTree())
+			orig := fragment(t, tc.format, tc.size, tree)
+
+			// count the writes of a whole run to pick where to fail
+			dev := fatfstest.NewFaultDevice(orig.Clone())
+			if _, err := fatfs.Defrag(dev, nil); err != nil {
+				t.Fatal(err)
+			}
+			_, writes := dev.Counts()
+			for _, n := range []int{0, 1, writes / 3, writes / 2, writes - 1} {
+				mem := orig.Clone()
+				dev := fatfstest.NewFaultDevice(mem)
+				dev.FailAfter(fatfstest.OpWrite, n)
+				if _, err := fatfs.Defrag(dev, nil); err == nil {
+					t.Fatalf("defrag failing after %d of %d writes succeeded", n, writes)
+				}
+
+				report, err := fatfs.Check(mem, &fatfs.CheckOptions{Repair: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range report.Problems {
+					if p.Kind != fatfs.ProblemLostChain && p.Kind != fatfs.ProblemFreeCount {
+						t.Errorf("after %d of %d writes: %v", n, writes, p)
+					}
+				}
+				checkTree(t, mem, tree)
+			}
+		})
+	}
+}
@@ -1,5 +1,3 @@
-#include <time.h>
-
 #include "ff.h"       // For DRESULT, DSTATUS, etc.
 #include "diskio.h"   // If you have a separate diskio.h
 #include "_cgo_export.h" // Magic cgo-generated header to call Go functions
@@ -53,7 +51,7 @@ DRESULT disk_ioctl (
 {
     switch(cmd) {
         case CTRL_SYNC:
-            return RES_OK;
+            return (DRESULT)Go_diskSync(pdrv);
             break;
             
         case GET_SECTOR_COUNT:
@@ -85,30 +83,23 @@ DRESULT disk_ioctl (
     return RES_OK;
 }
 
-#if defined(_WIN32) || defined(_WIN64)
-#define localtime_r(a,b) (localtime_s(b,a) ? 0 : b)
-#endif
+/*
+ * Timestamps come from the clock of the drive's volume, see clock.go.
+ */
+DWORD get_fattime_drv(BYTE pdrv)
+{
+	return (DWORD)Go_getFatTime(pdrv);
+}
 
 DWORD get_fattime(void)
-{ 
-	struct tm tm;
-	time_t now = time(NULL);
-	if (localtime_r(&now, &tm) != NULL) {
-		DWORD fattime =
-			/* bit31:25: Year origin from the 1980 (0..127, e.g. 37 for 2017) */
-			(((tm.tm_year - 80) & 0x7f) << 25) |
-			/* bit24:21: Month (1..12) */
-			(((tm.tm_mon + 1) & 0xf) << 21) |
-			/* bit20:16: Day of the month (1..31) */
-			((tm.tm_mday & 0x1f) << 16) |
-			/* bit15:11: Hour (0..23)) */
-			((tm.tm_hour & 0x1f) << 11) |
-			/* bit10:5: Minute (0..59) */
-			((tm.tm_min & 0x3f) << 5) |
-			/* bit4:0 Second / 2 (0..29, e.g. 25 for 50) */
-			((tm.tm_sec & 0x3f) / 2);
-		//printf("get_fattime %x\n", fattime);
-		return fattime;
-	} else
-		return 1; 
-}
\ No newline at end of file
+{
+	return (DWORD)Go_getFatTime(0xFF);
+}
+
+/*
+ * Short name generation is set per drive, see shortname.go.
+ */
+BYTE get_sfn_mode(BYTE pdrv)
+{
+	return (BYTE)Go_shortNameMode(pdrv);
+}
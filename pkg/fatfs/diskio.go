@@ -8,7 +8,9 @@ package fatfs
 */
 import "C"
 import (
+	"errors"
 	"fmt"
+	"sync"
 	"unsafe"
 )
 
@@ -18,20 +20,121 @@ const (
 	C_STA_PROTECT C.int = 0x04 /* Write protected */
 )
 
-var deviceMap = make(map[uint8]BlockDevice)
+// ErrDriveInUse is returned when registering or mounting on a drive number
+// that another device or mount holds.
+var ErrDriveInUse = errors.New("drive is in use")
 
-// RegisterBlockDevice associates a BlockDevice with a drive number.
-func RegisterBlockDevice(pdrv uint8, dev BlockDevice) {
-	deviceMap[pdrv] = dev
+var (
+	deviceMu  sync.RWMutex
+	deviceMap = make(map[uint8]registration)
+)
+
+// registration is a device on a drive and who registered it: the device
+// itself, the FatFs mounting it or a Format.
+type registration struct {
+	dev   BlockDevice
+	owner any
+}
+
+// RegisterBlockDevice associates a BlockDevice with a drive number. It
+// fails with ErrDriveInUse when another device is registered there.
+func RegisterBlockDevice(pdrv uint8, dev BlockDevice) error {
+	return claimDrive(pdrv, dev, dev)
 }
 
+// UnregisterBlockDevice removes the device on a drive number, whoever
+// registered it.
 func UnregisterBlockDevice(pdrv uint8) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	delete(deviceMap, pdrv)
+}
+
+// claimDrive registers dev on pdrv for owner, unless another owner holds
+// the drive.
+func claimDrive(pdrv uint8, dev BlockDevice, owner any) error {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if r, ok := deviceMap[pdrv]; ok && r.owner != owner {
+		return fmt.Errorf("drive %d: %w", pdrv, ErrDriveInUse)
+	}
+	deviceMap[pdrv] = registration{dev, owner}
+	return nil
+}
+
+// releaseDrive unregisters the device on pdrv if owner registered it, and
+// reports whether it did.
+func releaseDrive(pdrv uint8, owner any) bool {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if r, ok := deviceMap[pdrv]; !ok || r.owner != owner {
+		return false
+	}
 	delete(deviceMap, pdrv)
+	return true
+}
+
+// ownsDrive reports whether owner registered the device on pdrv.
+func ownsDrive(pdrv uint8, owner any) bool {
+	deviceMu.RLock()
+	defer deviceMu.RUnlock()
+	r, ok := deviceMap[pdrv]
+	return ok && r.owner == owner
+}
+
+// driveFree reports whether pdrv has no device and no settings left by a
+// FatFs that is not mounted yet. deviceMu must be held, for reading at
+// least.
+func driveFree(pdrv uint8) bool {
+	if _, ok := deviceMap[pdrv]; ok {
+		return false
+	}
+	timeMu.RLock()
+	_, timed := driveTimes[pdrv]
+	timeMu.RUnlock()
+	shortNameMu.RLock()
+	_, named := shortNameModes[pdrv]
+	shortNameMu.RUnlock()
+	return !timed && !named
+}
+
+// freeDrives returns the drive numbers that are free at the moment.
+func freeDrives() []uint8 {
+	deviceMu.RLock()
+	defer deviceMu.RUnlock()
+	var free []uint8
+	for pdrv := uint8(0); pdrv < C.FF_VOLUMES; pdrv++ {
+		if driveFree(pdrv) {
+			free = append(free, pdrv)
+		}
+	}
+	return free
+}
+
+// registerFreeBlockDevice associates a BlockDevice with the first free
+// drive number for owner, for short-lived operations like formatting.
+func registerFreeBlockDevice(dev BlockDevice, owner any) (uint8, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	for pdrv := uint8(0); pdrv < C.FF_VOLUMES; pdrv++ {
+		if driveFree(pdrv) {
+			deviceMap[pdrv] = registration{dev, owner}
+			return pdrv, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d drives are in use", C.FF_VOLUMES)
+}
+
+func lookupBlockDevice(pdrv C.BYTE) (BlockDevice, bool) {
+	deviceMu.RLock()
+	defer deviceMu.RUnlock()
+	r, ok := deviceMap[uint8(pdrv)]
+	return r.dev, ok
 }
 
 //export Go_diskRead
 func Go_diskRead(pdrv C.BYTE, buff *C.uchar, sector C.LBA_t, count C.uint) C.int {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return C.RES_ERROR // Some error code
 	}
@@ -42,15 +145,15 @@ func Go_diskRead(pdrv C.BYTE, buff *C.uchar, sector C.LBA_t, count C.uint) C.int
 
 	err := bd.ReadSectors(uint64(sector), uint32(count), buffer)
 	if err != nil {
-		fmt.Println("diskRead error:", err)
-		return C.RES_ERROR
+		Logger.Println("diskRead error:", err)
+		return diskResult(err)
 	}
 	return C.RES_OK
 }
 
 //export Go_diskWrite
 func Go_diskWrite(pdrv C.BYTE, buff *C.uchar, sector C.LBA_t, count C.uint) C.int {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return C.RES_ERROR
 	}
@@ -60,15 +163,15 @@ func Go_diskWrite(pdrv C.BYTE, buff *C.uchar, sector C.LBA_t, count C.uint) C.in
 
 	err := bd.WriteSectors(uint64(sector), uint32(count), buffer)
 	if err != nil {
-		fmt.Println("diskWrite error:", err)
-		return C.RES_ERROR
+		Logger.Println("diskWrite error:", err)
+		return diskResult(err)
 	}
 	return C.RES_OK
 }
 
 //export Go_diskGetSectorSize
 func Go_diskGetSectorSize(pdrv C.BYTE) C.uint {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return 0
 	}
@@ -77,34 +180,72 @@ func Go_diskGetSectorSize(pdrv C.BYTE) C.uint {
 
 //export Go_diskGetSectorCount
 func Go_diskGetSectorCount(pdrv C.BYTE) C.LBA_t {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return 0
 	}
 	return C.LBA_t(bd.GetSectorCount())
 }
 
+//export Go_diskSync
+func Go_diskSync(pdrv C.BYTE) C.int {
+	bd, ok := lookupBlockDevice(pdrv)
+	if !ok {
+		return C.RES_ERROR
+	}
+	if syncer, ok := bd.(Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			Logger.Println("diskSync error:", err)
+			return diskResult(err)
+		}
+	}
+	return C.RES_OK
+}
+
 //export Go_diskInitialize
 func Go_diskInitialize(pdrv C.BYTE) C.int {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return C_STA_NOINIT
 	}
 	if err := bd.Initialize(); err != nil {
-		return C_STA_NOINIT
+		return diskStatus(err)
 	}
 	return 0 // success
 }
 
 //export Go_diskStatus
 func Go_diskStatus(pdrv C.BYTE) C.int {
-	bd, ok := deviceMap[uint8(pdrv)]
+	bd, ok := lookupBlockDevice(pdrv)
 	if !ok {
 		return C_STA_NOINIT
 	}
 	if err := bd.Status(); err != nil {
-		// Could return an error status
-		return C_STA_NOINIT
+		return diskStatus(err)
 	}
 	return 0 // OK
 }
+
+// diskResult maps a BlockDevice read/write error to a DRESULT. Devices can
+// return FileResultNotReady or FileResultWriteProtected (possibly wrapped)
+// to have FatFs report FR_NOT_READY or FR_WRITE_PROTECTED, anything else is
+// a hard error.
+func diskResult(err error) C.int {
+	switch {
+	case errors.Is(err, FileResultWriteProtected):
+		return C.RES_WRPRT
+	case errors.Is(err, FileResultNotReady):
+		return C.RES_NOTRDY
+	default:
+		return C.RES_ERROR
+	}
+}
+
+// diskStatus maps a BlockDevice Initialize/Status error to DSTATUS bits.
+// FileResultWriteProtected marks a working but read-only medium.
+func diskStatus(err error) C.int {
+	if errors.Is(err, FileResultWriteProtected) {
+		return C_STA_PROTECT
+	}
+	return C_STA_NOINIT
+}
@@ -0,0 +1,91 @@
+package fatfs_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// gatedDevice blocks its first write until released, to hold a Format in
+// the middle of its work.
+type gatedDevice struct {
+	*fatfs.MemDevice
+	started, release chan struct{}
+}
+
+func (g *gatedDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	if g.started != nil {
+		close(g.started)
+		g.started = nil
+		<-g.release
+	}
+	return g.MemDevice.WriteSectors(sector, count, buff)
+}
+
+func TestMountDriveInUse(t *testing.T) {
+	dev := &gatedDevice{fatfs.NewMemDevice(4 << 20), make(chan struct{}), make(chan struct{})}
+	done := make(chan error)
+	go func() { done <- fatfs.Format(dev, nil) }()
+	<-dev.started
+
+	// the Format holds drive 0
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(fatfs.NewMemDevice(4 << 20)); !errors.Is(err, fatfs.ErrDriveInUse) {
+		t.Errorf("mount on the drive of a running Format: %v", err)
+	}
+	if err := fatfs.RegisterBlockDevice(0, fatfs.NewMemDevice(4<<20)); !errors.Is(err, fatfs.ErrDriveInUse) {
+		t.Errorf("register on the drive of a running Format: %v", err)
+	}
+	// and the failed mount must not unmount anything
+	if err := fs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	close(dev.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// once it is done the drive is free again
+	mounted(t, dev, func(fs *fatfs.FatFs) { writeFile(t, fs, "x", []byte("x")) })
+}
+
+func TestFormatKeepsClockOfUnmountedVolume(t *testing.T) {
+	stamp := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetLocation(time.UTC)
+	fs.SetClock(func() time.Time { return stamp })
+
+	// formatting and building pick another drive and leave the clock be
+	other := fatfs.NewMemDevice(4 << 20)
+	if err := fatfs.Format(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fatfs.BuildImage(other, testTree(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dev := fatfs.NewMemDevice(4 << 20)
+	if err := fatfs.Format(dev, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+	writeFile(t, fs, "stamped", []byte("x"))
+	info, err := fs.Stat("stamped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(stamp) {
+		t.Errorf("modified at %v, want %v", info.ModTime(), stamp)
+	}
+}
@@ -0,0 +1,79 @@
+package fatfs
+
+/*
+#include "ff.h"
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// Extent is a run of consecutive clusters of a file.
+type Extent struct {
+	// Offset is the position of the run in the file in bytes.
+	Offset int64
+	// Cluster is the first cluster of the run and Clusters its length.
+	Cluster  uint32
+	Clusters uint32
+	// Sector is the first sector of the run on the BlockDevice of the
+	// volume and Sectors its length, whole clusters.
+	Sector  uint64
+	Sectors uint64
+}
+
+// FileExtents tells where the data of a file lies on the device.
+type FileExtents struct {
+	Size        int64
+	ClusterSize int64
+	// Extents are the cluster runs of the file in file order, none for an
+	// empty file.
+	Extents []Extent
+	// Fragmented is set if the file has more than one extent.
+	Fragmented bool
+	// NoFatChain is set for exFAT files marked contiguous, which have no
+	// FAT chain; readers must not follow the FAT for them.
+	NoFatChain bool
+}
+
+// Extents returns the cluster runs of the file at path and where they are
+// on the BlockDevice, for loaders that read files by sector. Sectors of a
+// volume in a partition count from the start of the whole device.
+func (f *FatFs) Extents(path string) (*FileExtents, error) {
+	Logger.Println("CALL Extents", path)
+	file, err := f.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if file.info.IsDir() {
+		return nil, errors.New("extents of directories are not supported")
+	}
+	// the link map of fast seek mode is the list of cluster runs
+	if err := file.EnableFastSeek(); err != nil {
+		return nil, err
+	}
+
+	fs := file.fil.obj.fs
+	csect := uint64(fs.csize)
+	x := &FileExtents{
+		Size:        int64(file.fil.obj.objsize),
+		ClusterSize: int64(csect * SectorSize),
+		NoFatChain:  Type(fs.fs_type) == TypeEXFAT && file.fil.obj.stat&3 == 2,
+	}
+	tbl := unsafe.Slice(file.clmt, *file.clmt)
+	var offset int64
+	for i := 1; i+1 < len(tbl) && tbl[i] != 0; i += 2 {
+		n, clst := uint32(tbl[i]), uint32(tbl[i+1])
+		x.Extents = append(x.Extents, Extent{
+			Offset:   offset,
+			Cluster:  clst,
+			Clusters: n,
+			Sector:   uint64(fs.database) + uint64(clst-2)*csect,
+			Sectors:  uint64(n) * csect,
+		})
+		offset += int64(n) * x.ClusterSize
+	}
+	x.Fragmented = len(x.Extents) > 1
+	return x, nil
+}
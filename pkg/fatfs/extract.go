@@ -0,0 +1,269 @@
+package fatfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ExtractOptions controls ExtractImage.
+type ExtractOptions struct {
+	// Include, if not empty, limits extraction to the files matching one
+	// of its patterns; directories are then only created as needed.
+	// Exclude skips files and whole directories matching one of its
+	// patterns. Patterns are matched like those of AttrRule.
+	Include []string
+	Exclude []string
+	// Manifest is the host path of a JSON file listing the extracted
+	// entries that have FAT attributes a host file cannot carry or were
+	// renamed. Empty for no manifest.
+	Manifest string
+}
+
+// ManifestEntry describes an extracted file or directory in the manifest
+// written by ExtractImage.
+type ManifestEntry struct {
+	// Path is the path on the volume, relative to the root.
+	Path string `json:"path"`
+	// RawPath holds Path when it is not valid UTF-8 and so cannot be kept
+	// in JSON text.
+	RawPath []byte `json:"raw_path,omitempty"`
+	// HostPath is the path relative to the destination directory if the
+	// name had to be changed for the host.
+	HostPath string `json:"host_path,omitempty"`
+	// Attrs are the set attributes as letters, r, h, s and a for
+	// read-only, hidden, system and archive.
+	Attrs string `json:"attrs,omitempty"`
+}
+
+// ExtractImage copies every file of the mounted volume src below the host
+// directory dstDir, which is created if needed, keeping modification times.
+// Names that are not valid on the host are changed, the manifest maps them
+// back.
+func ExtractImage(src *FatFs, dstDir string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return err
+	}
+	x := &extractor{fs: src, opts: opts, root: dstDir}
+	if err := x.extractDir("/", "", ""); err != nil {
+		return err
+	}
+	// set directory times last, extracting their contents changes them
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := os.Chtimes(d.host, d.mtime, d.mtime); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if opts.Manifest == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(x.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(opts.Manifest, append(data, '\n'), 0o644)
+}
+
+type extractor struct {
+	fs       *FatFs
+	opts     *ExtractOptions
+	root     string
+	dirs     []extractedDir
+	manifest []ManifestEntry
+}
+
+type extractedDir struct {
+	host  string
+	mtime time.Time
+}
+
+func (x *extractor) match(patterns []string, rel string) (bool, error) {
+	for _, p := range patterns {
+		ok, err := matchGlob(p, rel)
+		if err != nil {
+			return false, fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extractDir extracts the volume directory name into the host directory
+// hostRel. rel and hostRel are relative to the root of the volume and the
+// destination, they differ when names were changed.
+func (x *extractor) extractDir(name, rel, hostRel string) error {
+	dir, err := x.fs.Open(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	used := make(map[string]bool)
+	for _, info := range infos {
+		entRel := path.Join(rel, info.Name())
+		if skip, err := x.match(x.opts.Exclude, entRel); err != nil {
+			return err
+		} else if skip {
+			continue
+		}
+		if !info.IsDir() && len(x.opts.Include) > 0 {
+			if ok, err := x.match(x.opts.Include, entRel); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		}
+
+		hname := uniqueName(hostName(info.Name()), used)
+		entHostRel := path.Join(hostRel, hname)
+		entHost := filepath.Join(x.root, filepath.FromSlash(entHostRel))
+		x.record(entRel, entHostRel, info)
+
+		if info.IsDir() {
+			if len(x.opts.Include) == 0 {
+				if err := os.Mkdir(entHost, 0o755); err != nil && !os.IsExist(err) {
+					return err
+				}
+			}
+			x.dirs = append(x.dirs, extractedDir{entHost, info.ModTime()})
+			if err := x.extractDir(path.Join(name, info.Name()), entRel, entHostRel); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := x.extractFile(path.Join(name, info.Name()), entHost, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record adds an entry to the manifest if it needs one.
+func (x *extractor) record(rel, hostRel string, info os.FileInfo) {
+	var attrs string
+	if fi, ok := info.(*FileInfo); ok {
+		for _, a := range []struct {
+			attr FileAttr
+			c    byte
+		}{{AttrReadOnly, 'r'}, {AttrHidden, 'h'}, {AttrSystem, 's'}} {
+			if fi.Attr()&a.attr != 0 {
+				attrs += string(a.c)
+			}
+		}
+		if attrs != "" && fi.Attr()&AttrArchive != 0 {
+			attrs += "a"
+		}
+	}
+	if attrs == "" && hostRel == rel {
+		return
+	}
+	ent := ManifestEntry{Path: rel, Attrs: attrs}
+	if hostRel != rel {
+		ent.HostPath = hostRel
+	}
+	if !utf8.ValidString(rel) {
+		ent.RawPath = []byte(rel)
+	}
+	x.manifest = append(x.manifest, ent)
+}
+
+func (x *extractor) extractFile(name, host string, info os.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(host), 0o755); err != nil {
+		return err
+	}
+	in, err := x.fs.Open(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer in.Close()
+	out, err := os.Create(host)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return os.Chtimes(host, info.ModTime(), info.ModTime())
+}
+
+// windowsReserved are the device names Windows does not allow as file
+// names, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// hostName returns name changed to be valid on the host: bytes that are not
+// UTF-8 and control characters are replaced by %XX escapes, and on Windows
+// also the characters and names it reserves.
+func hostName(name string) string {
+	windows := runtime.GOOS == "windows"
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		switch {
+		case r == utf8.RuneError && size == 1, r < 0x20, r == 0x7f, r == '/',
+			windows && strings.ContainsRune(`<>:"\|?*`, r):
+			for j := 0; j < size; j++ {
+				fmt.Fprintf(&b, "%%%02X", name[i+j])
+			}
+		default:
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	s := b.String()
+	if windows {
+		base, _, _ := strings.Cut(s, ".")
+		if windowsReserved[strings.ToUpper(base)] {
+			s = "_" + s
+		}
+		if n := len(s); n > 0 && (s[n-1] == '.' || s[n-1] == ' ') {
+			s = s[:n-1] + fmt.Sprintf("%%%02X", s[n-1])
+		}
+	}
+	if s == "." || s == ".." {
+		s = strings.ReplaceAll(s, ".", "%2E")
+	}
+	return s
+}
+
+// uniqueName returns name, or name with a ~N suffix before the extension if
+// it was used already, and marks the result used. Names compare
+// case-insensitively as on FAT and many hosts.
+func uniqueName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	cand := name
+	for n := 1; used[strings.ToLower(cand)]; n++ {
+		cand = fmt.Sprintf("%s~%d%s", base, n, ext)
+	}
+	used[strings.ToLower(cand)] = true
+	return cand
+}
@@ -0,0 +1,68 @@
+package fatfs
+
+/*
+#include <stdlib.h>
+#include "ff.h"
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// fastSeekMin is the size from which files opened through FatIO use fast
+// seek.
+const fastSeekMin = 1 << 20
+
+// EnableFastSeek switches the file to fast seek mode: the cluster runs of
+// the file are read once into a link map, after which Seek and ReadAt no
+// longer follow the FAT chain. This pays off for random access to large
+// files, e.g. serving range requests for disc images.
+//
+// The file cannot grow in fast seek mode, writes beyond its end come out
+// short. Truncate and Close end fast seek mode.
+func (f *FatFile) EnableFastSeek() error {
+	Logger.Println("CALL EnableFastSeek", f.info.name)
+	if f.info.IsDir() {
+		return FileResultInvalidObject
+	}
+	if f.clmt != nil {
+		return nil
+	}
+
+	// a map of n entries holds (n-1)/2 fragments, FatFs reports the size
+	// needed if it is too small
+	n := C.DWORD(64)
+	for {
+		clmt := (*C.DWORD)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.DWORD(0)))))
+		if clmt == nil {
+			return FileResultNotEnoughCore
+		}
+		*clmt = n
+		f.fil.cltbl = clmt
+		err := errval(C.f_lseek(f.fil, ^C.FSIZE_t(0))) // CREATE_LINKMAP
+		if err == nil {
+			f.clmt = clmt
+			return nil
+		}
+		f.fil.cltbl = nil
+		need := *clmt
+		C.free(unsafe.Pointer(clmt))
+		if !errors.Is(err, FileResultNotEnoughCore) || need <= n {
+			return err
+		}
+		n = need
+	}
+}
+
+// DisableFastSeek ends fast seek mode.
+func (f *FatFile) DisableFastSeek() {
+	if f.clmt == nil {
+		return
+	}
+	if f.fil != nil {
+		f.fil.cltbl = nil
+	}
+	C.free(unsafe.Pointer(f.clmt))
+	f.clmt = nil
+}
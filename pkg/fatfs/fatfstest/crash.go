@@ -0,0 +1,357 @@
+package fatfstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sync"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// RecordedWrite is a single WriteSectors call seen by a WriteRecorder.
+type RecordedWrite struct {
+	Sector uint64
+	Data   []byte
+	// Epoch counts the sync barriers issued before the write. Writes in the
+	// same epoch may reach the medium in any order, or not at all.
+	Epoch int
+}
+
+// assert that WriteRecorder implements the BlockDevice and Syncer interfaces
+var (
+	_ fatfs.BlockDevice = (*WriteRecorder)(nil)
+	_ fatfs.Syncer      = (*WriteRecorder)(nil)
+)
+
+// WriteRecorder passes every operation through to a MemDevice and records
+// each write and sync barrier, so the writes can be replayed later.
+type WriteRecorder struct {
+	dev     *fatfs.MemDevice
+	initial *fatfs.MemDevice
+
+	mu     sync.Mutex
+	writes []RecordedWrite
+	epoch  int
+}
+
+// NewWriteRecorder starts recording writes to dev. The current contents of
+// dev are kept as the starting point for replays.
+func NewWriteRecorder(dev *fatfs.MemDevice) *WriteRecorder {
+	return &WriteRecorder{dev: dev, initial: dev.Clone()}
+}
+
+// Writes returns the writes recorded so far.
+func (r *WriteRecorder) Writes() []RecordedWrite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedWrite(nil), r.writes...)
+}
+
+// Epochs returns the number of sync barriers seen so far plus one.
+func (r *WriteRecorder) Epochs() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.epoch + 1
+}
+
+// Initialize initializes the recorded device.
+func (r *WriteRecorder) Initialize() error { return r.dev.Initialize() }
+
+// Status reports the status of the recorded device.
+func (r *WriteRecorder) Status() error { return r.dev.Status() }
+
+// ReadSectors reads from the recorded device.
+func (r *WriteRecorder) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	return r.dev.ReadSectors(sector, count, buff)
+}
+
+// WriteSectors writes to the recorded device and logs the write.
+func (r *WriteRecorder) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	if err := r.dev.WriteSectors(sector, count, buff); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, RecordedWrite{
+		Sector: sector,
+		Data:   bytes.Clone(buff[:int(count)*int(r.dev.GetSectorSize())]),
+		Epoch:  r.epoch,
+	})
+	return nil
+}
+
+// Sync records a barrier: every earlier write is durable before any later
+// one reaches the medium.
+func (r *WriteRecorder) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.epoch++
+	return nil
+}
+
+// GetSectorSize returns the sector size of the recorded device.
+func (r *WriteRecorder) GetSectorSize() uint64 { return r.dev.GetSectorSize() }
+
+// GetSectorCount returns the sector count of the recorded device.
+func (r *WriteRecorder) GetSectorCount() uint64 { return r.dev.GetSectorCount() }
+
+// CrashOptions controls which crash states Replay and CrashTest build and
+// how each one is checked. The zero value is usable.
+type CrashOptions struct {
+	// Volume is the FatFs volume number used to mount the images. It must
+	// not be in use elsewhere while the test runs.
+	Volume int
+	// MaxExhaustive is the largest number of writes in one epoch for which
+	// every subset is tried. Larger epochs get every prefix plus Samples
+	// random subsets. Defaults to 8.
+	MaxExhaustive int
+	// Samples is the number of random subsets tried for large epochs.
+	// Defaults to 64.
+	Samples int
+	// Seed seeds the random subset selection.
+	Seed int64
+	// SplitSectors treats every sector of a multi-sector write as a write of
+	// its own, modelling devices that can tear a request apart.
+	SplitSectors bool
+	// Check is run on every crash state that mounts. It can verify
+	// application level invariants, e.g. that a file is either absent or
+	// complete.
+	Check func(fs *fatfs.FatFs, state CrashState) error
+}
+
+func (o *CrashOptions) withDefaults() CrashOptions {
+	var opts CrashOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.MaxExhaustive <= 0 {
+		opts.MaxExhaustive = 8
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = 64
+	}
+	return opts
+}
+
+// CrashState identifies one simulated power loss: every write of the
+// earlier epochs made it to the medium, plus the listed writes of Epoch.
+type CrashState struct {
+	Epoch int
+	// Applied are the indexes, into the writes of Epoch, that persisted.
+	Applied []int
+	// Pending is the number of writes in Epoch.
+	Pending int
+}
+
+func (s CrashState) String() string {
+	return fmt.Sprintf("epoch %d, writes %v of %d", s.Epoch, s.Applied, s.Pending)
+}
+
+// CrashFailure is a crash state that did not mount or failed a check.
+type CrashFailure struct {
+	State CrashState
+	Err   error
+}
+
+// CrashReport summarises a replay.
+type CrashReport struct {
+	Writes   int
+	Epochs   int
+	States   int
+	Failures []CrashFailure
+}
+
+// OK reports whether every crash state passed.
+func (r *CrashReport) OK() bool {
+	return len(r.Failures) == 0
+}
+
+// CrashTest runs workload against a FatFs mounted on dev, recording every
+// write, and then replays the recording: for every epoch between sync
+// barriers it builds the images a power loss could leave behind and checks
+// that each one mounts, that its whole tree can be read, and opts.Check.
+// dev must already hold a volume and is left with the workload applied.
+func CrashTest(dev *fatfs.MemDevice, workload func(fs *fatfs.FatFs) error, opts *CrashOptions) (*CrashReport, error) {
+	o := opts.withDefaults()
+	rec := NewWriteRecorder(dev)
+
+	fs, err := fatfs.NewFatFs(o.Volume)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Mount(rec); err != nil {
+		return nil, err
+	}
+	werr := workload(fs)
+	if err := fs.Unmount(); err != nil && werr == nil {
+		werr = err
+	}
+	if werr != nil {
+		return nil, fmt.Errorf("workload failed: %w", werr)
+	}
+
+	return rec.Replay(opts)
+}
+
+// Replay builds every crash state allowed by the recorded writes and
+// barriers and checks each of them, see CrashTest.
+func (r *WriteRecorder) Replay(opts *CrashOptions) (*CrashReport, error) {
+	o := opts.withDefaults()
+	rng := rand.New(rand.NewSource(o.Seed))
+	ssize := int(r.dev.GetSectorSize())
+
+	epochs := make([][]RecordedWrite, r.Epochs())
+	for _, w := range r.Writes() {
+		if !o.SplitSectors {
+			epochs[w.Epoch] = append(epochs[w.Epoch], w)
+			continue
+		}
+		for i := 0; i < len(w.Data); i += ssize {
+			epochs[w.Epoch] = append(epochs[w.Epoch], RecordedWrite{
+				Sector: w.Sector + uint64(i/ssize),
+				Data:   w.Data[i : i+ssize],
+				Epoch:  w.Epoch,
+			})
+		}
+	}
+
+	report := &CrashReport{Epochs: len(epochs)}
+	stable := r.initial.Clone()
+	for epoch, writes := range epochs {
+		report.Writes += len(writes)
+		for _, applied := range crashSubsets(len(writes), epoch > 0, o, rng) {
+			img := stable.Clone()
+			for _, i := range applied {
+				if err := applyWrite(img, writes[i], ssize); err != nil {
+					return nil, err
+				}
+			}
+
+			state := CrashState{Epoch: epoch, Applied: applied, Pending: len(writes)}
+			report.States++
+			if err := checkCrashState(img, state, o); err != nil {
+				report.Failures = append(report.Failures, CrashFailure{State: state, Err: err})
+			}
+		}
+
+		for _, w := range writes {
+			if err := applyWrite(stable, w, ssize); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// crashSubsets lists the sets of writes of an n write epoch to try, each in
+// write order. The empty set is the final state of the previous epoch, which
+// has been tried already unless this is the first epoch.
+func crashSubsets(n int, skipEmpty bool, o CrashOptions, rng *rand.Rand) [][]int {
+	var subsets [][]int
+	add := func(pick func(i int) bool) {
+		var applied []int
+		for i := 0; i < n; i++ {
+			if pick(i) {
+				applied = append(applied, i)
+			}
+		}
+		if len(applied) == 0 && skipEmpty {
+			return
+		}
+		subsets = append(subsets, applied)
+	}
+
+	if n <= o.MaxExhaustive {
+		for mask := 0; mask < 1<<n; mask++ {
+			add(func(i int) bool { return mask&(1<<i) != 0 })
+		}
+		return subsets
+	}
+
+	for prefix := 0; prefix <= n; prefix++ {
+		add(func(i int) bool { return i < prefix })
+	}
+	for s := 0; s < o.Samples; s++ {
+		add(func(int) bool { return rng.Intn(2) == 1 })
+	}
+	return subsets
+}
+
+func applyWrite(dev *fatfs.MemDevice, w RecordedWrite, ssize int) error {
+	return dev.WriteSectors(w.Sector, uint32(len(w.Data)/ssize), w.Data)
+}
+
+// checkCrashState mounts img, reads back the whole tree and runs the user
+// supplied check.
+func checkCrashState(img *fatfs.MemDevice, state CrashState, o CrashOptions) (err error) {
+	fs, err := fatfs.NewFatFs(o.Volume)
+	if err != nil {
+		return err
+	}
+	if err := fs.Mount(img); err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	defer func() {
+		if uerr := fs.Unmount(); uerr != nil && err == nil {
+			err = fmt.Errorf("unmount: %w", uerr)
+		}
+	}()
+
+	if err := readTree(fs, "/"); err != nil {
+		return err
+	}
+	if o.Check != nil {
+		return o.Check(fs, state)
+	}
+	return nil
+}
+
+// readTree lists every directory and reads every file below dir.
+func readTree(fs *fatfs.FatFs, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", dir, err)
+	}
+	infos, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return fmt.Errorf("readdir %s: %w", dir, err)
+	}
+
+	buf := make([]byte, 32*1024)
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := readTree(fs, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := fs.Open(name)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", name, err)
+		}
+		var size int64
+		for {
+			n, err := f.Read(buf)
+			size += int64(n)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("read %s: %w", name, err)
+			}
+		}
+		f.Close()
+		if size != info.Size() {
+			return fmt.Errorf("read %s: got %d bytes, directory entry says %d", name, size, info.Size())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package fatfstest_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs/fatfstest"
+)
+
+func formatted(t *testing.T) *fatfs.MemDevice {
+	t.Helper()
+	dev := fatfs.NewMemDevice(2 << 20)
+	if err := fatfs.Format(dev, &fatfs.FormatOptions{Type: fatfs.TypeFAT16, ClusterSize: 8192}); err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+func writeFile(fs *fatfs.FatFs, name string, data []byte, sync bool) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func readFile(fs *fatfs.FatFs, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestCrashTest(t *testing.T) {
+	dev := formatted(t)
+	a := bytes.Repeat([]byte("a"), 3000)
+	b := bytes.Repeat([]byte("b"), 700)
+	workload := func(fs *fatfs.FatFs) error {
+		if err := writeFile(fs, "a", a, true); err != nil {
+			return err
+		}
+		return writeFile(fs, "b", b, false)
+	}
+
+	var states []fatfstest.CrashState
+	opts := &fatfstest.CrashOptions{
+		MaxExhaustive: 3,
+		Samples:       4,
+		Check: func(fs *fatfs.FatFs, state fatfstest.CrashState) error {
+			states = append(states, state)
+			return nil
+		},
+	}
+	report, err := fatfstest.CrashTest(dev, workload, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes == 0 || report.Epochs < 2 {
+		t.Fatalf("%d writes in %d epochs", report.Writes, report.Epochs)
+	}
+	for _, f := range report.Failures {
+		states = append(states, f.State)
+	}
+	if len(states) != report.States {
+		t.Fatalf("%d states checked or failed, report says %d", len(states), report.States)
+	}
+
+	// every subset of small epochs, every prefix of large ones, each in
+	// write order
+	byEpoch := make(map[int][]fatfstest.CrashState)
+	for _, s := range states {
+		if !slices.IsSorted(s.Applied) || len(s.Applied) > 0 && s.Applied[len(s.Applied)-1] >= s.Pending {
+			t.Errorf("bad state %v", s)
+		}
+		byEpoch[s.Epoch] = append(byEpoch[s.Epoch], s)
+	}
+	seen := func(ss []fatfstest.CrashState, applied []int) bool {
+		return slices.ContainsFunc(ss, func(s fatfstest.CrashState) bool { return slices.Equal(s.Applied, applied) })
+	}
+	for epoch, ss := range byEpoch {
+		n := ss[0].Pending
+		if n <= opts.MaxExhaustive {
+			want := 1 << n
+			if epoch > 0 {
+				want-- // the empty set is the end of the previous epoch
+			}
+			if len(ss) != want {
+				t.Errorf("epoch %d: %d states of %d writes", epoch, len(ss), n)
+			}
+		}
+		for prefix := 0; prefix <= n; prefix++ {
+			applied := make([]int, 0, prefix)
+			for i := range prefix {
+				applied = append(applied, i)
+			}
+			if (prefix > 0 || epoch == 0) && !seen(ss, applied) {
+				t.Errorf("epoch %d: prefix of %d writes not tried", epoch, prefix)
+			}
+		}
+	}
+
+	// the device is left with the workload applied
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+	for name, want := range map[string][]byte{"a": a, "b": b} {
+		if got, err := readFile(fs, name); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// What f_sync made durable survives every later crash.
+func TestReplay(t *testing.T) {
+	dev := formatted(t)
+	rec := fatfstest.NewWriteRecorder(dev)
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(rec); err != nil {
+		t.Fatal(err)
+	}
+	// large enough for writes of whole clusters
+	a := bytes.Repeat([]byte("0123456789"), 3000)
+	if err := writeFile(fs, "a", a, true); err != nil {
+		t.Fatal(err)
+	}
+	synced := rec.Epochs() - 1
+	for i := range 3 {
+		if err := writeFile(fs, fmt.Sprintf("later%d", i), a[:100*(i+1)], i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(fs *fatfs.FatFs, state fatfstest.CrashState) error {
+		if state.Epoch < synced {
+			return nil
+		}
+		if got, err := readFile(fs, "a"); err != nil || !bytes.Equal(got, a) {
+			return fmt.Errorf("synced file lost: %d bytes, %v", len(got), err)
+		}
+		return nil
+	}
+	sectors := 0
+	for _, w := range rec.Writes() {
+		sectors += len(w.Data) / 512
+	}
+	if sectors == len(rec.Writes()) {
+		t.Fatal("no write of several sectors to split")
+	}
+	for _, split := range []bool{false, true} {
+		report, err := rec.Replay(&fatfstest.CrashOptions{MaxExhaustive: 4, Samples: 8, SplitSectors: split, Check: check})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if split && report.Writes != sectors || !split && report.Writes != len(rec.Writes()) {
+			t.Errorf("split %v: %d writes replayed, %d recorded in %d sectors", split, report.Writes, len(rec.Writes()), sectors)
+		}
+		for _, f := range report.Failures {
+			if f.State.Epoch >= synced {
+				t.Errorf("split %v: %v: %v", split, f.State, f.Err)
+			}
+		}
+	}
+}
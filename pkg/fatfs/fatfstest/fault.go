@@ -0,0 +1,321 @@
+// Package fatfstest provides BlockDevice implementations and helpers for
+// testing code built on the fatfs package.
+package fatfstest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// ErrInjected is returned by a FaultDevice for faults that do not specify
+// their own error. FatFs reports it as FileResultErr (FR_DISK_ERR).
+var ErrInjected = errors.New("fatfstest: injected fault")
+
+// Op selects which device operations a Fault applies to.
+type Op int
+
+const (
+	OpRead Op = 1 << iota
+	OpWrite
+	// OpSync is a Sync call (CTRL_SYNC). It touches no sectors, so only
+	// faults with a zero Count apply to it.
+	OpSync
+
+	// OpAny covers reads and writes, not syncs.
+	OpAny = OpRead | OpWrite
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpAny:
+		return "any"
+	default:
+		return "invalid/unknown"
+	}
+}
+
+// Fault describes an error a FaultDevice injects.
+type Fault struct {
+	// Op is the kind of operation that triggers the fault.
+	Op Op
+	// Sector and Count select the sectors the fault covers, an operation
+	// triggers it if it touches any of them. A zero Count covers the whole
+	// device.
+	Sector uint64
+	Count  uint64
+	// After lets that many matching operations through before the fault
+	// triggers.
+	After int
+	// Times limits how often the fault triggers, zero means every time.
+	Times int
+	// Err is returned by the failing operation, ErrInjected if nil. Use
+	// fatfs.FileResultNotReady or fatfs.FileResultWriteProtected to have
+	// FatFs see FR_NOT_READY or FR_WRITE_PROTECTED.
+	Err error
+	// Torn makes a failing write store its first Torn sectors before
+	// returning the error.
+	Torn uint32
+	// Silent makes a failing write or sync report success, simulating a
+	// device that drops (or, with Torn, truncates) writes without telling
+	// anyone.
+	Silent bool
+
+	seen, fired int
+}
+
+func (f *Fault) matches(op Op, sector uint64, count uint32) bool {
+	if f.Op&op == 0 {
+		return false
+	}
+	if f.Count != 0 && (sector+uint64(count) <= f.Sector || sector >= f.Sector+f.Count) {
+		return false
+	}
+	return true
+}
+
+// assert that FaultDevice implements the BlockDevice and Syncer interfaces
+var (
+	_ fatfs.BlockDevice = (*FaultDevice)(nil)
+	_ fatfs.Syncer      = (*FaultDevice)(nil)
+)
+
+// FaultDevice wraps a BlockDevice and injects media errors, torn writes,
+// status changes and latency into its operations. It is safe for concurrent
+// use, so faults can be added while a volume is mounted.
+type FaultDevice struct {
+	dev fatfs.BlockDevice
+
+	mu             sync.Mutex
+	faults         []*Fault
+	notReady       bool
+	writeProtected bool
+	readLatency    time.Duration
+	writeLatency   time.Duration
+	reads, writes  int
+}
+
+// NewFaultDevice wraps dev. Without any faults configured it behaves
+// exactly like dev.
+func NewFaultDevice(dev fatfs.BlockDevice) *FaultDevice {
+	return &FaultDevice{dev: dev}
+}
+
+// AddFault registers a fault. Faults are checked in the order they were
+// added and the first one that triggers wins.
+func (d *FaultDevice) AddFault(f Fault) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults = append(d.faults, &f)
+}
+
+// FailRead makes every read touching sector fail.
+func (d *FaultDevice) FailRead(sector uint64) {
+	d.AddFault(Fault{Op: OpRead, Sector: sector, Count: 1})
+}
+
+// FailWrite makes every write touching sector fail.
+func (d *FaultDevice) FailWrite(sector uint64) {
+	d.AddFault(Fault{Op: OpWrite, Sector: sector, Count: 1})
+}
+
+// FailAfter lets n operations of the given kind succeed and fails all the
+// following ones.
+func (d *FaultDevice) FailAfter(op Op, n int) {
+	d.AddFault(Fault{Op: op, After: n})
+}
+
+// TearWrite makes the next write touching sector store only its first
+// `written` sectors and then fail.
+func (d *FaultDevice) TearWrite(sector uint64, written uint32) {
+	d.AddFault(Fault{Op: OpWrite, Sector: sector, Count: 1, Times: 1, Torn: written})
+}
+
+// FailSync makes every sync fail.
+func (d *FaultDevice) FailSync() {
+	d.AddFault(Fault{Op: OpSync})
+}
+
+// SetNotReady makes Status and every operation report
+// fatfs.FileResultNotReady, like a removed card.
+func (d *FaultDevice) SetNotReady(notReady bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.notReady = notReady
+}
+
+// SetWriteProtected makes Status report fatfs.FileResultWriteProtected and
+// every write fail with it, like a card with its lock switch set.
+func (d *FaultDevice) SetWriteProtected(protected bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeProtected = protected
+}
+
+// SetLatency delays every read and write by the given durations.
+func (d *FaultDevice) SetLatency(read, write time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readLatency, d.writeLatency = read, write
+}
+
+// Reset removes all faults, status overrides and latency.
+func (d *FaultDevice) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults = nil
+	d.notReady, d.writeProtected = false, false
+	d.readLatency, d.writeLatency = 0, 0
+}
+
+// Counts returns how many reads and writes were attempted, including
+// failed ones.
+func (d *FaultDevice) Counts() (reads, writes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads, d.writes
+}
+
+// inject counts the operation and returns the fault to apply, if any.
+func (d *FaultDevice) inject(op Op, sector uint64, count uint32) (*Fault, time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var latency time.Duration
+	switch op {
+	case OpRead:
+		d.reads++
+		latency = d.readLatency
+	case OpWrite:
+		d.writes++
+		latency = d.writeLatency
+	}
+
+	if d.notReady {
+		return nil, latency, fatfs.FileResultNotReady
+	}
+	if op == OpWrite && d.writeProtected {
+		return nil, latency, fatfs.FileResultWriteProtected
+	}
+
+	for _, f := range d.faults {
+		if !f.matches(op, sector, count) {
+			continue
+		}
+		f.seen++
+		if f.seen <= f.After || (f.Times > 0 && f.fired >= f.Times) {
+			continue
+		}
+		f.fired++
+		return f, latency, nil
+	}
+	return nil, latency, nil
+}
+
+func (f *Fault) err(op Op, sector uint64) error {
+	err := f.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	return fmt.Errorf("%s at sector %d: %w", op, sector, err)
+}
+
+// Initialize initializes the wrapped device, unless it is marked not ready.
+func (d *FaultDevice) Initialize() error {
+	if err := d.Status(); errors.Is(err, fatfs.FileResultNotReady) {
+		return err
+	}
+	if err := d.dev.Initialize(); err != nil {
+		return err
+	}
+	return d.Status()
+}
+
+// Status reports the injected status, or that of the wrapped device.
+func (d *FaultDevice) Status() error {
+	d.mu.Lock()
+	notReady, protected := d.notReady, d.writeProtected
+	d.mu.Unlock()
+
+	switch {
+	case notReady:
+		return fatfs.FileResultNotReady
+	case protected:
+		return fatfs.FileResultWriteProtected
+	}
+	return d.dev.Status()
+}
+
+// ReadSectors reads from the wrapped device unless a fault triggers.
+func (d *FaultDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	f, latency, err := d.inject(OpRead, sector, count)
+	time.Sleep(latency)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		return f.err(OpRead, sector)
+	}
+	return d.dev.ReadSectors(sector, count, buff)
+}
+
+// WriteSectors writes to the wrapped device unless a fault triggers, in
+// which case part of the data may still be written.
+func (d *FaultDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	f, latency, err := d.inject(OpWrite, sector, count)
+	time.Sleep(latency)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return d.dev.WriteSectors(sector, count, buff)
+	}
+
+	if torn := min(f.Torn, count); torn > 0 {
+		if err := d.dev.WriteSectors(sector, torn, buff); err != nil {
+			return err
+		}
+	}
+	if f.Silent {
+		return nil
+	}
+	return f.err(OpWrite, sector)
+}
+
+// Sync syncs the wrapped device, if it supports it, unless a fault
+// triggers.
+func (d *FaultDevice) Sync() error {
+	f, _, err := d.inject(OpSync, 0, 0)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if f.Silent {
+			return nil
+		}
+		return f.err(OpSync, 0)
+	}
+	if syncer, ok := d.dev.(fatfs.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// GetSectorSize returns the sector size of the wrapped device.
+func (d *FaultDevice) GetSectorSize() uint64 {
+	return d.dev.GetSectorSize()
+}
+
+// GetSectorCount returns the sector count of the wrapped device.
+func (d *FaultDevice) GetSectorCount() uint64 {
+	return d.dev.GetSectorCount()
+}
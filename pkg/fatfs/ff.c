@@ -272,9 +272,9 @@
 #if FF_NORTC_YEAR < 1980 || FF_NORTC_YEAR > 2107 || FF_NORTC_MON < 1 || FF_NORTC_MON > 12 || FF_NORTC_MDAY < 1 || FF_NORTC_MDAY > 31
 #error Invalid FF_FS_NORTC settings
 #endif
-#define GET_FATTIME()	((DWORD)(FF_NORTC_YEAR - 1980) << 25 | (DWORD)FF_NORTC_MON << 21 | (DWORD)FF_NORTC_MDAY << 16)
+#define GET_FATTIME(drv)	((DWORD)(FF_NORTC_YEAR - 1980) << 25 | (DWORD)FF_NORTC_MON << 21 | (DWORD)FF_NORTC_MDAY << 16)
 #else
-#define GET_FATTIME()	get_fattime()
+#define GET_FATTIME(drv)	get_fattime_drv(drv)	/* go-fatfs: clocks are per drive */
 #endif
 
 
@@ -466,7 +466,7 @@ static FATFS *FatFs[FF_VOLUMES];	/* Pointer to the filesystem objects (logical d
 static WORD Fsid;					/* Filesystem mount ID */
 
 #if FF_FS_RPATH != 0
-static BYTE CurrVol;				/* Current drive number set by f_chdrive() */
+static __thread BYTE CurrVol;		/* Current drive number set by f_chdrive(), per thread (go-fatfs) */
 #endif
 
 #if FF_FS_LOCK
@@ -567,9 +567,10 @@ static WCHAR LfnBuf[FF_MAX_LFN + 1];		/* LFN working buffer */
 
 #if FF_CODE_PAGE == 0	/* Run-time code page configuration */
 #define CODEPAGE CodePage
-static WORD CodePage;	/* Current code page */
-static const BYTE* ExCvt;	/* Pointer to SBCS up-case table Ct???[] (null:disabled) */
-static const BYTE* DbcTbl;	/* Pointer to DBCS code range table Dc???[] (null:disabled) */
+/* (go-fatfs) The code page is per volume: lock_volume() sets it on the calling thread */
+static __thread WORD CodePage;	/* Current code page */
+static __thread const BYTE* ExCvt;	/* Pointer to SBCS up-case table Ct???[] (null:disabled) */
+static __thread const BYTE* DbcTbl;	/* Pointer to DBCS code range table Dc???[] (null:disabled) */
 
 static const BYTE Ct437[] = TBL_CT437;
 static const BYTE Ct720[] = TBL_CT720;
@@ -915,6 +916,9 @@ static int lock_volume (	/* 1:Ok, 0:timeout */
 	}
 #else
 	rv = syslock ? ff_mutex_take(fs->ldrv) : ff_mutex_take(fs->ldrv);	/* Lock the volume (this is to prevent compiler warning) */
+#endif
+#if FF_CODE_PAGE == 0
+	if (rv) f_setcp(fs->codepage ? fs->codepage : 437);	/* Use the code page of the volume (go-fatfs) */
 #endif
 	return rv;
 }
@@ -2480,6 +2484,52 @@ static FRESULT dir_find (	/* FR_OK(0):succeeded, !=0:error */
 
 
 #if !FF_FS_READONLY
+#if FF_USE_LFN
+/*-----------------------------------------------------------------------*/
+/* Generate the SFN of a new object (go-fatfs)                           */
+/*-----------------------------------------------------------------------*/
+
+static FRESULT make_sfn (	/* FR_OK:succeeded, FR_INVALID_NAME:needs an LFN in SFN-only mode, FR_DENIED:too many SFN collision, FR_DISK_ERR:disk error */
+	DIR* dp,					/* Target directory with object name in dp->fn, the SFN to use is returned in it */
+	BYTE* sn					/* The name as created by create_name is returned in it */
+)
+{
+	FRESULT res;
+	FATFS *fs = dp->obj.fs;
+	BYTE mode = get_sfn_mode(fs->pdrv);
+	UINT n;
+
+
+	memcpy(sn, dp->fn, 12);
+	if (mode == SFN_ONLY) {				/* Create no LFN */
+		if (sn[NSFLAG] & NS_LOSS) return FR_INVALID_NAME;	/* The name does not fit 8.3 */
+		sn[NSFLAG] &= ~NS_LFN;			/* Drop mixed case, the SFN is upper case */
+		dp->fn[NSFLAG] = sn[NSFLAG];
+	}
+	if (sn[NSFLAG] & NS_LOSS) {			/* When LFN is out of 8.3 format, generate a numbered name */
+		dp->fn[NSFLAG] = NS_NOLFN;		/* Find only SFN */
+		res = FR_OK;
+		if (mode == SFN_NOTAIL) {		/* Try the basis name without a tail first */
+			res = dir_find(dp);
+			if (res != FR_OK && res != FR_NO_FILE) return res;
+		}
+		if (res == FR_OK) {
+			for (n = 1; n < 100; n++) {
+				gen_numname(dp->fn, sn, fs->lfnbuf, n);	/* Generate a numbered name */
+				res = dir_find(dp);				/* Check if the name collides with existing SFN */
+				if (res != FR_OK) break;
+			}
+			if (n == 100) return FR_DENIED;		/* Abort if too many collisions */
+			if (res != FR_NO_FILE) return res;	/* Abort if the result is other than 'not collided' */
+		}
+		dp->fn[NSFLAG] = sn[NSFLAG];
+	}
+	return FR_OK;
+}
+#endif
+
+
+
 /*-----------------------------------------------------------------------*/
 /* Register an object to the directory                                   */
 /*-----------------------------------------------------------------------*/
@@ -2530,18 +2580,8 @@ static FRESULT dir_register (	/* FR_OK:succeeded, FR_DENIED:no free entry or too
 	}
 #endif
 	/* On the FAT/FAT32 volume */
-	memcpy(sn, dp->fn, 12);
-	if (sn[NSFLAG] & NS_LOSS) {			/* When LFN is out of 8.3 format, generate a numbered name */
-		dp->fn[NSFLAG] = NS_NOLFN;		/* Find only SFN */
-		for (n = 1; n < 100; n++) {
-			gen_numname(dp->fn, sn, fs->lfnbuf, n);	/* Generate a numbered name */
-			res = dir_find(dp);				/* Check if the name collides with existing SFN */
-			if (res != FR_OK) break;
-		}
-		if (n == 100) return FR_DENIED;		/* Abort if too many collisions */
-		if (res != FR_NO_FILE) return res;	/* Abort if the result is other than 'not collided' */
-		dp->fn[NSFLAG] = sn[NSFLAG];
-	}
+	res = make_sfn(dp, sn);				/* Generate the SFN (go-fatfs) */
+	if (res != FR_OK) return res;
 
 	/* Create an SFN with/without LFNs. */
 	n_ent = (sn[NSFLAG] & NS_LFN) ? (len + 12) / 13 + 1 : 1;	/* Number of entries to allocate */
@@ -2687,6 +2727,9 @@ static void get_fileinfo (
 		fno->fsize = (fno->fattrib & AM_DIR) ? 0 : ld_qword(fs->dirbuf + XDIR_FileSize);	/* Size */
 		fno->ftime = ld_word(fs->dirbuf + XDIR_ModTime + 0);	/* Time */
 		fno->fdate = ld_word(fs->dirbuf + XDIR_ModTime + 2);	/* Date */
+		fno->crtime = ld_word(fs->dirbuf + XDIR_CrtTime + 0);	/* Created time (go-fatfs) */
+		fno->crdate = ld_word(fs->dirbuf + XDIR_CrtTime + 2);	/* Created date (go-fatfs) */
+		fno->fclust = ld_dword(fs->dirbuf + XDIR_FstClus);		/* First cluster (go-fatfs) */
 		return;
 	} else
 #endif
@@ -2748,7 +2791,7 @@ static void get_fileinfo (
 			}
 		}
 		fno->fname[di] = 0;	/* Terminate the LFN */
-		if (!dp->dir[DIR_NTres]) fno->altname[0] = 0;	/* Altname is not needed if neither LFN nor case info is exist. */
+		/* (go-fatfs) altname[] is kept so the short name is always available */
 	}
 
 #else	/* Non-LFN configuration */
@@ -2767,6 +2810,9 @@ static void get_fileinfo (
 	fno->fsize = ld_dword(dp->dir + DIR_FileSize);		/* Size */
 	fno->ftime = ld_word(dp->dir + DIR_ModTime + 0);	/* Time */
 	fno->fdate = ld_word(dp->dir + DIR_ModTime + 2);	/* Date */
+	fno->crtime = ld_word(dp->dir + DIR_CrtTime + 0);	/* Created time (go-fatfs) */
+	fno->crdate = ld_word(dp->dir + DIR_CrtTime + 2);	/* Created date (go-fatfs) */
+	fno->fclust = ld_clust(dp->obj.fs, dp->dir);		/* First cluster (go-fatfs) */
 }
 
 #endif /* FF_FS_MINIMIZE <= 1 || FF_FS_RPATH >= 2 */
@@ -3795,7 +3841,7 @@ FRESULT f_open (
 					memset(fs->dirbuf + 2, 0, 30);	/* Clear 85 entry except for NumSec */
 					memset(fs->dirbuf + 38, 0, 26);	/* Clear C0 entry except for NumName and NameHash */
 					fs->dirbuf[XDIR_Attr] = AM_ARC;
-					st_dword(fs->dirbuf + XDIR_CrtTime, GET_FATTIME());
+					st_dword(fs->dirbuf + XDIR_CrtTime, GET_FATTIME(fs->pdrv));
 					fs->dirbuf[XDIR_GenFlags] = 1;
 					res = store_xdir(&dj);
 					if (res == FR_OK && fp->obj.sclust != 0) {	/* Remove the cluster chain if exist */
@@ -3806,7 +3852,7 @@ FRESULT f_open (
 #endif
 				{
 					/* Set directory entry initial state */
-					tm = GET_FATTIME();					/* Set created time */
+					tm = GET_FATTIME(fs->pdrv);			/* Set created time */
 					st_dword(dj.dir + DIR_CrtTime, tm);
 					st_dword(dj.dir + DIR_ModTime, tm);
 					cl = ld_clust(fs, dj.dir);			/* Get current cluster chain */
@@ -4167,7 +4213,7 @@ FRESULT f_sync (
 			}
 #endif
 			/* Update the directory entry */
-			tm = GET_FATTIME();				/* Modified time */
+			tm = GET_FATTIME(fs->pdrv);		/* Modified time */
 #if FF_FS_EXFAT
 			if (fs->fs_type == FS_EXFAT) {
 				res = fill_first_frag(&fp->obj);	/* Fill first fragment on the FAT if needed */
@@ -4823,6 +4869,78 @@ FRESULT f_stat (
 
 
 
+#if !FF_FS_READONLY && FF_USE_LFN
+/*-----------------------------------------------------------------------*/
+/* Get the SFN a New Object Would Be Given (go-fatfs)                    */
+/*-----------------------------------------------------------------------*/
+
+FRESULT f_shortname (
+	const TCHAR* path,	/* Pointer to the path of the object to be created */
+	TCHAR* sfn			/* Buffer of FF_SFN_BUF + 1 to return the SFN, empty on exFAT */
+)
+{
+	FRESULT res;
+	DIR dj;
+	BYTE sn[12];
+	UINT si, di;
+#if FF_LFN_UNICODE >= 1
+	WCHAR wc;
+	UINT nw;
+#endif
+	DEF_NAMBUF
+
+
+	sfn[0] = 0;
+	res = mount_volume(&path, &dj.obj.fs, 0);
+	if (res == FR_OK) {
+		INIT_NAMBUF(dj.obj.fs);
+		res = follow_path(&dj, path);	/* Follow the file path */
+		if (res == FR_OK) res = FR_EXIST;	/* Name collision? */
+		if (res == FR_NO_FILE && (dj.fn[NSFLAG] & (NS_DOT | NS_NONAME))) res = FR_INVALID_NAME;
+		if (res == FR_NO_FILE && dj.obj.fs->fs_type != FS_EXFAT) {
+			res = make_sfn(&dj, sn);
+			if (res == FR_OK) {
+				si = di = 0;
+				while (si < 11) {		/* Same as get_fileinfo() */
+#if FF_LFN_UNICODE >= 1
+					wc = dj.fn[si++];
+					if (wc == ' ') continue;	/* Skip padding spaces */
+					if (wc == RDDEM) wc = DDEM;	/* Restore replaced DDEM character */
+					if (si == 9 && di < FF_SFN_BUF) sfn[di++] = '.';	/* Insert a . if extension is exist */
+					if (dbc_1st((BYTE)wc) && si != 8 && si != 11 && dbc_2nd(dj.fn[si])) {	/* Make a DBC if needed */
+						wc = wc << 8 | dj.fn[si++];
+					}
+					wc = ff_oem2uni(wc, CODEPAGE);	/* ANSI/OEM -> Unicode */
+					if (wc == 0) {			/* Wrong char in the current code page? */
+						di = 0; break;
+					}
+					nw = put_utf(wc, &sfn[di], FF_SFN_BUF - di);	/* Store it in API encoding */
+					if (nw == 0) {			/* Buffer overflow? */
+						di = 0; break;
+					}
+					di += nw;
+#else
+					TCHAR c = (TCHAR)dj.fn[si++];
+					if (c == ' ') continue;		/* Skip padding spaces */
+					if (c == RDDEM) c = DDEM;	/* Restore replaced DDEM character */
+					if (si == 9) sfn[di++] = '.';	/* Insert a . if extension is exist */
+					sfn[di++] = c;
+#endif
+				}
+				sfn[di] = 0;
+			}
+		} else if (res == FR_NO_FILE) {
+			res = FR_OK;
+		}
+		FREE_NAMBUF();
+	}
+
+	LEAVE_FF(dj.obj.fs, res);
+}
+#endif
+
+
+
 #if !FF_FS_READONLY
 /*-----------------------------------------------------------------------*/
 /* Get Number of Free Clusters                                           */
@@ -5096,7 +5214,7 @@ FRESULT f_mkdir (
 			if (dcl == 0) res = FR_DENIED;		/* No space to allocate a new cluster? */
 			if (dcl == 1) res = FR_INT_ERR;		/* Any insanity? */
 			if (dcl == 0xFFFFFFFF) res = FR_DISK_ERR;	/* Disk error? */
-			tm = GET_FATTIME();
+			tm = GET_FATTIME(fs->pdrv);
 			if (res == FR_OK) {
 				res = dir_clear(fs, dcl);		/* Clean up the new table */
 				if (res == FR_OK) {
@@ -5784,7 +5902,7 @@ static FRESULT create_partition (
 #else
 		ss = FF_MAX_SS;
 #endif
-		rnd = (DWORD)sz_drv + GET_FATTIME();	/* Random seed */
+		rnd = (DWORD)sz_drv + GET_FATTIME(drv);	/* Random seed */
 		align = GPT_ALIGN / ss;				/* Partition alignment for GPT [sector] */
 		sz_ptbl = GPT_ITEMS * SZ_GPTE / ss;	/* Size of partition table [sector] */
 		top_bpt = sz_drv - sz_ptbl - 1;		/* Backup partition table start LBA */
@@ -6037,7 +6155,7 @@ FRESULT f_mkfs (
 		fsty = FS_FAT16;
 	} while (0);
 
-	vsn = (DWORD)sz_vol + GET_FATTIME();	/* VSN generated from current time and partition size */
+	vsn = (DWORD)sz_vol + GET_FATTIME(pdrv);	/* VSN generated from current time and partition size */
 
 #if FF_FS_EXFAT
 	if (fsty == FS_EXFAT) {	/* Create an exFAT volume */
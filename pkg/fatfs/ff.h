@@ -143,6 +143,9 @@ typedef struct {
 #if FF_MAX_SS != FF_MIN_SS
 	WORD	ssize;			/* Sector size (512, 1024, 2048 or 4096) */
 #endif
+#if FF_CODE_PAGE == 0
+	WORD	codepage;		/* Code page of the volume, 0:437 (go-fatfs) */
+#endif
 #if FF_USE_LFN
 	WCHAR*	lfnbuf;			/* LFN working buffer */
 #endif
@@ -248,6 +251,9 @@ typedef struct {
 	FSIZE_t	fsize;			/* File size */
 	WORD	fdate;			/* Modified date */
 	WORD	ftime;			/* Modified time */
+	WORD	crdate;			/* Created date (go-fatfs) */
+	WORD	crtime;			/* Created time (go-fatfs) */
+	DWORD	fclust;			/* First cluster, 0 if none (go-fatfs) */
 	BYTE	fattrib;		/* File attribute */
 #if FF_USE_LFN
 	TCHAR	altname[FF_SFN_BUF + 1];/* Alternative file name */
@@ -319,6 +325,7 @@ FRESULT f_mkdir (const TCHAR* path);								/* Create a sub directory */
 FRESULT f_unlink (const TCHAR* path);								/* Delete an existing file or directory */
 FRESULT f_rename (const TCHAR* path_old, const TCHAR* path_new);	/* Rename/Move a file or directory */
 FRESULT f_stat (const TCHAR* path, FILINFO* fno);					/* Get file status */
+FRESULT f_shortname (const TCHAR* path, TCHAR* sfn);				/* Get the SFN of a new object (go-fatfs) */
 FRESULT f_chmod (const TCHAR* path, BYTE attr, BYTE mask);			/* Change attribute of a file/dir */
 FRESULT f_utime (const TCHAR* path, const FILINFO* fno);			/* Change timestamp of a file/dir */
 FRESULT f_chdir (const TCHAR* path);								/* Change current directory */
@@ -359,8 +366,15 @@ TCHAR* f_gets (TCHAR* buff, int len, FIL* fp);						/* Get a string from the fil
 /* RTC function (provided by user) */
 #if !FF_FS_READONLY && !FF_FS_NORTC
 DWORD get_fattime (void);	/* Get current time */
+DWORD get_fattime_drv (BYTE pdrv);	/* Get current time for a drive (go-fatfs) */
 #endif
 
+/* SFN generation (provided by user, go-fatfs) */
+#define SFN_TAIL	0	/* Numeric tail on every name out of 8.3 format */
+#define SFN_NOTAIL	1	/* Numeric tail only on collision */
+#define SFN_ONLY	2	/* No LFN, names must fit 8.3 */
+BYTE get_sfn_mode (BYTE pdrv);
+
 
 /* LFN support functions (defined in ffunicode.c) */
 
@@ -0,0 +1,162 @@
+package fatfs
+
+/*
+#include <stdlib.h>
+#include "ff.h"
+
+FF_DIR* allocate_dir(void);
+*/
+import "C"
+import (
+	"iter"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// findRecurs is FIND_RECURS in ff.c, the most wildcard terms a FatFs
+// pattern may have.
+const findRecurs = 4
+
+// Find returns an iterator over the entries of dir whose long or short name
+// matches pattern. Patterns are those of FatFs: '*' matches any run of
+// characters and '?' any single one, case-insensitively, with at most four
+// wildcard terms. Entries are filtered in C as the directory is read, so
+// only matches reach Go. Iteration stops after the first error.
+func (f *FatFs) Find(dir, pattern string) iter.Seq2[*FileInfo, error] {
+	return func(yield func(*FileInfo, error) bool) {
+		Logger.Println("CALL Find", dir, pattern)
+		cdir := C.CString(f.fatPath(dir))
+		defer C.free(unsafe.Pointer(cdir))
+		// f_findnext keeps a pointer to the pattern until the directory is
+		// closed
+		cpattern := C.CString(pattern)
+		defer C.free(unsafe.Pointer(cpattern))
+
+		dp := C.allocate_dir()
+		if dp == nil {
+			yield(nil, FileResultNotEnoughCore)
+			return
+		}
+		defer C.free(unsafe.Pointer(dp))
+
+		info := C.FILINFO{}
+		if err := errval(C.f_findfirst(dp, &info, cdir, cpattern)); err != nil {
+			yield(nil, err)
+			return
+		}
+		defer C.f_closedir(dp)
+
+		loc := f.Location()
+		for info.fname[0] != 0 {
+			if !yield(newFileInfo(&info, loc), nil) {
+				return
+			}
+			if err := errval(C.f_findnext(dp, &info)); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+	}
+}
+
+// isFindPattern reports whether pattern can be matched by FatFs, that is
+// it has no character classes or escapes and few enough wildcard terms.
+func isFindPattern(pattern string) bool {
+	if strings.ContainsAny(pattern, `[\`) {
+		return false
+	}
+	terms := 0
+	for i := 0; i < len(pattern); i++ {
+		if c := pattern[i]; (c == '*' || c == '?') && (i == 0 || (pattern[i-1] != '*' && pattern[i-1] != '?')) {
+			terms++
+		}
+	}
+	return terms <= findRecurs
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// Glob returns the names of all files matching pattern, or nil if there
+// are none. The syntax is that of path.Match, but like FAT names matching
+// is case-insensitive; the only error is path.ErrBadPattern. Each
+// directory is searched with Find where the pattern allows it, but only
+// long names are matched.
+func (f *FatFs) Glob(pattern string) ([]string, error) {
+	Logger.Println("CALL Glob", pattern)
+	if _, err := pathpkg.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return f.glob(pattern, 0)
+}
+
+func (f *FatFs) glob(pattern string, depth int) ([]string, error) {
+	if !hasMeta(pattern) {
+		if _, err := f.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := pathpkg.Split(pattern)
+	switch {
+	case dir == "":
+		dir = "."
+	case dir != "/":
+		dir = dir[:len(dir)-1]
+	}
+	if !hasMeta(dir) {
+		return f.globDir(dir, file, nil)
+	}
+	// prevent infinite recursion, see golang.org/issue/15879
+	if dir == pattern || depth > 10000 {
+		return nil, pathpkg.ErrBadPattern
+	}
+
+	dirs, err := f.glob(dir, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		if matches, err = f.globDir(d, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// globDir appends the names in dir matching pattern to matches. Errors
+// reading dir are ignored as in path/filepath.Glob.
+func (f *FatFs) globDir(dir, pattern string, matches []string) ([]string, error) {
+	if info, err := f.Stat(dir); err != nil || !info.IsDir() {
+		return matches, nil
+	}
+
+	findPattern := pattern
+	if !isFindPattern(pattern) {
+		findPattern = "*"
+	}
+	upper := strings.ToUpper(pattern)
+	var names []string
+	for info, err := range f.Find(dir, findPattern) {
+		if err != nil {
+			return matches, nil
+		}
+		// Find matches short names too, which Glob must not
+		if ok, err := pathpkg.Match(upper, strings.ToUpper(info.Name())); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matches = append(matches, pathpkg.Join(dir, name))
+	}
+	return matches, nil
+}
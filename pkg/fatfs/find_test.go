@@ -0,0 +1,61 @@
+package fatfs_test
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// Find also matches short names, GAME~1.DOL for game.dolphin, but Glob
+// follows path.Match on the long names whatever way it searches.
+func TestGlobLongNames(t *testing.T) {
+	src := fstest.MapFS{
+		"game.dolphin":  {Data: []byte("a")},
+		"longname.isox": {Data: []byte("b")},
+		"disc.iso":      {Data: []byte("c")},
+	}
+	dev := fatfs.NewMemDevice(4 << 20)
+	if err := fatfs.BuildImage(dev, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"/*.dol", nil},
+		{"/*.iso", []string{"/disc.iso"}},
+		{"/*.is[o]", []string{"/disc.iso"}},
+		{"/*.DOLPHIN", []string{"/game.dolphin"}},
+	} {
+		got, err := fs.Glob(tc.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.pattern, err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.pattern, got, tc.want)
+		}
+	}
+
+	// Find keeps matching short names
+	var found []string
+	for info, err := range fs.Find("/", "*.dol") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, info.Name())
+	}
+	if !slices.Equal(found, []string{"game.dolphin"}) {
+		t.Errorf("Find *.dol: got %q", found)
+	}
+}
@@ -0,0 +1,118 @@
+package fatfs
+
+/*
+#include <stdlib.h>
+#include "ff.h"
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// mkfsWorkSize is the size of the f_mkfs work buffer, larger buffers mean
+// fewer and bigger writes.
+const mkfsWorkSize = 64 * 1024
+
+// FormatOptions controls the layout of a new volume. The zero value lets
+// FatFs pick everything based on the device size.
+type FormatOptions struct {
+	// Type is the filesystem to create. Zero picks one from the device size,
+	// TypeFAT12 and TypeFAT16 both allow either, depending on the number of
+	// clusters.
+	Type Type
+	// ClusterSize in bytes, zero for the default of the chosen type.
+	ClusterSize uint32
+	// NumFATs is 1 or 2, zero means 1. Ignored on exFAT.
+	NumFATs uint8
+	// RootEntries is the size of the FAT12/16 root directory, zero means 512.
+	RootEntries uint32
+	// Align is the data area alignment in sectors, zero asks the device.
+	Align uint32
+	// NoPartitionTable formats the whole device as a single volume (SFD,
+	// "superfloppy") instead of creating an MBR or GPT partition first.
+	NoPartitionTable bool
+	// Clock seeds the volume serial number and GPT GUIDs, nil means
+	// DefaultClock. A fixed clock gives the same volume every time.
+	Clock Clock
+	// Location is the time zone the clock is read in, nil for time.Local.
+	Location *time.Location
+	// Serial, if not zero, is the volume serial number instead of one
+	// derived from the clock.
+	Serial uint32
+}
+
+// Format creates a new FAT or exFAT volume on blk, destroying its contents.
+// blk must not be mounted.
+func Format(blk BlockDevice, opts *FormatOptions) error {
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+
+	var parm C.MKFS_PARM
+	switch opts.Type {
+	case 0:
+		parm.fmt = C.FM_ANY
+	case TypeFAT12, TypeFAT16:
+		parm.fmt = C.FM_FAT
+	case TypeFAT32:
+		parm.fmt = C.FM_FAT32
+	case TypeEXFAT:
+		parm.fmt = C.FM_EXFAT
+	default:
+		return fmt.Errorf("invalid filesystem type: %d", opts.Type)
+	}
+	if opts.NoPartitionTable {
+		parm.fmt |= C.FM_SFD
+	}
+	parm.n_fat = C.BYTE(opts.NumFATs)
+	parm.align = C.UINT(opts.Align)
+	parm.n_root = C.UINT(opts.RootEntries)
+	parm.au_size = C.DWORD(opts.ClusterSize)
+
+	// parm is unique to this call, so it tells our drive and clock from
+	// those a mount sets later
+	owner := &parm
+	pdrv, err := registerFreeBlockDevice(blk, owner)
+	if err != nil {
+		return err
+	}
+	defer releaseDrive(pdrv, owner)
+	setDriveTime(pdrv, func(t *driveTime) { *t = driveTime{opts.Clock, opts.Location, owner} })
+	defer setDriveTime(pdrv, func(t *driveTime) {
+		if t.owner == owner {
+			*t = driveTime{}
+		}
+	})
+
+	cpath := C.CString(fmt.Sprintf("%d:", pdrv))
+	defer C.free(unsafe.Pointer(cpath))
+	work := C.malloc(mkfsWorkSize)
+	defer C.free(work)
+
+	if err := errval(C.f_mkfs(cpath, &parm, work, mkfsWorkSize)); err != nil {
+		return fmt.Errorf("format failed: %w", err)
+	}
+	if opts.Serial != 0 {
+		return setSerial(blk, opts.Serial)
+	}
+	return nil
+}
+
+// setSerial changes the serial number of the first volume on blk.
+func setSerial(blk BlockDevice, serial uint32) error {
+	v, err := openVolume(blk, 0)
+	if err != nil {
+		return err
+	}
+	off := 39
+	switch v.typ {
+	case TypeFAT32:
+		off = 67
+	case TypeEXFAT:
+		off = 100
+	}
+	return v.updateBoot(func(boot []byte) { binary.LittleEndian.PutUint32(boot[off:], serial) })
+}
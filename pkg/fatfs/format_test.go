@@ -0,0 +1,41 @@
+package fatfs_test
+
+import (
+	"testing"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+func TestFormatSerial(t *testing.T) {
+	for _, typ := range []fatfs.Type{fatfs.TypeFAT16, fatfs.TypeFAT32, fatfs.TypeEXFAT} {
+		t.Run(typ.String(), func(t *testing.T) {
+			size := int64(8 << 20)
+			opts := &fatfs.FormatOptions{Type: typ, Serial: 0x12345678}
+			if typ == fatfs.TypeFAT32 {
+				size, opts.ClusterSize = 40<<20, 512
+			}
+			dev := fatfs.NewMemDevice(size)
+			if err := fatfs.Format(dev, opts); err != nil {
+				t.Fatal(err)
+			}
+			// the checksum of the exFAT boot region and the FAT32 backup
+			// boot sector must follow the change
+			report, err := fatfs.Check(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.OK() {
+				t.Fatalf("check: %v", report.Problems)
+			}
+			mounted(t, dev, func(fs *fatfs.FatFs) {
+				_, serial, err := fs.Label()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if serial != opts.Serial {
+					t.Errorf("serial %08x, want %08x", serial, opts.Serial)
+				}
+			})
+		})
+	}
+}
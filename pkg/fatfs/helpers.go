@@ -7,7 +7,17 @@ package fatfs
 #include "ff.h"
 */
 import "C"
-import "os"
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// Logger receives the package's debug output, which is discarded by
+// default. Point it somewhere else to see every FatFs call.
+var Logger = log.New(io.Discard, "fatfs: ", log.LstdFlags)
 
 const (
 	FileResultOK                          = C.FR_OK /* (0) Succeeded */
@@ -127,6 +137,20 @@ func (r FileResult) Error() string {
 	return "fatfs: " + msg
 }
 
+// Is lets errors.Is match FatFs results against the fs package errors,
+// e.g. FileResultNoFile is fs.ErrNotExist.
+func (r FileResult) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return r == FileResultNoFile || r == FileResultNoPath
+	case fs.ErrExist:
+		return r == FileResultExist
+	case fs.ErrPermission:
+		return r == FileResultDenied || r == FileResultWriteProtected
+	}
+	return false
+}
+
 func errval(errno C.FRESULT) error {
 	if errno > FileResultOK {
 		return FileResult(errno)
@@ -181,3 +205,28 @@ func isAppendMode(flags int) bool {
 	// If O_APPEND is set, it's opened for appending.
 	return flags&os.O_APPEND != 0
 }
+
+// fatTime decodes a FAT date and time, which FatFs stores in local time. A
+// zero date means no timestamp.
+func fatTime(date, tm uint16, loc *time.Location) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, loc)
+}
+
+// toFatTime encodes t as a FAT date and time, clamped to the years FAT can
+// represent (1980 to 2107).
+func toFatTime(t time.Time, loc *time.Location) (date, tm uint16) {
+	t = t.In(loc)
+	switch {
+	case t.Year() < 1980:
+		return 1<<5 | 1, 0
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
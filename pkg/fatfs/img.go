@@ -112,6 +112,14 @@ func (img *ImageFile) WriteSectors(sector uint64, count uint32, buff []byte) err
 	return nil
 }
 
+// Sync flushes the file to stable storage.
+func (img *ImageFile) Sync() error {
+	if img.file == nil {
+		return fmt.Errorf("file is not open")
+	}
+	return img.file.Sync()
+}
+
 // GetSectorSize returns the sector size of the file.
 func (img *ImageFile) GetSectorSize() uint64 {
 	return sectorSize
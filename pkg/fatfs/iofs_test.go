@@ -0,0 +1,34 @@
+package fatfs_test
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+func TestIOFS(t *testing.T) {
+	tree := testTree()
+	dev := fatfs.NewMemDevice(8 << 20)
+	if err := fatfs.BuildImage(dev, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+
+	var names []string
+	for name := range tree {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if err := fstest.TestFS(fatfs.AsIO(fs), names...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,88 @@
+package fatfs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// assert that MemDevice implements the BlockDevice interface
+var _ BlockDevice = (*MemDevice)(nil)
+
+// MemDevice is a BlockDevice held entirely in memory.
+type MemDevice struct {
+	data []byte
+}
+
+// NewMemDevice allocates a zeroed device of size bytes, rounded up to a
+// whole sector.
+func NewMemDevice(size int64) *MemDevice {
+	return &MemDevice{data: make([]byte, roundUpSector(size))}
+}
+
+// NewMemDeviceFromBytes wraps data without copying it. Trailing bytes that
+// do not fill a sector are ignored.
+func NewMemDeviceFromBytes(data []byte) *MemDevice {
+	return &MemDevice{data: data[:len(data)/sectorSize*sectorSize]}
+}
+
+// Bytes returns the contents of the device. The slice aliases the device
+// memory.
+func (m *MemDevice) Bytes() []byte {
+	return m.data
+}
+
+// Clone returns an independent copy of the device.
+func (m *MemDevice) Clone() *MemDevice {
+	return &MemDevice{data: bytes.Clone(m.data)}
+}
+
+// Initialize is a no-op.
+func (m *MemDevice) Initialize() error {
+	return nil
+}
+
+// Status is always ready.
+func (m *MemDevice) Status() error {
+	return nil
+}
+
+// ReadSectors copies `count` sectors at `sector` into `buff`.
+func (m *MemDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	off, length, err := m.span(sector, count, buff)
+	if err != nil {
+		return err
+	}
+	copy(buff[:length], m.data[off:])
+	return nil
+}
+
+// WriteSectors copies `count` sectors from `buff` to `sector`.
+func (m *MemDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	off, length, err := m.span(sector, count, buff)
+	if err != nil {
+		return err
+	}
+	copy(m.data[off:off+length], buff)
+	return nil
+}
+
+func (m *MemDevice) span(sector uint64, count uint32, buff []byte) (uint64, uint64, error) {
+	length := uint64(count) * sectorSize
+	if uint64(len(buff)) < length {
+		return 0, 0, fmt.Errorf("buffer too small: need %d bytes, got %d", length, len(buff))
+	}
+	if sector+uint64(count) > m.GetSectorCount() {
+		return 0, 0, fmt.Errorf("access beyond end of device: sector %d, count %d", sector, count)
+	}
+	return sector * sectorSize, length, nil
+}
+
+// GetSectorSize returns the sector size of the device.
+func (m *MemDevice) GetSectorSize() uint64 {
+	return sectorSize
+}
+
+// GetSectorCount returns the number of sectors in the device.
+func (m *MemDevice) GetSectorCount() uint64 {
+	return uint64(len(m.data) / sectorSize)
+}
@@ -0,0 +1,255 @@
+package fatfs
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+)
+
+// MinimalFormat returns the format and the device size in bytes of the
+// smallest image BuildImage can make of the tree src with opts. Unless
+// opts.Format fixes them, every filesystem type and cluster size is tried.
+// The result has one FAT unless opts.Format asks for two, no data area
+// alignment and, on FAT12/16, a root directory just large enough for the
+// root of src. The size is found by formatting scratch devices in memory
+// rather than from a model of the layout; only directories are sized
+// assuming every name needs a long name. Build the image with the returned
+// format on a device of exactly that size.
+func MinimalFormat(src fs.FS, opts *BuildOptions) (*FormatOptions, int64, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	tree, err := measureTree(src)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var types []Type
+	switch opts.Format.Type {
+	case 0:
+		types = []Type{TypeFAT16, TypeFAT32, TypeEXFAT}
+	case TypeFAT12, TypeFAT16:
+		types = []Type{TypeFAT16}
+	default:
+		types = []Type{opts.Format.Type}
+	}
+	var cands []*minCandidate
+	for _, typ := range types {
+		sizes := []uint64{uint64(opts.Format.ClusterSize)}
+		if sizes[0] == 0 {
+			sizes = sizes[:0]
+			// exFAT allows far larger clusters, but they only help trees
+			// of few huge files and cost a scratch format each
+			limit := uint64(64 << 10)
+			if typ == TypeEXFAT {
+				limit = 1 << 20
+			}
+			for csize := uint64(SectorSize); csize <= limit; csize *= 2 {
+				sizes = append(sizes, csize)
+			}
+		}
+		for _, csize := range sizes {
+			if c := newMinCandidate(tree, &opts.Format, typ, csize); c != nil {
+				cands = append(cands, c)
+			}
+		}
+	}
+	// try the most promising first, and stop when no other can beat the
+	// best found
+	slices.SortStableFunc(cands, func(a, b *minCandidate) int {
+		return cmp.Compare(a.lower, b.lower)
+	})
+	var best *minCandidate
+	for _, c := range cands {
+		if best != nil && c.lower >= best.sectors {
+			break
+		}
+		if err := c.fit(); err != nil {
+			return nil, 0, err
+		}
+		if c.sectors != 0 && (best == nil || c.sectors < best.sectors) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, 0, errors.New("no filesystem type and cluster size can hold the tree")
+	}
+	return best.format, int64(best.sectors * SectorSize), nil
+}
+
+// minCandidate is a filesystem type and cluster size MinimalFormat tries.
+type minCandidate struct {
+	format *FormatOptions
+	// need is the number of clusters the tree takes on top of those a
+	// freshly formatted volume uses.
+	need uint64
+	// lower is a lower bound of the device size in sectors, sectors the
+	// smallest size found to hold the tree or 0.
+	lower, sectors uint64
+}
+
+// newMinCandidate returns the candidate for the tree formatted with typ
+// and csize, nil if it cannot hold the tree.
+func newMinCandidate(tree *treeSize, base *FormatOptions, typ Type, csize uint64) *minCandidate {
+	if csize < SectorSize || csize&(csize-1) != 0 || typ != TypeEXFAT && csize > 64<<10 {
+		return nil
+	}
+	csect := csize / SectorSize
+	f := *base
+	f.Type, f.ClusterSize, f.Align = typ, uint32(csize), 1
+	f.NumFATs = max(f.NumFATs, 1)
+	nfats := uint64(f.NumFATs)
+	if typ == TypeEXFAT {
+		nfats = 1
+	}
+
+	// the root directory holds the label and, on exFAT, the bitmap and
+	// up-case table entries too
+	slots := tree.fatSlots
+	rootSlots := uint64(slots[0]) + 1
+	if typ == TypeEXFAT {
+		slots = tree.exfatSlots
+		rootSlots = uint64(slots[0]) + 3
+	}
+	rootClusters := max(1, (rootSlots*dirEntrySize+csize-1)/csize)
+	need := tree.clusters(typ, csize) - max(1, (uint64(slots[0])*dirEntrySize+csize-1)/csize)
+	if typ == TypeFAT16 {
+		f.RootEntries = uint32((rootSlots + 15) / 16 * 16)
+		if f.RootEntries > 32768 {
+			return nil
+		}
+	} else {
+		// the volume is formatted with the first root cluster
+		need += rootClusters - 1
+	}
+	if typ != TypeEXFAT && slices.ContainsFunc(tree.files, func(size int64) bool { return size > 0xFFFFFFFF }) {
+		return nil
+	}
+
+	var lower uint64
+	switch typ {
+	case TypeEXFAT:
+		n := need + 1
+		if n > maxEXFAT {
+			return nil
+		}
+		lower = max(32+((n+2)*4+SectorSize-1)/SectorSize+n*csect, 0x1000)
+	case TypeFAT32:
+		n := max(need+1, maxFAT16+1)
+		if n > maxFAT32 {
+			return nil
+		}
+		lower = 32 + nfats*((n+2)*4+SectorSize-1)/SectorSize + n*csect
+	default:
+		if need > maxFAT16 {
+			return nil
+		}
+		lower = max(1+nfats*((need+2)*3/2+SectorSize-1)/SectorSize+uint64(f.RootEntries)/16+need*csect, 128)
+	}
+	if !f.NoPartitionTable {
+		// f_mkfs starts the partition at the second track
+		lower += 63
+	}
+	return &minCandidate{format: &f, need: need, lower: lower}
+}
+
+// fit finds the smallest device that holds the candidate's clusters:
+// growing the device from the lower bound by what a scratch format of it
+// lacks, then narrowing down between the last size too small and the first
+// large enough.
+func (c *minCandidate) fit() error {
+	csect := uint64(c.format.ClusterSize) / SectorSize
+	bad, sectors := c.lower-1, c.lower
+	// near the cluster count limits of a type f_mkfs may refuse a few
+	// sizes, but not many in a row
+	for failed := 0; ; {
+		short, err := c.try(sectors)
+		if err != nil {
+			return err
+		}
+		if short == 0 {
+			break
+		}
+		if short < 0 {
+			if failed++; failed > 64 {
+				return nil
+			}
+			short = 1
+		} else {
+			failed = 0
+		}
+		bad = sectors
+		sectors += uint64(short) * csect
+	}
+	for sectors-bad > 1 {
+		mid := bad + (sectors-bad)/2
+		short, err := c.try(mid)
+		if err != nil {
+			return err
+		}
+		if short == 0 {
+			sectors = mid
+		} else {
+			bad = mid
+		}
+	}
+	c.sectors = sectors
+	return nil
+}
+
+// try formats a scratch device of the given size and returns how many
+// clusters it lacks for the tree, 0 if it holds it and -1 if f_mkfs makes
+// no volume of the candidate's type there.
+func (c *minCandidate) try(sectors uint64) (int64, error) {
+	dev := NewOverlayDevice(zeroDevice{sectors})
+	defer dev.Close()
+	if err := Format(dev, c.format); err != nil {
+		if errors.Is(err, FileResultMkfsAborted) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	v, err := openVolume(dev, 0)
+	if err != nil {
+		return 0, fmt.Errorf("scratch volume of %d sectors: %w", sectors, err)
+	}
+	if typ := v.typ; typ != c.format.Type && !(typ == TypeFAT12 && c.format.Type == TypeFAT16) {
+		return -1, nil
+	}
+	var free uint64
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if v.fatEntry(cl) == 0 {
+			free++
+		}
+	}
+	if free >= c.need {
+		return 0, nil
+	}
+	return int64(c.need - free), nil
+}
+
+// zeroDevice reads as zeroes and takes no writes. Under an OverlayDevice it
+// makes a scratch device of any size that only takes the memory written to
+// it.
+type zeroDevice struct {
+	sectors uint64
+}
+
+func (z zeroDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	if sector+uint64(count) > z.sectors {
+		return fmt.Errorf("read beyond the end of the device: sector %d", sector)
+	}
+	clear(buff[:uint64(count)*SectorSize])
+	return nil
+}
+
+func (z zeroDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	return FileResultWriteProtected
+}
+
+func (z zeroDevice) GetSectorSize() uint64  { return SectorSize }
+func (z zeroDevice) GetSectorCount() uint64 { return z.sectors }
+func (z zeroDevice) Initialize() error      { return nil }
+func (z zeroDevice) Status() error          { return nil }
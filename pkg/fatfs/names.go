@@ -0,0 +1,132 @@
+package fatfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLen is FF_MAX_LFN, the longest name in UTF-16 code units.
+const maxNameLen = 255
+
+// invalidNameChars are the printable characters names on FAT and exFAT
+// cannot contain.
+const invalidNameChars = `"*/:<>?\|`
+
+// NameError reports a name that cannot be stored on the volume.
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid name %q: %s", e.Name, e.Reason)
+}
+
+// Unwrap returns FileResultInvalidName, the error FatFs gives for most such
+// names.
+func (e *NameError) Unwrap() error { return FileResultInvalidName }
+
+// ValidateName checks that name can be stored as it is as a long name on
+// FAT or exFAT, returning a *NameError if not. Besides the names FatFs
+// rejects, this rejects trailing dots and spaces, which FatFs removes
+// without notice.
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return &NameError{name, "empty name"}
+	case name == "." || name == "..":
+		return &NameError{name, "reserved name"}
+	case !utf8.ValidString(name):
+		return &NameError{name, "not valid UTF-8"}
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7F {
+			return &NameError{name, fmt.Sprintf("control character %U", r)}
+		}
+		if strings.ContainsRune(invalidNameChars, r) {
+			return &NameError{name, fmt.Sprintf("character %q is not allowed", r)}
+		}
+	}
+	if c := name[len(name)-1]; c == '.' || c == ' ' {
+		return &NameError{name, "trailing dot or space"}
+	}
+	if n := len(utf16.Encode([]rune(name))); n > maxNameLen {
+		return &NameError{name, fmt.Sprintf("%d UTF-16 code units, at most %d are allowed", n, maxNameLen)}
+	}
+	return nil
+}
+
+// ValidatePath checks every element of the slash-separated path p with
+// ValidateName.
+func ValidatePath(p string) error {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "" {
+			continue
+		}
+		if err := ValidateName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NamePolicy controls how the names of imported files are fitted to FAT.
+// The zero policy only validates names.
+type NamePolicy struct {
+	// NFC normalizes names to Unicode normalization form C. macOS sends
+	// names decomposed (NFD), which FAT stores as they are, so the same
+	// name typed on a Mac and elsewhere would not match.
+	NFC bool
+	// Sanitize replaces invalid characters and bytes by '_', removes
+	// trailing dots and spaces and shortens names that are too long,
+	// keeping the extension, instead of rejecting such names.
+	Sanitize bool
+}
+
+// Apply returns name changed according to the policy, or a *NameError if
+// it is not valid.
+func (p NamePolicy) Apply(name string) (string, error) {
+	if p.Sanitize {
+		name = sanitizeName(name)
+	}
+	if p.NFC {
+		name = norm.NFC.String(name)
+	}
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func sanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7F || strings.ContainsRune(invalidNameChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+
+	if units := len(utf16.Encode([]rune(name))); units > maxNameLen {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := []rune(strings.TrimSuffix(name, ext))
+		keep := maxNameLen - len(utf16.Encode([]rune(ext)))
+		for len(utf16.Encode(base)) > keep {
+			base = base[:len(base)-1]
+		}
+		name = strings.TrimRight(string(base), ". ") + ext
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
@@ -0,0 +1,573 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+// assert that OverlayDevice implements the BlockDevice interface
+var _ BlockDevice = (*OverlayDevice)(nil)
+
+// OverlayDevice is a copy-on-write BlockDevice. Reads come from the base
+// device unless the sector has been written, writes only ever land in a
+// delta kept in memory or in a sidecar file. The base is never modified
+// until Commit is called, so it may be read-only.
+//
+// Snapshots capture the delta under a name and can be restored later. The
+// FatFs caches are not aware of the overlay: unmount the volume, or at least
+// sync every file and remount afterwards, around Commit, Discard and Restore.
+type OverlayDevice struct {
+	base  BlockDevice
+	store overlayStore
+
+	// delta maps a sector to its data reference in the store
+	delta     map[uint64]int64
+	snapshots map[string]map[uint64]int64
+}
+
+// overlayStore holds the sector data of an OverlayDevice delta.
+type overlayStore interface {
+	// put stores count sectors starting at sector and returns a reference
+	// for each of them.
+	put(sector uint64, count uint32, data []byte) ([]int64, error)
+	get(ref int64, buf []byte) error
+	// release tells the store a reference is no longer used.
+	release(ref int64)
+	// log persists a control operation so the state can be rebuilt.
+	log(op byte, name string) error
+	reset() error
+	sync() error
+	close() error
+}
+
+// NewOverlayDevice layers an in-memory delta over base.
+func NewOverlayDevice(base BlockDevice) *OverlayDevice {
+	return &OverlayDevice{
+		base:      base,
+		store:     &memOverlayStore{blocks: make(map[int64][]byte)},
+		delta:     make(map[uint64]int64),
+		snapshots: make(map[string]map[uint64]int64),
+	}
+}
+
+// OpenOverlayDevice layers a delta kept in the sidecar file at path over
+// base. An existing sidecar is resumed, including its snapshots; it must
+// have been created for a base of the same size.
+func OpenOverlayDevice(base BlockDevice, path string) (*OverlayDevice, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &OverlayDevice{
+		base:      base,
+		delta:     make(map[uint64]int64),
+		snapshots: make(map[string]map[uint64]int64),
+	}
+	store := &fileOverlayStore{file: f, sectors: base.GetSectorCount()}
+	o.store = store
+	if err := store.load(o); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("overlay %s: %w", path, err)
+	}
+	return o, nil
+}
+
+// Base returns the device below the overlay.
+func (o *OverlayDevice) Base() BlockDevice {
+	return o.base
+}
+
+// DeltaSectors returns how many sectors differ from the base.
+func (o *OverlayDevice) DeltaSectors() int {
+	return len(o.delta)
+}
+
+// Commit writes the delta to the base device and empties it. Snapshots are
+// dropped, since they were taken against the old base contents.
+func (o *OverlayDevice) Commit() error {
+	sectors := make([]uint64, 0, len(o.delta))
+	for s := range o.delta {
+		sectors = append(sectors, s)
+	}
+	slices.Sort(sectors)
+
+	// write back in runs of consecutive sectors
+	buf := make([]byte, 0, 64*sectorSize)
+	for i := 0; i < len(sectors); {
+		start := sectors[i]
+		buf = buf[:0]
+		for i < len(sectors) && sectors[i] == start+uint64(len(buf)/sectorSize) && len(buf) < cap(buf) {
+			buf = buf[:len(buf)+sectorSize]
+			if err := o.store.get(o.delta[sectors[i]], buf[len(buf)-sectorSize:]); err != nil {
+				return err
+			}
+			i++
+		}
+		if err := o.base.WriteSectors(start, uint32(len(buf)/sectorSize), buf); err != nil {
+			return fmt.Errorf("commit failed at sector %d: %w", start, err)
+		}
+	}
+
+	return o.reset()
+}
+
+// Discard throws the delta away so the device reads as the base again.
+// Snapshots are kept and can still be restored.
+func (o *OverlayDevice) Discard() error {
+	if err := o.store.log(overlayOpDiscard, ""); err != nil {
+		return err
+	}
+	o.replace(make(map[uint64]int64))
+	return nil
+}
+
+// Snapshot records the current delta under name, replacing any previous
+// snapshot with that name.
+func (o *OverlayDevice) Snapshot(name string) error {
+	if err := o.store.log(overlayOpSnapshot, name); err != nil {
+		return err
+	}
+	o.snapshot(name)
+	return nil
+}
+
+// Restore makes the delta equal to the snapshot called name.
+func (o *OverlayDevice) Restore(name string) error {
+	if _, ok := o.snapshots[name]; !ok {
+		return fmt.Errorf("no snapshot named %q", name)
+	}
+	if err := o.store.log(overlayOpRestore, name); err != nil {
+		return err
+	}
+	o.restore(name)
+	return nil
+}
+
+// DeleteSnapshot forgets the snapshot called name.
+func (o *OverlayDevice) DeleteSnapshot(name string) error {
+	if _, ok := o.snapshots[name]; !ok {
+		return fmt.Errorf("no snapshot named %q", name)
+	}
+	if err := o.store.log(overlayOpDelete, name); err != nil {
+		return err
+	}
+	o.deleteSnapshot(name)
+	return nil
+}
+
+// Snapshots lists the snapshot names in sorted order.
+func (o *OverlayDevice) Snapshots() []string {
+	names := make([]string, 0, len(o.snapshots))
+	for name := range o.snapshots {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (o *OverlayDevice) snapshot(name string) {
+	o.deleteSnapshot(name)
+	o.snapshots[name] = maps.Clone(o.delta)
+}
+
+func (o *OverlayDevice) restore(name string) {
+	o.replace(maps.Clone(o.snapshots[name]))
+}
+
+func (o *OverlayDevice) deleteSnapshot(name string) {
+	old, ok := o.snapshots[name]
+	if !ok {
+		return
+	}
+	delete(o.snapshots, name)
+	for sector, ref := range old {
+		o.releaseIfUnused(sector, ref)
+	}
+}
+
+// replace swaps the delta, releasing data only the old delta referenced.
+func (o *OverlayDevice) replace(delta map[uint64]int64) {
+	old := o.delta
+	o.delta = delta
+	for sector, ref := range old {
+		o.releaseIfUnused(sector, ref)
+	}
+}
+
+// releaseIfUnused releases ref unless the delta or a snapshot still uses it.
+// A reference only ever belongs to one sector, so only that sector needs to
+// be looked at.
+func (o *OverlayDevice) releaseIfUnused(sector uint64, ref int64) {
+	if cur, ok := o.delta[sector]; ok && cur == ref {
+		return
+	}
+	for _, snap := range o.snapshots {
+		if cur, ok := snap[sector]; ok && cur == ref {
+			return
+		}
+	}
+	o.store.release(ref)
+}
+
+func (o *OverlayDevice) reset() error {
+	if syncer, ok := o.base.(Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := o.store.reset(); err != nil {
+		return err
+	}
+	o.delta = make(map[uint64]int64)
+	o.snapshots = make(map[string]map[uint64]int64)
+	return nil
+}
+
+// Initialize initializes the base device.
+func (o *OverlayDevice) Initialize() error {
+	if err := o.base.Initialize(); !errors.Is(err, FileResultWriteProtected) {
+		return err
+	}
+	return nil
+}
+
+// Status reports the status of the base device. The overlay itself is
+// always writable, even over a write-protected base.
+func (o *OverlayDevice) Status() error {
+	if err := o.base.Status(); !errors.Is(err, FileResultWriteProtected) {
+		return err
+	}
+	return nil
+}
+
+// ReadSectors reads `count` sectors at `sector`, taking each one from the
+// delta if it was written and from the base otherwise.
+func (o *OverlayDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	length := int64(count) * sectorSize
+	if int64(len(buff)) < length {
+		return fmt.Errorf("buffer too small: need %d bytes, got %d", length, len(buff))
+	}
+
+	for i := uint32(0); i < count; {
+		if ref, ok := o.delta[sector+uint64(i)]; ok {
+			if err := o.store.get(ref, buff[i*sectorSize:(i+1)*sectorSize]); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+
+		// read runs of untouched sectors from the base in one go
+		run := uint32(1)
+		for i+run < count {
+			if _, ok := o.delta[sector+uint64(i+run)]; ok {
+				break
+			}
+			run++
+		}
+		if err := o.base.ReadSectors(sector+uint64(i), run, buff[i*sectorSize:(i+run)*sectorSize]); err != nil {
+			return err
+		}
+		i += run
+	}
+	return nil
+}
+
+// WriteSectors stores `count` sectors from `buff` in the delta.
+func (o *OverlayDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	length := int64(count) * sectorSize
+	if int64(len(buff)) < length {
+		return fmt.Errorf("buffer too small: need %d bytes, got %d", length, len(buff))
+	}
+	if sector+uint64(count) > o.base.GetSectorCount() {
+		return fmt.Errorf("access beyond end of device: sector %d, count %d", sector, count)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	refs, err := o.store.put(sector, count, buff[:length])
+	if err != nil {
+		return err
+	}
+	o.apply(sector, refs)
+	return nil
+}
+
+func (o *OverlayDevice) apply(sector uint64, refs []int64) {
+	for i, ref := range refs {
+		s := sector + uint64(i)
+		old, ok := o.delta[s]
+		o.delta[s] = ref
+		if ok {
+			o.releaseIfUnused(s, old)
+		}
+	}
+}
+
+// Sync makes the delta durable. The base is not touched, it only changes
+// on Commit.
+func (o *OverlayDevice) Sync() error {
+	return o.store.sync()
+}
+
+// GetSectorSize returns the sector size of the base device.
+func (o *OverlayDevice) GetSectorSize() uint64 {
+	return o.base.GetSectorSize()
+}
+
+// GetSectorCount returns the number of sectors of the base device.
+func (o *OverlayDevice) GetSectorCount() uint64 {
+	return o.base.GetSectorCount()
+}
+
+// Close releases the delta store. Uncommitted changes held in memory are
+// lost, a sidecar file keeps them for the next OpenOverlayDevice.
+func (o *OverlayDevice) Close() error {
+	return o.store.close()
+}
+
+// memOverlayStore keeps every written sector in its own slice.
+type memOverlayStore struct {
+	blocks map[int64][]byte
+	next   int64
+}
+
+func (m *memOverlayStore) put(sector uint64, count uint32, data []byte) ([]int64, error) {
+	refs := make([]int64, count)
+	for i := range refs {
+		refs[i] = m.next
+		m.blocks[m.next] = bytes.Clone(data[i*sectorSize : (i+1)*sectorSize])
+		m.next++
+	}
+	return refs, nil
+}
+
+func (m *memOverlayStore) get(ref int64, buf []byte) error {
+	copy(buf, m.blocks[ref])
+	return nil
+}
+
+func (m *memOverlayStore) release(ref int64) {
+	delete(m.blocks, ref)
+}
+
+func (m *memOverlayStore) log(op byte, name string) error {
+	return nil
+}
+
+func (m *memOverlayStore) reset() error {
+	m.blocks = make(map[int64][]byte)
+	return nil
+}
+
+func (m *memOverlayStore) sync() error {
+	return nil
+}
+
+func (m *memOverlayStore) close() error {
+	m.blocks = nil
+	return nil
+}
+
+// The sidecar file is an append-only log: a header followed by records that
+// each start with one of the op bytes below. Data records carry the sector
+// contents, so a reference is simply the file offset of the sector data and
+// stays valid until Commit truncates the log.
+const (
+	overlayOpWrite    = 'W' // sector u64, count u32, data
+	overlayOpSnapshot = 'S' // name
+	overlayOpRestore  = 'R' // name
+	overlayOpDelete   = 'X' // name
+	overlayOpDiscard  = 'D'
+
+	overlayHeaderSize = 16
+)
+
+var overlayMagic = []byte("GOFATOV1")
+
+type fileOverlayStore struct {
+	file    *os.File
+	sectors uint64
+	end     int64
+}
+
+// load checks the header, or writes one for a new sidecar, then replays
+// the log into o.
+func (s *fileOverlayStore) load(o *OverlayDevice) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return s.reset()
+	}
+
+	var hdr [overlayHeaderSize]byte
+	if _, err := s.file.ReadAt(hdr[:], 0); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], overlayMagic) {
+		return errors.New("not an overlay sidecar file")
+	}
+	if got := binary.LittleEndian.Uint64(hdr[8:]); got != s.sectors {
+		return fmt.Errorf("sidecar was made for a %d sector base, this one has %d", got, s.sectors)
+	}
+
+	rd := io.NewSectionReader(s.file, overlayHeaderSize, info.Size()-overlayHeaderSize)
+	s.end = overlayHeaderSize
+	for {
+		var op [1]byte
+		if _, err := io.ReadFull(rd, op[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch op[0] {
+		case overlayOpWrite:
+			var rec [12]byte
+			if _, err := io.ReadFull(rd, rec[:]); err != nil {
+				return s.truncateTail(err)
+			}
+			sector := binary.LittleEndian.Uint64(rec[0:])
+			count := binary.LittleEndian.Uint32(rec[8:])
+			// a torn or garbled record may claim anything; check it
+			// against the base and the file before trusting it
+			data := s.end + 1 + int64(len(rec))
+			if count == 0 || sector >= s.sectors || uint64(count) > s.sectors-sector ||
+				data+int64(count)*sectorSize > info.Size() {
+				return s.truncateTail(io.ErrUnexpectedEOF)
+			}
+			if _, err := rd.Seek(int64(count)*sectorSize, io.SeekCurrent); err != nil {
+				return err
+			}
+			o.apply(sector, dataRefs(data, count))
+		case overlayOpSnapshot, overlayOpRestore, overlayOpDelete:
+			var n [1]byte
+			if _, err := io.ReadFull(rd, n[:]); err != nil {
+				return s.truncateTail(err)
+			}
+			name := make([]byte, n[0])
+			if _, err := io.ReadFull(rd, name); err != nil {
+				return s.truncateTail(err)
+			}
+			switch op[0] {
+			case overlayOpSnapshot:
+				o.snapshot(string(name))
+			case overlayOpRestore:
+				if _, ok := o.snapshots[string(name)]; ok {
+					o.restore(string(name))
+				}
+			case overlayOpDelete:
+				o.deleteSnapshot(string(name))
+			}
+		case overlayOpDiscard:
+			o.replace(make(map[uint64]int64))
+		default:
+			return fmt.Errorf("corrupt record at offset %d", s.end)
+		}
+
+		pos, _ := rd.Seek(0, io.SeekCurrent)
+		s.end = overlayHeaderSize + pos
+	}
+	return nil
+}
+
+// truncateTail drops a record that was cut short, e.g. by a crash while it
+// was being appended.
+func (s *fileOverlayStore) truncateTail(err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return s.file.Truncate(s.end)
+}
+
+func (s *fileOverlayStore) append(rec []byte) (int64, error) {
+	off := s.end
+	if _, err := s.file.WriteAt(rec, off); err != nil {
+		return 0, fmt.Errorf("failed to write sidecar: %w", err)
+	}
+	s.end += int64(len(rec))
+	return off, nil
+}
+
+func (s *fileOverlayStore) put(sector uint64, count uint32, data []byte) ([]int64, error) {
+	rec := make([]byte, 13, 13+len(data))
+	rec[0] = overlayOpWrite
+	binary.LittleEndian.PutUint64(rec[1:], sector)
+	binary.LittleEndian.PutUint32(rec[9:], count)
+	rec = append(rec, data...)
+	off, err := s.append(rec)
+	if err != nil {
+		return nil, err
+	}
+	return dataRefs(off+13, count), nil
+}
+
+// dataRefs returns the file offsets of count sectors stored back to back.
+func dataRefs(off int64, count uint32) []int64 {
+	refs := make([]int64, count)
+	for i := range refs {
+		refs[i] = off + int64(i)*sectorSize
+	}
+	return refs
+}
+
+func (s *fileOverlayStore) get(ref int64, buf []byte) error {
+	if _, err := s.file.ReadAt(buf[:sectorSize], ref); err != nil {
+		return fmt.Errorf("failed to read sidecar: %w", err)
+	}
+	return nil
+}
+
+func (s *fileOverlayStore) release(ref int64) {
+	// the log is append-only, space is reclaimed by Commit
+}
+
+func (s *fileOverlayStore) log(op byte, name string) error {
+	if len(name) > 255 {
+		return fmt.Errorf("snapshot name too long: %q", name)
+	}
+	rec := []byte{op}
+	if op != overlayOpDiscard {
+		rec = append(rec, byte(len(name)))
+		rec = append(rec, name...)
+	}
+	_, err := s.append(rec)
+	return err
+}
+
+func (s *fileOverlayStore) reset() error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	hdr := make([]byte, overlayHeaderSize)
+	copy(hdr, overlayMagic)
+	binary.LittleEndian.PutUint64(hdr[8:], s.sectors)
+	if _, err := s.file.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	s.end = overlayHeaderSize
+	return nil
+}
+
+func (s *fileOverlayStore) sync() error {
+	return s.file.Sync()
+}
+
+func (s *fileOverlayStore) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
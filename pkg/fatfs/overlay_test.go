@@ -0,0 +1,236 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// sectorData returns a sector filled with b.
+func sectorData(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 512)
+}
+
+// expectSectors fails t unless each sector of want reads as the sector of
+// its byte, 0 meaning the base.
+func expectSectors(t *testing.T, dev fatfs.BlockDevice, base []byte, want map[uint64]byte) {
+	t.Helper()
+	buf := make([]byte, 512)
+	for sector := uint64(0); sector < 16; sector++ {
+		if err := dev.ReadSectors(sector, 1, buf); err != nil {
+			t.Fatal(err)
+		}
+		exp := base[sector*512:][:512]
+		if b, ok := want[sector]; ok {
+			exp = sectorData(b)
+		}
+		if !bytes.Equal(buf, exp) {
+			t.Errorf("sector %d reads %#x, want %#x", sector, buf[0], exp[0])
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	for _, sidecar := range []bool{false, true} {
+		name := "memory"
+		if sidecar {
+			name = "sidecar"
+		}
+		t.Run(name, func(t *testing.T) {
+			base := fatfs.NewMemDevice(1 << 20)
+			for i := range base.Bytes() {
+				base.Bytes()[i] = byte(i / 512)
+			}
+			orig := bytes.Clone(base.Bytes())
+			o := fatfs.NewOverlayDevice(base)
+			if sidecar {
+				var err error
+				if o, err = fatfs.OpenOverlayDevice(base, filepath.Join(t.TempDir(), "delta")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer o.Close()
+
+			write := func(sector uint64, b byte) {
+				t.Helper()
+				if err := o.WriteSectors(sector, 1, sectorData(b)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write(1, 0xA1)
+			write(2, 0xA2)
+			if err := o.Snapshot("a"); err != nil {
+				t.Fatal(err)
+			}
+			write(2, 0xB2)
+			write(3, 0xB3)
+			expectSectors(t, o, orig, map[uint64]byte{1: 0xA1, 2: 0xB2, 3: 0xB3})
+			if !bytes.Equal(base.Bytes(), orig) {
+				t.Fatal("the base changed")
+			}
+
+			if err := o.Restore("a"); err != nil {
+				t.Fatal(err)
+			}
+			expectSectors(t, o, orig, map[uint64]byte{1: 0xA1, 2: 0xA2})
+			if err := o.Discard(); err != nil {
+				t.Fatal(err)
+			}
+			expectSectors(t, o, orig, nil)
+			if o.DeltaSectors() != 0 {
+				t.Errorf("%d sectors in the delta after Discard", o.DeltaSectors())
+			}
+			// snapshots survive Discard
+			if err := o.Restore("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Restore("b"); err == nil {
+				t.Error("restored a snapshot that was never taken")
+			}
+			write(4, 0xA4)
+
+			if err := o.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if o.DeltaSectors() != 0 || len(o.Snapshots()) != 0 {
+				t.Errorf("after Commit: %d sectors, snapshots %q", o.DeltaSectors(), o.Snapshots())
+			}
+			want := map[uint64]byte{1: 0xA1, 2: 0xA2, 4: 0xA4}
+			expectSectors(t, o, orig, want)
+			expectSectors(t, base, orig, want)
+		})
+	}
+}
+
+// A volume changed through an overlay and committed matches one changed
+// directly.
+func TestOverlayFileSystem(t *testing.T) {
+	tree := testTree()
+	base := fatfs.NewMemDevice(4 << 20)
+	if err := fatfs.BuildImage(base, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	orig := base.Clone()
+	o := fatfs.NewOverlayDevice(base)
+	defer o.Close()
+	mounted(t, o, func(fs *fatfs.FatFs) {
+		writeFile(t, fs, "added.txt", []byte("added"))
+		if err := fs.Remove("top.txt"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	changed := fstest.MapFS{"added.txt": {Data: []byte("added")}}
+	for name, f := range tree {
+		if name != "top.txt" {
+			changed[name] = f
+		}
+	}
+	checkTree(t, o, changed)
+	checkTree(t, base, tree)
+	if !bytes.Equal(base.Bytes(), orig.Bytes()) {
+		t.Fatal("the base changed")
+	}
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, base, changed)
+}
+
+func TestOverlaySidecarReopen(t *testing.T) {
+	base := fatfs.NewMemDevice(1 << 20)
+	orig := bytes.Clone(base.Bytes())
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := fatfs.OpenOverlayDevice(base, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.WriteSectors(1, 2, append(sectorData(0xA1), sectorData(0xA2)...))
+	o.Snapshot("a")
+	o.WriteSectors(2, 1, sectorData(0xB2))
+	o.Snapshot("b")
+	o.Discard()
+	o.WriteSectors(5, 1, sectorData(0xC5))
+	o.DeleteSnapshot("a")
+	o.Snapshot("c")
+	o.Restore("b")
+	if err := o.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint64]byte{1: 0xA1, 2: 0xB2}
+
+	reopen := func() *fatfs.OverlayDevice {
+		t.Helper()
+		o, err := fatfs.OpenOverlayDevice(base, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.Snapshots(); !slices.Equal(got, []string{"b", "c"}) {
+			t.Errorf("snapshots %q", got)
+		}
+		expectSectors(t, o, orig, want)
+		return o
+	}
+	o = reopen()
+	if err := o.Restore("c"); err != nil {
+		t.Fatal(err)
+	}
+	expectSectors(t, o, orig, map[uint64]byte{5: 0xC5})
+	if err := o.Restore("b"); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// records torn or garbled by a crash while appending are dropped
+	record := func(sector uint64, count uint32, data int) []byte {
+		rec := []byte{'W'}
+		rec = binary.LittleEndian.AppendUint64(rec, sector)
+		rec = binary.LittleEndian.AppendUint32(rec, count)
+		return append(rec, make([]byte, data)...)
+	}
+	for name, tail := range map[string][]byte{
+		"torn header":     record(3, 1, 0)[:7],
+		"torn data":       record(3, 2, 700),
+		"no sectors":      record(3, 0, 0),
+		"beyond the base": record(2048, 1, 512),
+		"huge count":      record(3, 0xFFFFFFFF, 512),
+		"torn name":       {'S', 10, 'x'},
+	} {
+		if err := os.WriteFile(path, append(bytes.Clone(good), tail...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		o := reopen()
+		o.Close()
+		if info2, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if info2.Size() != info.Size() {
+			t.Errorf("%s: sidecar of %d bytes, want %d", name, info2.Size(), info.Size())
+		}
+	}
+
+	// a sidecar belongs to a base of one size
+	if _, err := fatfs.OpenOverlayDevice(fatfs.NewMemDevice(2<<20), path); err == nil {
+		t.Error("opened a sidecar over a base of another size")
+	}
+	other := filepath.Join(t.TempDir(), "other")
+	os.WriteFile(other, []byte("not a sidecar file at all"), 0o644)
+	if _, err := fatfs.OpenOverlayDevice(base, other); err == nil {
+		t.Error("opened a file that is no sidecar")
+	}
+}
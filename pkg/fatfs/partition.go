@@ -0,0 +1,193 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Partition is an entry of an MBR or GPT partition table.
+type Partition struct {
+	// Index is the 1-based position of the entry in the table.
+	Index   int
+	Start   uint64
+	Sectors uint64
+	// Type is the MBR system ID, e.g. "0x0c", or the GPT partition type
+	// GUID.
+	Type string
+}
+
+// ReadPartitions lists the partitions of dev. It returns no partitions for
+// a device formatted without a partition table.
+func ReadPartitions(dev BlockDevice) ([]Partition, error) {
+	v := &volume{dev: dev, ssize: dev.GetSectorSize()}
+	mbr, err := v.read(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if checkBootSector(mbr) != 2 {
+		return nil, nil
+	}
+	if mbr[mbrTable+4] == 0xEE {
+		return v.readGPT()
+	}
+
+	var parts []Partition
+	for i := 0; i < 4; i++ {
+		ent := mbr[mbrTable+i*partEntSize:]
+		if ent[4] == 0 {
+			continue
+		}
+		parts = append(parts, Partition{
+			Index:   i + 1,
+			Start:   uint64(binary.LittleEndian.Uint32(ent[8:])),
+			Sectors: uint64(binary.LittleEndian.Uint32(ent[12:])),
+			Type:    fmt.Sprintf("%#02x", ent[4]),
+		})
+	}
+	return parts, nil
+}
+
+func (v *volume) readGPT() ([]Partition, error) {
+	hdr, err := v.read(1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:8], []byte("EFI PART")) {
+		return nil, errors.New("bad GPT header")
+	}
+	n := uint64(binary.LittleEndian.Uint32(hdr[80:]))
+	esize := uint64(binary.LittleEndian.Uint32(hdr[84:]))
+	table := binary.LittleEndian.Uint64(hdr[72:])
+	if esize < 128 || esize > v.ssize || v.ssize%esize != 0 {
+		return nil, fmt.Errorf("bad GPT entry size %d", esize)
+	}
+
+	data, err := v.read(table, (n*esize+v.ssize-1)/v.ssize)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Partition
+	for i := uint64(0); i < n; i++ {
+		ent := data[i*esize:]
+		if isZero(ent[:16]) {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(ent[32:])
+		last := binary.LittleEndian.Uint64(ent[40:])
+		parts = append(parts, Partition{
+			Index:   int(i) + 1,
+			Start:   first,
+			Sectors: last - first + 1,
+			Type:    formatGUID(ent[:16]),
+		})
+	}
+	return parts, nil
+}
+
+// formatGUID renders a GUID stored in the mixed-endian layout of GPT.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// OpenPartition returns a device covering partition index (1-based) of dev.
+func OpenPartition(dev BlockDevice, index int) (*SectionDevice, error) {
+	parts, err := ReadPartitions(dev)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if p.Index == index {
+			return NewSectionDevice(dev, p.Start, p.Sectors)
+		}
+	}
+	return nil, fmt.Errorf("partition %d not found", index)
+}
+
+// assert that SectionDevice implements the BlockDevice and Syncer interfaces
+var (
+	_ BlockDevice = (*SectionDevice)(nil)
+	_ Syncer      = (*SectionDevice)(nil)
+)
+
+// SectionDevice exposes a range of sectors of another device as a device of
+// its own, e.g. a partition or a volume at an offset in a larger image.
+type SectionDevice struct {
+	dev          BlockDevice
+	start, count uint64
+}
+
+// NewSectionDevice returns a device for the count sectors of dev starting
+// at start. A zero count extends the section to the end of dev.
+func NewSectionDevice(dev BlockDevice, start, count uint64) (*SectionDevice, error) {
+	total := dev.GetSectorCount()
+	if start > total {
+		return nil, fmt.Errorf("section starts beyond the end of the device: sector %d of %d", start, total)
+	}
+	if count == 0 {
+		count = total - start
+	}
+	if start+count > total {
+		return nil, fmt.Errorf("section ends beyond the end of the device: sector %d of %d", start+count, total)
+	}
+	return &SectionDevice{dev: dev, start: start, count: count}, nil
+}
+
+// Initialize initializes the underlying device.
+func (s *SectionDevice) Initialize() error {
+	return s.dev.Initialize()
+}
+
+// Status reports the status of the underlying device.
+func (s *SectionDevice) Status() error {
+	return s.dev.Status()
+}
+
+func (s *SectionDevice) check(sector uint64, count uint32) error {
+	if sector+uint64(count) > s.count {
+		return fmt.Errorf("access beyond end of section: sector %d, count %d", sector, count)
+	}
+	return nil
+}
+
+// ReadSectors reads from the section.
+func (s *SectionDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	if err := s.check(sector, count); err != nil {
+		return err
+	}
+	return s.dev.ReadSectors(s.start+sector, count, buff)
+}
+
+// WriteSectors writes to the section.
+func (s *SectionDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	if err := s.check(sector, count); err != nil {
+		return err
+	}
+	return s.dev.WriteSectors(s.start+sector, count, buff)
+}
+
+// Sync syncs the underlying device, if it supports it.
+func (s *SectionDevice) Sync() error {
+	if syncer, ok := s.dev.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// GetSectorSize returns the sector size of the underlying device.
+func (s *SectionDevice) GetSectorSize() uint64 {
+	return s.dev.GetSectorSize()
+}
+
+// Start returns the first sector of the section on the underlying device.
+func (s *SectionDevice) Start() uint64 {
+	return s.start
+}
+
+// GetSectorCount returns the size of the section.
+func (s *SectionDevice) GetSectorCount() uint64 {
+	return s.count
+}
@@ -0,0 +1,768 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ResizeOptions controls Resize and ResizeLimits.
+type ResizeOptions struct {
+	// Partition selects the partition (1-based) holding the volume, 0 the
+	// volume FatFs would mount. Pass the whole device rather than a
+	// SectionDevice so that the partition table can be updated.
+	Partition int
+}
+
+// ResizeRange gives the sizes a volume can be resized to, in sectors.
+type ResizeRange struct {
+	// Start is the first sector of the volume on the device and Sectors
+	// its current size.
+	Start, Sectors uint64
+	// Min is the smallest size that holds the files on the volume, Max the
+	// largest the device, its partition table and the file system allow.
+	Min, Max uint64
+	// DeviceMin is the smallest device that holds the volume shrunk to
+	// Min, the partitions after it and the backup GPT: the size an image
+	// file can be cut to after shrinking the volume.
+	DeviceMin uint64
+}
+
+// ResizeLimits reports how far the FAT32 or exFAT volume on blk can be
+// shrunk and grown. blk must not be mounted.
+func ResizeLimits(blk BlockDevice, opts *ResizeOptions) (*ResizeRange, error) {
+	r, err := newResizer(blk, opts)
+	if err != nil {
+		return nil, err
+	}
+	return r.limits()
+}
+
+// Resize changes the size of the FAT32 or exFAT volume on blk to sectors,
+// or with sectors 0 grows it to take all the space the device and its
+// partition table leave it. The partition holding the volume is resized
+// with it; on GPT devices the backup GPT is moved to the end of the device,
+// which is needed after copying an image to a larger card.
+//
+// Growing the volume enlarges the FAT and, on exFAT, the allocation
+// bitmap. Shrinking it first moves the clusters in use beyond the new end
+// to free clusters below it, which can fragment the files moved; Defrag
+// can repair that afterwards. When the FAT changes size the data area is
+// shifted to make room or to close the gap, so Resize is not safe against
+// interruption: keep a copy of the volume until it returns. Resize refuses
+// volumes with broken or cross-linked chains and clusters in use by no
+// file; repair those with Check first. blk must not be mounted.
+func Resize(blk BlockDevice, sectors uint64, opts *ResizeOptions) error {
+	r, err := newResizer(blk, opts)
+	if err != nil {
+		return err
+	}
+	rng, err := r.limits()
+	if err != nil {
+		return err
+	}
+	if sectors == 0 {
+		sectors = rng.Max
+	}
+	switch {
+	case sectors > rng.Max:
+		return fmt.Errorf("volume of %d sectors does not fit, at most %d are available", sectors, rng.Max)
+	case sectors < rng.Min:
+		return fmt.Errorf("volume of %d sectors is too small, the files need at least %d", sectors, rng.Min)
+	case sectors == r.v.sectors:
+		// only bring the partition table in line
+		return r.setSlot(sectors)
+	case sectors > r.v.sectors:
+		if err := r.setSlot(sectors); err != nil {
+			return err
+		}
+		return r.resize(sectors)
+	default:
+		if err := r.resize(sectors); err != nil {
+			return err
+		}
+		return r.setSlot(sectors)
+	}
+}
+
+// resizer holds the state of Resize.
+type resizer struct {
+	v *volume
+	d *defragger
+
+	// The volume starts with pre sectors before the FAT and has gap
+	// sectors between the FATs and the data area, which stay as they are.
+	pre, gap uint64
+	// step is the smallest change of the FAT size that moves the data
+	// area by whole clusters, keeping it aligned as the formatter left it.
+	step uint64
+
+	slot *volumeSlot
+}
+
+func newResizer(blk BlockDevice, opts *ResizeOptions) (*resizer, error) {
+	if opts == nil {
+		opts = &ResizeOptions{}
+	}
+	v, err := openVolume(blk, opts.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if v.typ != TypeFAT32 && v.typ != TypeEXFAT {
+		return nil, fmt.Errorf("resizing %s volumes is not supported", v.typ)
+	}
+	d := &defragger{v: v}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	r := &resizer{
+		v:    v,
+		d:    d,
+		pre:  v.fatStart - v.base,
+		gap:  v.dataStart - v.fatStart - uint64(v.nfats)*v.fatSize,
+		step: v.csize,
+	}
+	if v.nfats == 2 && v.csize > 1 {
+		r.step = v.csize / 2
+	}
+	if r.slot, err = v.findSlot(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// maxClusters returns the largest number of clusters of the volume's type.
+func (r *resizer) maxClusters() uint64 {
+	if r.v.typ == TypeEXFAT {
+		return maxEXFAT
+	}
+	return maxFAT32
+}
+
+// minClusters returns the smallest number of clusters of the volume's type.
+func (r *resizer) minClusters() uint64 {
+	if r.v.typ == TypeEXFAT {
+		return 1
+	}
+	return maxFAT16 + 1
+}
+
+// fatFor returns the FAT size for n clusters. The size differs from the
+// current one by a multiple of step; with keep set it is at least the
+// current one.
+func (r *resizer) fatFor(n uint64, keep bool) uint64 {
+	v := r.v
+	fatSize := (v.fatSize-1)%r.step + 1
+	if keep {
+		fatSize = v.fatSize
+	}
+	if need := ((n+2)*4 + v.ssize - 1) / v.ssize; need > fatSize {
+		fatSize += (need - fatSize + r.step - 1) / r.step * r.step
+	}
+	return fatSize
+}
+
+// geometry returns the FAT size and number of clusters of the volume
+// resized to sectors. The number of clusters may exceed maxClusters.
+func (r *resizer) geometry(sectors uint64, keep bool) (fatSize, nclst uint64, err error) {
+	v := r.v
+	system := func(n uint64) uint64 { return r.pre + uint64(v.nfats)*r.fatFor(n, keep) + r.gap }
+	// start with the clusters the smallest FAT leaves room for, then take
+	// away those the FAT grown for them needs
+	if s := system(0); sectors > s {
+		nclst = (sectors - s) / v.csize
+	}
+	for nclst > 0 && r.sectorsFor(nclst, keep) > sectors {
+		if s := system(nclst); sectors > s {
+			nclst = min(nclst-1, (sectors-s)/v.csize)
+		} else {
+			nclst = 0
+		}
+	}
+	// the FAT shrunk for the fewer clusters may leave room for a few more
+	for nclst > 0 && r.sectorsFor(nclst+1, keep) <= sectors {
+		nclst++
+	}
+	if nclst < r.minClusters() {
+		return 0, 0, fmt.Errorf("volume of %d sectors is too small for %s", sectors, v.typ)
+	}
+	return r.fatFor(nclst, keep), nclst, nil
+}
+
+// sectorsFor returns the size of the volume with n clusters.
+func (r *resizer) sectorsFor(n uint64, keep bool) uint64 {
+	v := r.v
+	return r.pre + uint64(v.nfats)*r.fatFor(n, keep) + r.gap + n*v.csize
+}
+
+// bitmapClusters returns the clusters an exFAT allocation bitmap for n
+// clusters takes.
+func (r *resizer) bitmapClusters(n uint64) uint64 {
+	cb := r.v.clusterBytes()
+	return ((n+7)/8 + cb - 1) / cb
+}
+
+func (r *resizer) limits() (*ResizeRange, error) {
+	v, d := r.v, r.d
+	rng := &ResizeRange{Start: v.base, Sectors: v.sectors}
+
+	// clusters in use, apart from the allocation bitmap whose size
+	// depends on the number of clusters
+	var used uint64
+	for cl := uint32(2); cl < v.nclst+2; cl++ {
+		if d.owner[cl] != 0 {
+			used++
+		}
+	}
+	n := max(used, r.minClusters())
+	if v.typ == TypeEXFAT {
+		used -= uint64(len(d.bitmapClusters))
+		for n = used + 1; used+r.bitmapClusters(n) > n; {
+			n = used + r.bitmapClusters(n)
+		}
+	}
+	rng.Min = min(r.sectorsFor(n, false), v.sectors)
+
+	rng.Max = r.slot.limit
+	if v.typ == TypeFAT32 {
+		rng.Max = min(rng.Max, 0xFFFFFFFF)
+	}
+	if _, nclst, err := r.geometry(rng.Max, true); err == nil && nclst > r.maxClusters() {
+		rng.Max = r.sectorsFor(r.maxClusters(), true)
+	}
+	rng.Max = max(rng.Max, v.sectors)
+
+	rng.DeviceMin = max(v.base+rng.Min, r.slot.othersEnd) + r.slot.trailer
+	return rng, nil
+}
+
+// resize changes the file system to the new size; the partition is handled
+// by the caller.
+func (r *resizer) resize(sectors uint64) error {
+	v, d := r.v, r.d
+	fatSize, n, err := r.geometry(sectors, sectors > v.sectors)
+	if err != nil {
+		return err
+	}
+	if n > r.maxClusters() {
+		return fmt.Errorf("volume of %d sectors has too many clusters for %s", sectors, v.typ)
+	}
+	nclst := uint32(n)
+
+	if nclst < v.nclst {
+		if err := r.evacuate(nclst); err != nil {
+			return err
+		}
+		if v.typ == TypeEXFAT {
+			if err := r.placeBitmap(nclst); err != nil {
+				return err
+			}
+		}
+	}
+
+	shift := int64(v.nfats) * (int64(fatSize) - int64(v.fatSize))
+	if err := r.shiftData(shift, min(nclst, v.nclst)); err != nil {
+		return err
+	}
+
+	// the new FAT keeps the entries of the clusters that remain
+	fat := make([]byte, fatSize*v.ssize)
+	copy(fat, v.fat[:(uint64(min(nclst, v.nclst))+2)*4])
+	v.fat, v.fatSize = fat, fatSize
+	v.dataStart = uint64(int64(v.dataStart) + shift)
+	v.sectors = sectors
+	clear(v.fatDirty)
+	for i := 0; i < v.nfats; i++ {
+		if err := v.write(v.fatStart+uint64(i)*fatSize, fat); err != nil {
+			return err
+		}
+	}
+	old := v.nclst
+	v.nclst = nclst
+	if nclst > old {
+		d.owner = append(d.owner, make([]int32, nclst-old)...)
+		d.pos = append(d.pos, make([]uint32, nclst-old)...)
+	} else {
+		d.owner, d.pos = d.owner[:nclst+2], d.pos[:nclst+2]
+	}
+
+	if v.typ == TypeEXFAT {
+		if err := r.placeBitmap(nclst); err != nil {
+			return err
+		}
+		if err := r.writeBitmap(); err != nil {
+			return err
+		}
+	}
+
+	var free, used uint64
+	for cl := uint32(2); cl < nclst+2; cl++ {
+		if d.owner[cl] == 0 {
+			free++
+		} else {
+			used++
+		}
+	}
+	err = v.updateBoot(func(boot []byte) {
+		if v.typ == TypeEXFAT {
+			binary.LittleEndian.PutUint64(boot[72:], sectors)
+			binary.LittleEndian.PutUint32(boot[84:], uint32(fatSize))
+			binary.LittleEndian.PutUint32(boot[88:], uint32(v.dataStart-v.base))
+			binary.LittleEndian.PutUint32(boot[92:], nclst)
+			boot[112] = byte(used * 100 / uint64(nclst))
+			return
+		}
+		binary.LittleEndian.PutUint16(boot[19:], 0)
+		binary.LittleEndian.PutUint32(boot[32:], uint32(sectors))
+		binary.LittleEndian.PutUint32(boot[36:], uint32(fatSize))
+	})
+	if err != nil {
+		return err
+	}
+	if v.typ == TypeFAT32 {
+		return r.writeFSInfo(uint32(free))
+	}
+	return nil
+}
+
+// evacuate moves the clusters in use at or beyond cluster nclst+2 to free
+// clusters below it. The exFAT allocation bitmap is left to placeBitmap.
+func (r *resizer) evacuate(nclst uint32) error {
+	v, d := r.v, r.d
+	end := nclst + 2
+	bitmap := make(map[uint32]bool, len(d.bitmapClusters))
+	for _, cl := range d.bitmapClusters {
+		bitmap[cl] = true
+	}
+	for cl := end; cl < v.nclst+2; cl++ {
+		if d.owner[cl] < 0 && !bitmap[cl] {
+			return fmt.Errorf("%w: cluster %d is in use but not by any file, repair the volume with Check first", FileResultIntErr, cl)
+		}
+	}
+
+	// take the free clusters from the start, in the order of the files
+	target := map[uint32]uint32{}
+	next := uint32(2)
+	for _, f := range d.files {
+		for _, cl := range f.clusters {
+			if cl < end {
+				continue
+			}
+			for next < end && d.owner[next] != 0 {
+				next++
+			}
+			if next == end {
+				return fmt.Errorf("no room below cluster %d for the clusters in use", end)
+			}
+			target[cl] = next
+			next++
+		}
+	}
+	return d.run(target)
+}
+
+// shiftData moves the data area by shift sectors, copying the clusters in
+// use below cluster end+2. Moving up it copies from the top down, moving
+// down from the bottom up, so that no cluster is overwritten before it is
+// copied.
+func (r *resizer) shiftData(shift int64, end uint32) error {
+	v, d := r.v, r.d
+	if shift == 0 {
+		return nil
+	}
+	var runs []clusterRun
+	for cl := uint32(2); cl < end+2; cl++ {
+		if d.owner[cl] == 0 {
+			continue
+		}
+		if k := len(runs) - 1; k >= 0 && runs[k].start+runs[k].n == cl {
+			runs[k].n++
+		} else {
+			runs = append(runs, clusterRun{cl, 1})
+		}
+	}
+
+	chunk := uint32(max((1<<20)/v.clusterBytes(), 1))
+	move := func(first, n uint32) error {
+		src := v.clusterSector(first)
+		data, err := v.read(src, uint64(n)*v.csize)
+		if err != nil {
+			return err
+		}
+		return v.write(uint64(int64(src)+shift), data)
+	}
+	if shift > 0 {
+		for i := len(runs) - 1; i >= 0; i-- {
+			for end := runs[i].start + runs[i].n; end > runs[i].start; {
+				n := min(chunk, end-runs[i].start)
+				if err := move(end-n, n); err != nil {
+					return err
+				}
+				end -= n
+			}
+		}
+		return nil
+	}
+	for _, run := range runs {
+		for first := run.start; first < run.start+run.n; {
+			n := min(chunk, run.start+run.n-first)
+			if err := move(first, n); err != nil {
+				return err
+			}
+			first += n
+		}
+	}
+	return nil
+}
+
+// placeBitmap fits the exFAT allocation bitmap to nclst clusters. The
+// bitmap must be contiguous and, as FatFs finds it by its first cluster,
+// below cluster nclst+2; if its clusters do not do, it is copied to a free
+// run that does. The bitmap is written out by writeBitmap.
+func (r *resizer) placeBitmap(nclst uint32) error {
+	v, d := r.v, r.d
+	size := (uint64(nclst) + 7) / 8
+	need := int(r.bitmapClusters(uint64(nclst)))
+	end := nclst + 2
+
+	// bits for clusters beyond the current end are free
+	for i := uint64(v.nclst); i < uint64(len(d.bitmap))*8; i++ {
+		d.bitmap[i/8] &^= 1 << (i % 8)
+	}
+	if want := need * int(v.clusterBytes()); len(d.bitmap) < want {
+		d.bitmap = append(d.bitmap, make([]byte, want-len(d.bitmap))...)
+	}
+
+	old := d.bitmapClusters
+	fits := len(old) >= need && countExtents(old[:need]) == 1 && old[need-1] < end
+	if fits {
+		// free the clusters the bitmap no longer needs
+		for _, cl := range old[need:] {
+			v.setFATEntry(cl, 0)
+			d.owner[cl] = 0
+			r.setBit(cl, false)
+		}
+		if len(old) > need {
+			v.setFATEntry(old[need-1], v.eoc())
+		}
+		d.bitmapClusters = old[:need]
+	} else {
+		start, ok := r.freeRun(uint32(need), end)
+		if !ok {
+			return fmt.Errorf("no room for an allocation bitmap of %d clusters", need)
+		}
+		d.bitmapClusters = contiguous(start, uint64(need))
+		for k, cl := range d.bitmapClusters {
+			d.owner[cl] = -1
+			r.setBit(cl, true)
+			if k == need-1 {
+				v.setFATEntry(cl, v.eoc())
+			} else {
+				v.setFATEntry(cl, cl+1)
+			}
+		}
+		if err := r.writeBitmap(); err != nil {
+			return err
+		}
+		for _, cl := range old {
+			v.setFATEntry(cl, 0)
+			if cl < uint32(len(d.owner)) {
+				d.owner[cl] = 0
+			}
+			if uint64(cl-2) < uint64(len(d.bitmap))*8 {
+				r.setBit(cl, false)
+			}
+		}
+	}
+	if err := v.flushFAT(); err != nil {
+		return err
+	}
+	v.bitmapCluster, v.bitmapSize = d.bitmapClusters[0], size
+	return r.writeBitmapEntry()
+}
+
+func (r *resizer) setBit(cl uint32, used bool) {
+	i := cl - 2
+	if used {
+		r.d.bitmap[i/8] |= 1 << (i % 8)
+	} else {
+		r.d.bitmap[i/8] &^= 1 << (i % 8)
+	}
+}
+
+// freeRun returns the first run of n free clusters below end.
+func (r *resizer) freeRun(n, end uint32) (uint32, bool) {
+	var length uint32
+	for cl := uint32(2); cl < end; cl++ {
+		if r.d.owner[cl] != 0 {
+			length = 0
+			continue
+		}
+		if length++; length == n {
+			return cl - n + 1, true
+		}
+	}
+	return 0, false
+}
+
+// writeBitmap writes the exFAT allocation bitmap out, clearing the bits
+// beyond the last cluster.
+func (r *resizer) writeBitmap() error {
+	v, d := r.v, r.d
+	data := d.bitmap[:uint64(len(d.bitmapClusters))*v.clusterBytes()]
+	for i := uint64(v.nclst); i < uint64(len(data))*8; i++ {
+		data[i/8] &^= 1 << (i % 8)
+	}
+	for k, cl := range d.bitmapClusters {
+		cb := v.clusterBytes()
+		if err := v.write(v.clusterSector(cl), data[uint64(k)*cb:uint64(k+1)*cb]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBitmapEntry records the location and size of the allocation bitmap
+// in the root directory.
+func (r *resizer) writeBitmapEntry() error {
+	v := r.v
+	clusters, err := v.chain(v.rootCluster)
+	if err != nil {
+		return err
+	}
+	dir, err := v.readDir(v.clusterSectors(clusters))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < dir.entries(); i++ {
+		if ent := dir.entry(i); ent[0] == exfatBitmap && ent[1]&1 == 0 {
+			binary.LittleEndian.PutUint32(ent[20:], v.bitmapCluster)
+			binary.LittleEndian.PutUint64(ent[24:], v.bitmapSize)
+			dir.dirty = true
+			break
+		}
+	}
+	return v.writeDir(dir)
+}
+
+// writeFSInfo stores the free cluster count in the FAT32 FSInfo sector and
+// its backup, and drops the next free cluster hint.
+func (r *resizer) writeFSInfo(free uint32) error {
+	v := r.v
+	if v.fsinfo == 0 {
+		return nil
+	}
+	fsi, err := v.read(v.fsinfo, 1)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(fsi[0:]) != 0x41615252 {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(fsi[488:], free)
+	binary.LittleEndian.PutUint32(fsi[492:], 0xFFFFFFFF)
+	if err := v.write(v.fsinfo, fsi); err != nil {
+		return err
+	}
+	boot, err := v.read(v.base, 1)
+	if err != nil {
+		return err
+	}
+	if backup := uint64(binary.LittleEndian.Uint16(boot[50:])); backup != 0 && backup != 0xFFFF {
+		return v.write(v.base+backup+(v.fsinfo-v.base), fsi)
+	}
+	return nil
+}
+
+// volumeSlot is the room a volume has on its device.
+type volumeSlot struct {
+	// table is 0 for a device without a partition table, 1 for MBR and 2
+	// for GPT; entry is the index of the volume's partition entry.
+	table int
+	entry int
+	// limit is the largest size of the volume, othersEnd the end of the
+	// other partitions and trailer the sectors the partition table needs
+	// at the end of the device.
+	limit     uint64
+	othersEnd uint64
+	trailer   uint64
+}
+
+const (
+	tableNone = iota
+	tableMBR
+	tableGPT
+)
+
+// findSlot finds the partition holding the volume and how far it can grow:
+// up to the next partition or the end of the device, less the room of the
+// backup GPT.
+func (v *volume) findSlot() (*volumeSlot, error) {
+	devSectors := v.dev.GetSectorCount()
+	mbr, err := v.read(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if v.base == 0 || checkBootSector(mbr) != 2 {
+		return &volumeSlot{limit: devSectors - v.base}, nil
+	}
+
+	slot := &volumeSlot{table: tableMBR, entry: -1}
+	type extent struct{ start, end uint64 }
+	var others []extent
+	end := devSectors
+	if mbr[mbrTable+4] == 0xEE {
+		slot.table = tableGPT
+		hdr, table, esize, err := v.readGPTTable()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(binary.LittleEndian.Uint32(hdr[80:]))
+		slot.trailer = (n*esize+v.ssize-1)/v.ssize + 1
+		end = devSectors - slot.trailer
+		for i := uint64(0); i < n; i++ {
+			ent := table[i*esize:]
+			if isZero(ent[:16]) {
+				continue
+			}
+			first := binary.LittleEndian.Uint64(ent[32:])
+			last := binary.LittleEndian.Uint64(ent[40:])
+			if first == v.base {
+				slot.entry = int(i)
+			} else {
+				others = append(others, extent{first, last + 1})
+			}
+		}
+	} else {
+		end = min(end, 0xFFFFFFFF)
+		for i := 0; i < 4; i++ {
+			ent := mbr[mbrTable+i*partEntSize:]
+			if ent[4] == 0 {
+				continue
+			}
+			first := uint64(binary.LittleEndian.Uint32(ent[8:]))
+			size := uint64(binary.LittleEndian.Uint32(ent[12:]))
+			if first == v.base {
+				slot.entry = i
+			} else {
+				others = append(others, extent{first, first + size})
+			}
+		}
+	}
+	if slot.entry < 0 {
+		return nil, fmt.Errorf("no partition entry starts at sector %d", v.base)
+	}
+	for _, o := range others {
+		if o.start > v.base {
+			end = min(end, o.start)
+		}
+		slot.othersEnd = max(slot.othersEnd, o.end)
+	}
+	if end < v.base {
+		return nil, errors.New("the partition table leaves no room for the volume")
+	}
+	slot.limit = end - v.base
+	return slot, nil
+}
+
+// readGPTTable reads the primary GPT header and partition entry array.
+func (v *volume) readGPTTable() (hdr, table []byte, esize uint64, err error) {
+	if hdr, err = v.read(1, 1); err != nil {
+		return nil, nil, 0, err
+	}
+	if !bytes.Equal(hdr[:8], []byte("EFI PART")) {
+		return nil, nil, 0, errors.New("bad GPT header")
+	}
+	n := uint64(binary.LittleEndian.Uint32(hdr[80:]))
+	esize = uint64(binary.LittleEndian.Uint32(hdr[84:]))
+	if esize < 128 || esize > v.ssize || v.ssize%esize != 0 {
+		return nil, nil, 0, fmt.Errorf("bad GPT entry size %d", esize)
+	}
+	table, err = v.read(binary.LittleEndian.Uint64(hdr[72:]), (n*esize+v.ssize-1)/v.ssize)
+	return hdr, table, esize, err
+}
+
+// setSlot sets the size of the volume's partition to sectors. On GPT
+// devices the backup GPT is rewritten at the end of the device.
+func (r *resizer) setSlot(sectors uint64) error {
+	v, slot := r.v, r.slot
+	switch slot.table {
+	case tableMBR:
+		mbr, err := v.read(0, 1)
+		if err != nil {
+			return err
+		}
+		ent := mbr[mbrTable+slot.entry*partEntSize:]
+		binary.LittleEndian.PutUint32(ent[12:], uint32(sectors))
+		// the end is beyond what CHS can address for all but tiny disks,
+		// mark it so as partitioning tools do
+		copy(ent[5:8], []byte{0xFE, 0xFF, 0xFF})
+		return v.write(0, mbr)
+	case tableGPT:
+		return r.setGPTSlot(sectors)
+	}
+	return nil
+}
+
+func (r *resizer) setGPTSlot(sectors uint64) error {
+	v, slot := r.v, r.slot
+	hdr, table, esize, err := v.readGPTTable()
+	if err != nil {
+		return err
+	}
+	devSectors := v.dev.GetSectorCount()
+	n := uint64(binary.LittleEndian.Uint32(hdr[80:]))
+	tableSectors := slot.trailer - 1
+	backupHdr := devSectors - 1
+	backupTable := backupHdr - tableSectors
+	oldBackup := binary.LittleEndian.Uint64(hdr[32:])
+
+	ent := table[uint64(slot.entry)*esize:]
+	binary.LittleEndian.PutUint64(ent[40:], v.base+sectors-1)
+	binary.LittleEndian.PutUint32(hdr[88:], crc32.ChecksumIEEE(table[:n*esize]))
+	binary.LittleEndian.PutUint64(hdr[32:], backupHdr)
+	binary.LittleEndian.PutUint64(hdr[48:], backupTable-1)
+	setGPTHeaderSum(hdr)
+
+	backup := bytes.Clone(hdr)
+	binary.LittleEndian.PutUint64(backup[24:], backupHdr)
+	binary.LittleEndian.PutUint64(backup[32:], 1)
+	binary.LittleEndian.PutUint64(backup[72:], backupTable)
+	setGPTHeaderSum(backup)
+
+	if err := v.write(binary.LittleEndian.Uint64(hdr[72:]), table); err != nil {
+		return err
+	}
+	if err := v.write(1, hdr); err != nil {
+		return err
+	}
+	if err := v.write(backupTable, table); err != nil {
+		return err
+	}
+	if err := v.write(backupHdr, backup); err != nil {
+		return err
+	}
+	if oldBackup != backupHdr && oldBackup > 1 && oldBackup < devSectors {
+		// a stale backup header would confuse tools looking for one
+		if err := v.write(oldBackup, make([]byte, v.ssize)); err != nil {
+			return err
+		}
+	}
+
+	// the protective MBR covers the whole device
+	mbr, err := v.read(0, 1)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(mbr[mbrTable+12:], uint32(min(devSectors-1, 0xFFFFFFFF)))
+	return v.write(0, mbr)
+}
+
+// setGPTHeaderSum recomputes the checksum of a GPT header.
+func setGPTHeaderSum(hdr []byte) {
+	size := binary.LittleEndian.Uint32(hdr[12:])
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:size]))
+}
@@ -0,0 +1,272 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"fmt"
+	iofs "io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// testTree returns a small tree of directories and files of varied sizes
+// whose contents tell them apart.
+func testTree() fstest.MapFS {
+	tree := fstest.MapFS{}
+	for i := range 24 {
+		name := fmt.Sprintf("dir%d/file%02d.bin", i%3, i)
+		if i%4 == 0 {
+			name = fmt.Sprintf("dir%d/sub/long file name %02d.dat", i%3, i)
+		}
+		tree[name] = &fstest.MapFile{Data: bytes.Repeat([]byte{byte(i), byte(i >> 8), 0x5A}, 700*i+i*i*97)}
+	}
+	tree["top.txt"] = &fstest.MapFile{Data: []byte("top level\n")}
+	return tree
+}
+
+// checkTree fails t unless the volume on dev is clean and holds every file
+// of tree with its contents.
+func checkTree(t *testing.T, dev fatfs.BlockDevice, tree fstest.MapFS) {
+	t.Helper()
+	report, err := fatfs.Check(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("check: %v", report.Problems)
+	}
+
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Unmount()
+	for name, f := range tree {
+		got, err := iofs.ReadFile(fatfs.AsIO(fs), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, f.Data) {
+			t.Errorf("%s: contents differ after %d of %d bytes", name, commonPrefix(got, f.Data), len(f.Data))
+		}
+	}
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// grow returns a copy of dev enlarged to size bytes.
+func grow(dev *fatfs.MemDevice, size int64) *fatfs.MemDevice {
+	data := make([]byte, size)
+	copy(data, dev.Bytes())
+	return fatfs.NewMemDeviceFromBytes(data)
+}
+
+var resizeTests = []struct {
+	name   string
+	format fatfs.FormatOptions
+	// size is the device the tree is built on, FAT32 needing enough
+	// clusters to stay FAT32 at the minimum
+	size int64
+}{
+	{"fat32", fatfs.FormatOptions{Type: fatfs.TypeFAT32, ClusterSize: 512}, 40 << 20},
+	{"fat32-nopart", fatfs.FormatOptions{Type: fatfs.TypeFAT32, ClusterSize: 512, NoPartitionTable: true}, 40 << 20},
+	{"exfat", fatfs.FormatOptions{Type: fatfs.TypeEXFAT, ClusterSize: 4096}, 8 << 20},
+	{"exfat-nopart", fatfs.FormatOptions{Type: fatfs.TypeEXFAT, ClusterSize: 4096, NoPartitionTable: true}, 8 << 20},
+}
+
+func TestResizeGrow(t *testing.T) {
+	tree := testTree()
+	for _, tc := range resizeTests {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := fatfs.NewMemDevice(tc.size)
+			if err := fatfs.BuildImage(dev, tree, &fatfs.BuildOptions{Format: tc.format}); err != nil {
+				t.Fatal(err)
+			}
+			before, err := fatfs.ResizeLimits(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.format.NoPartitionTable != (before.Start == 0) {
+				t.Fatalf("volume starts at sector %d", before.Start)
+			}
+
+			report, err := fatfs.Check(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusters := report.Clusters
+
+			dev = grow(dev, 2*tc.size)
+			if err := fatfs.Resize(dev, 0, nil); err != nil {
+				t.Fatal(err)
+			}
+			after, err := fatfs.ResizeLimits(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Start != before.Start || after.Sectors != after.Max || after.Sectors <= before.Sectors {
+				t.Fatalf("grown from %+v to %+v", before, after)
+			}
+			checkTree(t, dev, tree)
+			report, err = fatfs.Check(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Clusters <= clusters {
+				t.Errorf("%d clusters after growing, %d before", report.Clusters, clusters)
+			}
+		})
+	}
+}
+
+func TestResizeShrink(t *testing.T) {
+	tree := testTree()
+	for _, tc := range resizeTests {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := fatfs.NewMemDevice(2 * tc.size)
+			if err := fatfs.BuildImage(dev, tree, &fatfs.BuildOptions{Format: tc.format}); err != nil {
+				t.Fatal(err)
+			}
+			// spread files over the whole volume, so that shrinking has
+			// clusters to move
+			tree := cloneTree(tree)
+			spread(t, dev, tree)
+
+			rng, err := fatfs.ResizeLimits(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rng.Min >= rng.Sectors {
+				t.Fatalf("cannot shrink: %+v", rng)
+			}
+			if last := lastSector(t, dev, tree); last <= rng.Start+rng.Min {
+				t.Fatalf("no data beyond the new end: last sector %d, new end %d", last, rng.Start+rng.Min)
+			}
+			if err := fatfs.Resize(dev, rng.Min, nil); err != nil {
+				t.Fatal(err)
+			}
+			after, err := fatfs.ResizeLimits(dev, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Sectors != rng.Min {
+				t.Fatalf("shrunk to %d sectors, want %d", after.Sectors, rng.Min)
+			}
+			checkTree(t, dev, tree)
+
+			// the image can be cut to the reported size
+			cut := fatfs.NewMemDeviceFromBytes(bytes.Clone(dev.Bytes()[:after.DeviceMin*fatfs.SectorSize]))
+			checkTree(t, cut, tree)
+		})
+	}
+}
+
+func cloneTree(tree fstest.MapFS) fstest.MapFS {
+	c := fstest.MapFS{}
+	for name, f := range tree {
+		c[name] = f
+	}
+	return c
+}
+
+// mounted calls fn with the volume on dev mounted.
+func mounted(t *testing.T, dev fatfs.BlockDevice, fn func(fs *fatfs.FatFs)) {
+	t.Helper()
+	fs, err := fatfs.NewFatFs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mount(dev); err != nil {
+		t.Fatal(err)
+	}
+	fn(fs)
+	if err := fs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spread fills the volume on dev with files, then removes all but every
+// eighth, and adds those kept to tree.
+func spread(t *testing.T, dev fatfs.BlockDevice, tree fstest.MapFS) {
+	t.Helper()
+	mounted(t, dev, func(fs *fatfs.FatFs) {
+		if err := fs.Mkdir("spread", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("spread/%04d.bin", i)
+			data := bytes.Repeat([]byte{byte(i), byte(i >> 8)}, 32<<10)
+			f, err := fs.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				// the volume is full
+				break
+			}
+			names = append(names, name)
+			if i%8 == 0 {
+				tree[name] = &fstest.MapFile{Data: data}
+			}
+		}
+		for _, name := range names {
+			if _, ok := tree[name]; !ok {
+				if err := fs.Remove(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		// the last file may be short
+		if err := fs.Remove(fmt.Sprintf("spread/%04d.bin", len(names))); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// lastSector returns the sector after the last data sector of the files of
+// tree on dev.
+func lastSector(t *testing.T, dev fatfs.BlockDevice, tree fstest.MapFS) uint64 {
+	t.Helper()
+	var last uint64
+	mounted(t, dev, func(fs *fatfs.FatFs) {
+		for name := range tree {
+			x, err := fs.Extents(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range x.Extents {
+				last = max(last, e.Sector+e.Sectors)
+			}
+		}
+	})
+	return last
+}
+
+func writeFile(t *testing.T, fs *fatfs.FatFs, name string, data []byte) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package fatfs
+
+/*
+#include <stdlib.h>
+#include "ff.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// ShortNameMode controls how the short (8.3) names of new files and
+// directories are made on FAT volumes. exFAT has no short names.
+type ShortNameMode uint8
+
+const (
+	// ShortNameTail gives every name that does not fit 8.3 a numeric tail,
+	// as Windows does: "Long name.txt" gets LONGNA~1.TXT. This is the
+	// default.
+	ShortNameTail ShortNameMode = C.SFN_TAIL
+	// ShortNameNoTail truncates names that do not fit 8.3 and only adds a
+	// numeric tail if the truncated name is taken, like the nonumtail
+	// option of Linux: "Long name.txt" gets LONGNA.TXT.
+	ShortNameNoTail ShortNameMode = C.SFN_NOTAIL
+	// ShortNameOnly creates no long names at all, for loaders that only
+	// read 8.3 names. Names must fit 8.3; they are stored in upper case.
+	ShortNameOnly ShortNameMode = C.SFN_ONLY
+)
+
+func (m ShortNameMode) String() string {
+	switch m {
+	case ShortNameTail:
+		return "tail"
+	case ShortNameNoTail:
+		return "notail"
+	case ShortNameOnly:
+		return "only"
+	}
+	return fmt.Sprintf("ShortNameMode(%d)", uint8(m))
+}
+
+// ParseShortNameMode parses the names returned by ShortNameMode.String.
+func ParseShortNameMode(s string) (ShortNameMode, error) {
+	for _, m := range []ShortNameMode{ShortNameTail, ShortNameNoTail, ShortNameOnly} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid short name mode %q", s)
+}
+
+var (
+	shortNameMu    sync.RWMutex
+	shortNameModes = make(map[uint8]ShortNameMode)
+)
+
+func setDriveShortNames(pdrv uint8, mode ShortNameMode) {
+	shortNameMu.Lock()
+	defer shortNameMu.Unlock()
+	if mode == ShortNameTail {
+		delete(shortNameModes, pdrv)
+	} else {
+		shortNameModes[pdrv] = mode
+	}
+}
+
+// SetShortNameMode sets how short names of new files and directories are
+// made. It applies until the volume is unmounted. In ShortNameOnly mode
+// creating a file whose name does not fit 8.3 fails with
+// FileResultInvalidName.
+func (f *FatFs) SetShortNameMode(mode ShortNameMode) {
+	setDriveShortNames(f.volNumber, mode)
+}
+
+// ShortName returns the short name of the file name, or the one it would
+// get if it was created now. Short names are upper case and limited to the
+// characters of the volume's code page; on exFAT it returns an empty name.
+//
+// Files can be opened by their short name as well as by their long one.
+func (f *FatFs) ShortName(name string) (string, error) {
+	Logger.Println("CALL ShortName", name)
+	cpath := C.CString(f.fatPath(name))
+	defer C.free(unsafe.Pointer(cpath))
+
+	var sfn [C.FF_SFN_BUF + 1]C.TCHAR
+	err := errval(C.f_shortname(cpath, &sfn[0]))
+	if errors.Is(err, FileResultExist) {
+		info, err := f.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		return info.Sys().(*FileStat).ShortName, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return C.GoString(&sfn[0]), nil
+}
+
+//export Go_shortNameMode
+func Go_shortNameMode(pdrv C.BYTE) C.BYTE {
+	shortNameMu.RLock()
+	defer shortNameMu.RUnlock()
+	return C.BYTE(shortNameModes[uint8(pdrv)])
+}
@@ -0,0 +1,504 @@
+package fatfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceOp is the kind of device operation in a trace.
+type TraceOp string
+
+const (
+	TraceRead  TraceOp = "read"
+	TraceWrite TraceOp = "write"
+	TraceSync  TraceOp = "sync"
+)
+
+// TraceRecord is one traced device operation.
+type TraceRecord struct {
+	// Offset is the time since the trace started at which the operation
+	// was issued.
+	Offset   time.Duration `json:"t"`
+	Op       TraceOp       `json:"op"`
+	Sector   uint64        `json:"sector,omitempty"`
+	Count    uint32        `json:"count,omitempty"`
+	Duration time.Duration `json:"dur"`
+	// Caller is the FatFs or FatFile method that caused the operation, e.g.
+	// "FatFile.ReadAt", and Func the FatFs C function it called, e.g.
+	// "f_read". Both are empty if the device was used directly.
+	Caller string `json:"caller,omitempty"`
+	Func   string `json:"func,omitempty"`
+	Err    string `json:"err,omitempty"`
+	// Data holds the written sectors when the trace records data.
+	Data []byte `json:"data,omitempty"`
+}
+
+// TraceFormat selects the encoding of a trace.
+type TraceFormat int
+
+const (
+	// TraceJSONL writes one JSON object per line, easy to inspect and
+	// process with jq.
+	TraceJSONL TraceFormat = iota
+	// TraceBinary is a compact varint encoding, suited to long traces and
+	// traces with data.
+	TraceBinary
+)
+
+// TraceOptions controls what a TracingDevice writes.
+type TraceOptions struct {
+	Format TraceFormat
+	// Data records the contents of every write, which ReplayTrace needs to
+	// replay writes.
+	Data bool
+}
+
+// assert that TracingDevice implements the BlockDevice and Syncer interfaces
+var (
+	_ BlockDevice = (*TracingDevice)(nil)
+	_ Syncer      = (*TracingDevice)(nil)
+)
+
+// TracingDevice wraps a BlockDevice and logs every read, write and sync to
+// a trace, with the time taken and the operation that caused it.
+type TracingDevice struct {
+	dev   BlockDevice
+	start time.Time
+	data  bool
+
+	mu  sync.Mutex
+	enc traceEncoder
+	err error
+}
+
+// NewTracingDevice traces operations on dev to w. Call Flush (or Close)
+// when done, the trace is buffered.
+func NewTracingDevice(dev BlockDevice, w io.Writer, opts *TraceOptions) *TracingDevice {
+	if opts == nil {
+		opts = &TraceOptions{}
+	}
+	t := &TracingDevice{dev: dev, start: time.Now(), data: opts.Data}
+	bw := bufio.NewWriter(w)
+	if opts.Format == TraceBinary {
+		t.enc = newBinaryTraceEncoder(bw)
+	} else {
+		t.enc = &jsonTraceEncoder{w: bw, enc: json.NewEncoder(bw)}
+	}
+	return t
+}
+
+// Flush writes buffered records out and returns the first error hit while
+// writing the trace.
+func (t *TracingDevice) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.flush(); err != nil && t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// Close flushes the trace. The wrapped device and writer are left open.
+func (t *TracingDevice) Close() error {
+	return t.Flush()
+}
+
+func (t *TracingDevice) record(op TraceOp, sector uint64, count uint32, data []byte, begin time.Time, err error) {
+	rec := TraceRecord{
+		Offset:   begin.Sub(t.start),
+		Op:       op,
+		Sector:   sector,
+		Count:    count,
+		Duration: time.Since(begin),
+	}
+	rec.Caller, rec.Func = traceCaller()
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if t.data && op == TraceWrite {
+		rec.Data = data
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.enc.encode(&rec)
+	}
+}
+
+// traceCaller finds the FatFs C function on the stack and the Go method
+// that called it.
+func traceCaller() (caller, cfunc string) {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if i := strings.Index(frame.Function, "._Cfunc_"); i >= 0 {
+			cfunc = frame.Function[i+len("._Cfunc_"):]
+		} else if cfunc != "" {
+			caller = frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+			caller = strings.TrimPrefix(caller, "fatfs.")
+			caller = strings.NewReplacer("(*", "", ")", "").Replace(caller)
+			// drop closure suffixes such as ".func1"
+			if i := strings.Index(caller, ".func"); i >= 0 {
+				caller = caller[:i]
+			}
+			return caller, cfunc
+		}
+		if !more {
+			return "", cfunc
+		}
+	}
+}
+
+// Initialize initializes the wrapped device.
+func (t *TracingDevice) Initialize() error {
+	return t.dev.Initialize()
+}
+
+// Status reports the status of the wrapped device.
+func (t *TracingDevice) Status() error {
+	return t.dev.Status()
+}
+
+// ReadSectors reads from the wrapped device and traces the read.
+func (t *TracingDevice) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	begin := time.Now()
+	err := t.dev.ReadSectors(sector, count, buff)
+	t.record(TraceRead, sector, count, nil, begin, err)
+	return err
+}
+
+// WriteSectors writes to the wrapped device and traces the write.
+func (t *TracingDevice) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	begin := time.Now()
+	err := t.dev.WriteSectors(sector, count, buff)
+	t.record(TraceWrite, sector, count, buff[:int(count)*int(t.dev.GetSectorSize())], begin, err)
+	return err
+}
+
+// Sync syncs the wrapped device, if it supports it, and traces the call.
+func (t *TracingDevice) Sync() error {
+	begin := time.Now()
+	var err error
+	if syncer, ok := t.dev.(Syncer); ok {
+		err = syncer.Sync()
+	}
+	t.record(TraceSync, 0, 0, nil, begin, err)
+	return err
+}
+
+// GetSectorSize returns the sector size of the wrapped device.
+func (t *TracingDevice) GetSectorSize() uint64 {
+	return t.dev.GetSectorSize()
+}
+
+// GetSectorCount returns the sector count of the wrapped device.
+func (t *TracingDevice) GetSectorCount() uint64 {
+	return t.dev.GetSectorCount()
+}
+
+type traceEncoder interface {
+	encode(rec *TraceRecord) error
+	flush() error
+}
+
+type jsonTraceEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonTraceEncoder) encode(rec *TraceRecord) error {
+	return e.enc.Encode(rec)
+}
+
+func (e *jsonTraceEncoder) flush() error {
+	return e.w.Flush()
+}
+
+// The binary trace starts with traceMagic, followed by records of the form
+//
+//	op byte, then uvarints: offset ns, duration ns, sector, count, caller
+//	id, func id, error length, data length, then the error and data bytes
+//
+// Caller and function names are interned: the first time a name is used it
+// is preceded by a traceOpName record holding the id and the name.
+var traceMagic = []byte("GOFATTR1")
+
+const (
+	traceOpName = 'N'
+
+	traceOpRead  = 'r'
+	traceOpWrite = 'w'
+	traceOpSync  = 's'
+)
+
+type binaryTraceEncoder struct {
+	w     *bufio.Writer
+	names map[string]uint64
+	buf   []byte
+	err   error
+}
+
+func newBinaryTraceEncoder(w *bufio.Writer) *binaryTraceEncoder {
+	_, err := w.Write(traceMagic)
+	return &binaryTraceEncoder{w: w, names: map[string]uint64{"": 0}, err: err}
+}
+
+func (e *binaryTraceEncoder) intern(name string) uint64 {
+	if id, ok := e.names[name]; ok {
+		return id
+	}
+	id := uint64(len(e.names))
+	e.names[name] = id
+	e.buf = append(e.buf[:0], traceOpName)
+	e.buf = binary.AppendUvarint(e.buf, id)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(name)))
+	e.buf = append(e.buf, name...)
+	e.w.Write(e.buf)
+	return id
+}
+
+func (e *binaryTraceEncoder) encode(rec *TraceRecord) error {
+	if e.err != nil {
+		return e.err
+	}
+	var op byte
+	switch rec.Op {
+	case TraceRead:
+		op = traceOpRead
+	case TraceWrite:
+		op = traceOpWrite
+	case TraceSync:
+		op = traceOpSync
+	}
+	caller, cfunc := e.intern(rec.Caller), e.intern(rec.Func)
+
+	e.buf = append(e.buf[:0], op)
+	e.buf = binary.AppendUvarint(e.buf, uint64(rec.Offset))
+	e.buf = binary.AppendUvarint(e.buf, uint64(rec.Duration))
+	e.buf = binary.AppendUvarint(e.buf, rec.Sector)
+	e.buf = binary.AppendUvarint(e.buf, uint64(rec.Count))
+	e.buf = binary.AppendUvarint(e.buf, caller)
+	e.buf = binary.AppendUvarint(e.buf, cfunc)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(rec.Err)))
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(rec.Data)))
+	e.buf = append(e.buf, rec.Err...)
+	e.buf = append(e.buf, rec.Data...)
+	_, e.err = e.w.Write(e.buf)
+	return e.err
+}
+
+func (e *binaryTraceEncoder) flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// TraceReader decodes a trace written by a TracingDevice, in either format.
+type TraceReader struct {
+	r      *bufio.Reader
+	binary bool
+	names  []string
+}
+
+// NewTraceReader detects the trace format and prepares to decode it.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	tr := &TraceReader{r: bufio.NewReader(r), names: []string{""}}
+	magic, err := tr.r.Peek(len(traceMagic))
+	if err == nil && bytes.Equal(magic, traceMagic) {
+		tr.binary = true
+		tr.r.Discard(len(traceMagic))
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the trace.
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+	if !tr.binary {
+		line, err := tr.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err == nil {
+				return tr.Next()
+			}
+			return nil, err
+		}
+		var rec TraceRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("bad trace record: %w", err)
+		}
+		return &rec, nil
+	}
+
+	for {
+		op, err := tr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if op == traceOpName {
+			id, name, err := tr.readName()
+			if err != nil {
+				return nil, err
+			}
+			if id != uint64(len(tr.names)) {
+				return nil, errors.New("bad trace: names out of order")
+			}
+			tr.names = append(tr.names, name)
+			continue
+		}
+		return tr.readRecord(op)
+	}
+}
+
+func (tr *TraceReader) readName() (uint64, string, error) {
+	id, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return 0, "", unexpectedEOF(err)
+	}
+	n, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return 0, "", unexpectedEOF(err)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(tr.r, name); err != nil {
+		return 0, "", unexpectedEOF(err)
+	}
+	return id, string(name), nil
+}
+
+func (tr *TraceReader) readRecord(op byte) (*TraceRecord, error) {
+	rec := &TraceRecord{}
+	switch op {
+	case traceOpRead:
+		rec.Op = TraceRead
+	case traceOpWrite:
+		rec.Op = TraceWrite
+	case traceOpSync:
+		rec.Op = TraceSync
+	default:
+		return nil, fmt.Errorf("bad trace: unknown record type %q", op)
+	}
+
+	var v [8]uint64
+	for i := range v {
+		var err error
+		if v[i], err = binary.ReadUvarint(tr.r); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	if v[4] >= uint64(len(tr.names)) || v[5] >= uint64(len(tr.names)) {
+		return nil, errors.New("bad trace: unknown name id")
+	}
+	rec.Offset = time.Duration(v[0])
+	rec.Duration = time.Duration(v[1])
+	rec.Sector = v[2]
+	rec.Count = uint32(v[3])
+	rec.Caller = tr.names[v[4]]
+	rec.Func = tr.names[v[5]]
+
+	msg := make([]byte, v[6])
+	if _, err := io.ReadFull(tr.r, msg); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	rec.Err = string(msg)
+	if v[7] > 0 {
+		rec.Data = make([]byte, v[7])
+		if _, err := io.ReadFull(tr.r, rec.Data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	return rec, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReplayOptions controls ReplayTrace.
+type ReplayOptions struct {
+	// Timing sleeps between operations to reproduce the original pacing.
+	Timing bool
+	// SkipWrites replays only reads and syncs. Without it, a trace that did
+	// not record data cannot be replayed if it contains writes.
+	SkipWrites bool
+}
+
+// ReplayStats summarises a replayed trace.
+type ReplayStats struct {
+	Reads, Writes, Syncs int
+	// Errors counts operations that failed during the replay.
+	Errors int
+	// Time is the total time spent in device operations.
+	Time time.Duration
+}
+
+// ReplayTrace runs the operations of a trace against dev, e.g. to time an
+// access pattern on different storage or to reproduce a field bug offline.
+func ReplayTrace(r io.Reader, dev BlockDevice, opts *ReplayOptions) (*ReplayStats, error) {
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+	tr, err := NewTraceReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ReplayStats{}
+	start := time.Now()
+	var buf []byte
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+
+		if opts.Timing {
+			time.Sleep(rec.Offset - time.Since(start))
+		}
+
+		begin := time.Now()
+		switch rec.Op {
+		case TraceRead:
+			if need := int(rec.Count) * int(dev.GetSectorSize()); len(buf) < need {
+				buf = make([]byte, need)
+			}
+			err = dev.ReadSectors(rec.Sector, rec.Count, buf)
+			stats.Reads++
+		case TraceWrite:
+			if opts.SkipWrites {
+				continue
+			}
+			if len(rec.Data) == 0 && rec.Count > 0 {
+				return stats, errors.New("trace has writes without data, record it with data or skip writes")
+			}
+			err = dev.WriteSectors(rec.Sector, rec.Count, rec.Data)
+			stats.Writes++
+		case TraceSync:
+			if syncer, ok := dev.(Syncer); ok {
+				err = syncer.Sync()
+			}
+			stats.Syncs++
+		}
+		stats.Time += time.Since(begin)
+		if err != nil {
+			stats.Errors++
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"strings"
+	"testing"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+var traceFormats = []struct {
+	name   string
+	format fatfs.TraceFormat
+}{
+	{"jsonl", fatfs.TraceJSONL},
+	{"binary", fatfs.TraceBinary},
+}
+
+func readTrace(t *testing.T, trace []byte) []*fatfs.TraceRecord {
+	t.Helper()
+	tr, err := fatfs.NewTraceReader(bytes.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []*fatfs.TraceRecord
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			return recs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// traceWorkload changes the volume on dev through a TracingDevice and
+// returns the trace.
+func traceWorkload(t *testing.T, dev fatfs.BlockDevice, opts *fatfs.TraceOptions) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tracer := fatfs.NewTracingDevice(dev, &buf, opts)
+	mounted(t, tracer, func(fs *fatfs.FatFs) {
+		writeFile(t, fs, "dir1/added.bin", bytes.Repeat([]byte("added"), 3000))
+		if _, err := iofs.ReadFile(fatfs.AsIO(fs), "dir2/file23.bin"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Remove("top.txt"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Records written in either format decode to what was traced.
+func TestTraceFormats(t *testing.T) {
+	for _, tf := range traceFormats {
+		t.Run(tf.name, func(t *testing.T) {
+			dev := fatfs.NewMemDevice(64 << 10)
+			var buf bytes.Buffer
+			tracer := fatfs.NewTracingDevice(dev, &buf, &fatfs.TraceOptions{Format: tf.format, Data: true})
+			data := append(sectorData(0xA1), sectorData(0xA2)...)
+			sector := make([]byte, 512)
+			if err := tracer.WriteSectors(5, 2, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := tracer.ReadSectors(6, 1, sector); err != nil {
+				t.Fatal(err)
+			}
+			if err := tracer.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			rerr := tracer.ReadSectors(128, 1, sector)
+			if rerr == nil {
+				t.Fatal("read beyond the device succeeded")
+			}
+			if err := tracer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := []fatfs.TraceRecord{
+				{Op: fatfs.TraceWrite, Sector: 5, Count: 2, Data: data},
+				{Op: fatfs.TraceRead, Sector: 6, Count: 1},
+				{Op: fatfs.TraceSync},
+				{Op: fatfs.TraceRead, Sector: 128, Count: 1, Err: rerr.Error()},
+			}
+			recs := readTrace(t, buf.Bytes())
+			if len(recs) != len(want) {
+				t.Fatalf("got %d records, want %d", len(recs), len(want))
+			}
+			for i, rec := range recs {
+				w := want[i]
+				if rec.Op != w.Op || rec.Sector != w.Sector || rec.Count != w.Count || rec.Err != w.Err || !bytes.Equal(rec.Data, w.Data) {
+					t.Errorf("record %d: got %s %d+%d err %q with %d bytes, want %s %d+%d err %q with %d bytes",
+						i, rec.Op, rec.Sector, rec.Count, rec.Err, len(rec.Data), w.Op, w.Sector, w.Count, w.Err, len(w.Data))
+				}
+				if rec.Caller != "" || rec.Func != "" {
+					t.Errorf("record %d: direct use traced as %s/%s", i, rec.Caller, rec.Func)
+				}
+				if rec.Duration < 0 || i > 0 && rec.Offset < recs[i-1].Offset {
+					t.Errorf("record %d: offset %v, duration %v", i, rec.Offset, rec.Duration)
+				}
+			}
+		})
+	}
+
+	// Tracing the same operations in both formats at once gives the same
+	// records, names included.
+	t.Run("both", func(t *testing.T) {
+		dev := fatfs.NewMemDevice(4 << 20)
+		if err := fatfs.BuildImage(dev, testTree(), nil); err != nil {
+			t.Fatal(err)
+		}
+		var bin bytes.Buffer
+		inner := fatfs.NewTracingDevice(dev, &bin, &fatfs.TraceOptions{Format: fatfs.TraceBinary, Data: true})
+		trace := traceWorkload(t, inner, &fatfs.TraceOptions{Format: fatfs.TraceJSONL, Data: true})
+		if err := inner.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		jrecs, brecs := readTrace(t, trace), readTrace(t, bin.Bytes())
+		if len(jrecs) != len(brecs) {
+			t.Fatalf("%d JSONL records, %d binary records", len(jrecs), len(brecs))
+		}
+		ops := map[fatfs.TraceOp]int{}
+		for i, j := range jrecs {
+			b := brecs[i]
+			if j.Op != b.Op || j.Sector != b.Sector || j.Count != b.Count || j.Caller != b.Caller || j.Func != b.Func || j.Err != b.Err || !bytes.Equal(j.Data, b.Data) {
+				t.Fatalf("record %d: JSONL %+v, binary %+v", i, j, b)
+			}
+			if j.Caller == "" || !strings.HasPrefix(j.Func, "f_") {
+				t.Errorf("record %d: %s of sector %d traced as %q/%q", i, j.Op, j.Sector, j.Caller, j.Func)
+			}
+			if j.Op == fatfs.TraceWrite && len(j.Data) != int(j.Count)*512 {
+				t.Errorf("record %d: %d bytes for %d sectors", i, len(j.Data), j.Count)
+			}
+			ops[j.Op]++
+		}
+		if ops[fatfs.TraceRead] == 0 || ops[fatfs.TraceWrite] == 0 || ops[fatfs.TraceSync] == 0 {
+			t.Errorf("ops %v, want reads, writes and syncs", ops)
+		}
+	})
+}
+
+func TestTraceTruncated(t *testing.T) {
+	for _, tf := range traceFormats {
+		t.Run(tf.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tracer := fatfs.NewTracingDevice(fatfs.NewMemDevice(64<<10), &buf, &fatfs.TraceOptions{Format: tf.format, Data: true})
+			if err := tracer.WriteSectors(1, 1, sectorData(0xA1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tracer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tr, err := fatfs.NewTraceReader(bytes.NewReader(buf.Bytes()[:buf.Len()-100]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tr.Next(); err == nil || err == io.EOF {
+				t.Errorf("truncated trace: got %v, want an error", err)
+			}
+		})
+	}
+}
+
+// Replaying a trace onto a copy of the original volume reproduces the
+// traced volume.
+func TestReplayTrace(t *testing.T) {
+	for _, tf := range traceFormats {
+		t.Run(tf.name, func(t *testing.T) {
+			dev := fatfs.NewMemDevice(4 << 20)
+			if err := fatfs.BuildImage(dev, testTree(), nil); err != nil {
+				t.Fatal(err)
+			}
+			orig := dev.Clone()
+			trace := traceWorkload(t, dev, &fatfs.TraceOptions{Format: tf.format, Data: true})
+			ops := map[fatfs.TraceOp]int{}
+			for _, rec := range readTrace(t, trace) {
+				ops[rec.Op]++
+			}
+
+			second := orig.Clone()
+			stats, err := fatfs.ReplayTrace(bytes.NewReader(trace), second, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Reads != ops[fatfs.TraceRead] || stats.Writes != ops[fatfs.TraceWrite] || stats.Syncs != ops[fatfs.TraceSync] || stats.Errors != 0 {
+				t.Errorf("stats %+v, trace has %v", stats, ops)
+			}
+			if !bytes.Equal(second.Bytes(), dev.Bytes()) {
+				t.Fatal("the replayed device differs from the traced one")
+			}
+
+			// writes that failed when traced are counted when they fail again
+			var buf bytes.Buffer
+			tracer := fatfs.NewTracingDevice(fatfs.NewMemDevice(64<<10), &buf, &fatfs.TraceOptions{Format: tf.format, Data: true})
+			if err := tracer.WriteSectors(127, 2, bytes.Repeat(sectorData(0xA1), 2)); err == nil {
+				t.Fatal("write beyond the device succeeded")
+			}
+			tracer.Close()
+			stats, err = fatfs.ReplayTrace(&buf, fatfs.NewMemDevice(64<<10), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Writes != 1 || stats.Errors != 1 {
+				t.Errorf("stats %+v, want one failed write", stats)
+			}
+		})
+	}
+
+	t.Run("no data", func(t *testing.T) {
+		dev := fatfs.NewMemDevice(4 << 20)
+		if err := fatfs.BuildImage(dev, testTree(), nil); err != nil {
+			t.Fatal(err)
+		}
+		orig := dev.Clone()
+		trace := traceWorkload(t, dev, &fatfs.TraceOptions{Format: fatfs.TraceBinary})
+
+		second := orig.Clone()
+		if _, err := fatfs.ReplayTrace(bytes.NewReader(trace), second, nil); err == nil {
+			t.Error("replayed writes without data")
+		}
+
+		second = orig.Clone()
+		stats, err := fatfs.ReplayTrace(bytes.NewReader(trace), second, &fatfs.ReplayOptions{SkipWrites: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Reads == 0 || stats.Writes != 0 || stats.Errors != 0 {
+			t.Errorf("stats %+v, want only reads and syncs", stats)
+		}
+		if !bytes.Equal(second.Bytes(), orig.Bytes()) {
+			t.Error("skipping writes changed the device")
+		}
+	})
+}
@@ -0,0 +1,513 @@
+package fatfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// VHD on-disk constants, see the "Virtual Hard Disk Image Format
+// Specification" published by Microsoft.
+const (
+	vhdFooterSize       = 512
+	vhdDynHeaderSize    = 1024
+	vhdDefaultBlockSize = 2 * 1024 * 1024
+	vhdMaxSize          = 2040 * 1024 * 1024 * 1024
+	vhdUnallocated      = 0xFFFFFFFF
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+)
+
+var (
+	vhdFooterCookie = []byte("conectix")
+	vhdDynCookie    = []byte("cxsparse")
+
+	// vhdEpoch is the reference time of VHD timestamps.
+	vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// assert that VHDFile implements the BlockDevice interface
+var _ BlockDevice = (*VHDFile)(nil)
+
+// VHDFile is a BlockDevice backed by a Microsoft VHD image. Both fixed and
+// dynamic (sparse) images are supported; differencing images are not.
+type VHDFile struct {
+	file *os.File
+
+	footer [vhdFooterSize]byte
+	size   uint64
+	fixed  bool
+
+	// dynamic disk state
+	header     [vhdDynHeaderSize]byte
+	headerOff  int64
+	batOff     int64
+	bat        []uint32
+	blockSize  uint32
+	bitmapSize int64 // bytes, padded to a sector boundary
+	footerOff  int64 // where the trailing footer lives, also the next free block
+}
+
+// OpenVHD opens an existing fixed or dynamic VHD image at path.
+func OpenVHD(path string) (*VHDFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	vhd := &VHDFile{file: f}
+	if err := vhd.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("vhd %s: %w", path, err)
+	}
+	return vhd, nil
+}
+
+// CreateVHD creates a new, empty dynamic VHD image of the given virtual size
+// at path. Blocks are only allocated in the image once they are written to
+// with non-zero data, so a freshly formatted volume stays small.
+func CreateVHD(path string, size int64) (*VHDFile, error) {
+	if size <= 0 || size > vhdMaxSize {
+		return nil, fmt.Errorf("invalid VHD size: %d", size)
+	}
+	size = (size + sectorSize - 1) / sectorSize * sectorSize
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	vhd := &VHDFile{
+		file:      f,
+		size:      uint64(size),
+		headerOff: vhdFooterSize,
+		batOff:    vhdFooterSize + vhdDynHeaderSize,
+		blockSize: vhdDefaultBlockSize,
+	}
+	entries := uint32((uint64(size) + vhdDefaultBlockSize - 1) / vhdDefaultBlockSize)
+	vhd.bat = make([]uint32, entries)
+	for i := range vhd.bat {
+		vhd.bat[i] = vhdUnallocated
+	}
+	vhd.bitmapSize = vhdBitmapSize(vhd.blockSize)
+	vhd.footerOff = vhd.batOff + roundUpSector(int64(entries)*4)
+
+	vhd.initFooter(vhdTypeDynamic)
+	vhd.initDynHeader(entries)
+
+	if err := vhd.create(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return vhd, nil
+}
+
+func (vhd *VHDFile) create() error {
+	if _, err := vhd.file.WriteAt(vhd.footer[:], 0); err != nil {
+		return err
+	}
+	if _, err := vhd.file.WriteAt(vhd.header[:], vhd.headerOff); err != nil {
+		return err
+	}
+	bat := make([]byte, vhd.footerOff-vhd.batOff)
+	for i := range bat {
+		bat[i] = 0xFF
+	}
+	if _, err := vhd.file.WriteAt(bat, vhd.batOff); err != nil {
+		return err
+	}
+	_, err := vhd.file.WriteAt(vhd.footer[:], vhd.footerOff)
+	return err
+}
+
+// load parses the footer, and for dynamic disks the header and BAT.
+func (vhd *VHDFile) load() error {
+	info, err := vhd.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < vhdFooterSize {
+		return errors.New("file too small")
+	}
+
+	// The trailing footer is authoritative. Images created by some older
+	// tools only have a 511 byte footer, fall back to the copy at offset 0.
+	if _, err := vhd.file.ReadAt(vhd.footer[:], info.Size()-vhdFooterSize); err != nil {
+		return err
+	}
+	if !bytes.Equal(vhd.footer[:8], vhdFooterCookie) {
+		if _, err := vhd.file.ReadAt(vhd.footer[:], 0); err != nil {
+			return err
+		}
+		if !bytes.Equal(vhd.footer[:8], vhdFooterCookie) {
+			return errors.New("missing VHD footer")
+		}
+	}
+	if got, want := binary.BigEndian.Uint32(vhd.footer[64:]), vhdChecksum(vhd.footer[:], 64); got != want {
+		return fmt.Errorf("bad footer checksum: %08x != %08x", got, want)
+	}
+
+	vhd.size = binary.BigEndian.Uint64(vhd.footer[48:])
+	switch diskType := binary.BigEndian.Uint32(vhd.footer[60:]); diskType {
+	case vhdTypeFixed:
+		vhd.fixed = true
+		if uint64(info.Size()) < vhd.size {
+			return errors.New("fixed image is truncated")
+		}
+		return nil
+	case vhdTypeDynamic:
+		// handled below
+	case vhdTypeDifferencing:
+		return errors.New("differencing disks are not supported")
+	default:
+		return fmt.Errorf("unknown disk type %d", diskType)
+	}
+
+	vhd.headerOff = int64(binary.BigEndian.Uint64(vhd.footer[16:]))
+	if _, err := vhd.file.ReadAt(vhd.header[:], vhd.headerOff); err != nil {
+		return fmt.Errorf("failed to read dynamic header: %w", err)
+	}
+	if !bytes.Equal(vhd.header[:8], vhdDynCookie) {
+		return errors.New("missing dynamic disk header")
+	}
+	if got, want := binary.BigEndian.Uint32(vhd.header[36:]), vhdChecksum(vhd.header[:], 36); got != want {
+		return fmt.Errorf("bad dynamic header checksum: %08x != %08x", got, want)
+	}
+
+	vhd.batOff = int64(binary.BigEndian.Uint64(vhd.header[16:]))
+	entries := binary.BigEndian.Uint32(vhd.header[28:])
+	vhd.blockSize = binary.BigEndian.Uint32(vhd.header[32:])
+	if vhd.blockSize == 0 || vhd.blockSize%sectorSize != 0 {
+		return fmt.Errorf("invalid block size %d", vhd.blockSize)
+	}
+	if uint64(entries)*uint64(vhd.blockSize) < vhd.size {
+		return errors.New("block allocation table is too small for the disk size")
+	}
+	vhd.bitmapSize = vhdBitmapSize(vhd.blockSize)
+
+	raw := make([]byte, int64(entries)*4)
+	if _, err := vhd.file.ReadAt(raw, vhd.batOff); err != nil {
+		return fmt.Errorf("failed to read BAT: %w", err)
+	}
+	vhd.bat = make([]uint32, entries)
+	for i := range vhd.bat {
+		vhd.bat[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+
+	// New blocks are appended where the trailing footer currently sits.
+	vhd.footerOff = roundUpSector(info.Size() - vhdFooterSize)
+	if end := vhd.batOff + roundUpSector(int64(entries)*4); vhd.footerOff < end {
+		vhd.footerOff = end
+	}
+	for _, off := range vhd.bat {
+		if off == vhdUnallocated {
+			continue
+		}
+		if end := int64(off)*sectorSize + vhd.bitmapSize + int64(vhd.blockSize); end > vhd.footerOff {
+			vhd.footerOff = end
+		}
+	}
+	return nil
+}
+
+func (vhd *VHDFile) initFooter(diskType uint32) {
+	ft := vhd.footer[:]
+	copy(ft[0:], vhdFooterCookie)
+	binary.BigEndian.PutUint32(ft[8:], 0x00000002)  // features: reserved bit must be set
+	binary.BigEndian.PutUint32(ft[12:], 0x00010000) // file format version
+	if diskType == vhdTypeFixed {
+		binary.BigEndian.PutUint64(ft[16:], 0xFFFFFFFFFFFFFFFF)
+	} else {
+		binary.BigEndian.PutUint64(ft[16:], uint64(vhd.headerOff))
+	}
+	binary.BigEndian.PutUint32(ft[24:], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(ft[28:], "gfat")
+	binary.BigEndian.PutUint32(ft[32:], 0x00010000) // creator version
+	copy(ft[36:], "Wi2k")                           // creator host OS
+	binary.BigEndian.PutUint64(ft[40:], vhd.size)   // original size
+	binary.BigEndian.PutUint64(ft[48:], vhd.size)   // current size
+	cyl, heads, spt := vhdGeometry(vhd.size / sectorSize)
+	binary.BigEndian.PutUint16(ft[56:], cyl)
+	ft[58] = heads
+	ft[59] = spt
+	binary.BigEndian.PutUint32(ft[60:], diskType)
+	rand.Read(ft[68:84]) // unique id
+	binary.BigEndian.PutUint32(ft[64:], vhdChecksum(ft, 64))
+}
+
+func (vhd *VHDFile) initDynHeader(entries uint32) {
+	hd := vhd.header[:]
+	copy(hd[0:], vhdDynCookie)
+	binary.BigEndian.PutUint64(hd[8:], 0xFFFFFFFFFFFFFFFF)
+	binary.BigEndian.PutUint64(hd[16:], uint64(vhd.batOff))
+	binary.BigEndian.PutUint32(hd[24:], 0x00010000) // header version
+	binary.BigEndian.PutUint32(hd[28:], entries)
+	binary.BigEndian.PutUint32(hd[32:], vhd.blockSize)
+	binary.BigEndian.PutUint32(hd[36:], vhdChecksum(hd, 36))
+}
+
+// Initialize is a no-op, the image is parsed when it is opened.
+func (vhd *VHDFile) Initialize() error {
+	return nil
+}
+
+// Status reports whether the image is still open.
+func (vhd *VHDFile) Status() error {
+	if vhd.file == nil {
+		return fmt.Errorf("file is not open")
+	}
+	return nil
+}
+
+// ReadSectors reads `count` sectors starting at `sector` into `buff`.
+// Unallocated areas of a dynamic image read as zeroes.
+func (vhd *VHDFile) ReadSectors(sector uint64, count uint32, buff []byte) error {
+	length, err := vhd.checkRange(sector, count, buff)
+	if err != nil {
+		return err
+	}
+	if vhd.fixed {
+		return vhd.readFull(buff[:length], int64(sector*sectorSize))
+	}
+
+	for done := int64(0); done < length; {
+		blk, off, n := vhd.locate(uint64(sector*sectorSize)+uint64(done), length-done)
+		dst := buff[done : done+n]
+		if vhd.bat[blk] == vhdUnallocated {
+			clear(dst)
+		} else {
+			bitmap, err := vhd.readBitmap(blk)
+			if err != nil {
+				return err
+			}
+			if err := vhd.readFull(dst, vhd.blockDataOffset(blk)+off); err != nil {
+				return err
+			}
+			for s := int64(0); s < n/sectorSize; s++ {
+				if !bitmapIsSet(bitmap, (off/sectorSize)+s) {
+					clear(dst[s*sectorSize : (s+1)*sectorSize])
+				}
+			}
+		}
+		done += n
+	}
+	return nil
+}
+
+// WriteSectors writes `count` sectors from `buff` starting at `sector`. Blocks
+// of a dynamic image are allocated on first write; all-zero writes to an
+// unallocated block leave it unallocated.
+func (vhd *VHDFile) WriteSectors(sector uint64, count uint32, buff []byte) error {
+	length, err := vhd.checkRange(sector, count, buff)
+	if err != nil {
+		return err
+	}
+	if vhd.fixed {
+		_, err := vhd.file.WriteAt(buff[:length], int64(sector*sectorSize))
+		return err
+	}
+
+	for done := int64(0); done < length; {
+		blk, off, n := vhd.locate(uint64(sector*sectorSize)+uint64(done), length-done)
+		src := buff[done : done+n]
+		done += n
+
+		if vhd.bat[blk] == vhdUnallocated {
+			if isZero(src) {
+				continue
+			}
+			if err := vhd.allocate(blk); err != nil {
+				return err
+			}
+		}
+		if _, err := vhd.file.WriteAt(src, vhd.blockDataOffset(blk)+off); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		if err := vhd.markWritten(blk, off/sectorSize, n/sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes the image to stable storage.
+func (vhd *VHDFile) Sync() error {
+	if vhd.file == nil {
+		return fmt.Errorf("file is not open")
+	}
+	return vhd.file.Sync()
+}
+
+// GetSectorSize returns the sector size of the image.
+func (vhd *VHDFile) GetSectorSize() uint64 {
+	return sectorSize
+}
+
+// GetSectorCount returns the virtual size of the disk in sectors.
+func (vhd *VHDFile) GetSectorCount() uint64 {
+	return vhd.size / sectorSize
+}
+
+// Close should be called when you're done with the VHDFile
+func (vhd *VHDFile) Close() error {
+	if vhd.file == nil {
+		return nil
+	}
+	err := vhd.file.Close()
+	vhd.file = nil
+	return err
+}
+
+func (vhd *VHDFile) checkRange(sector uint64, count uint32, buff []byte) (int64, error) {
+	if vhd.file == nil {
+		return 0, fmt.Errorf("file is not open")
+	}
+	length := int64(count) * sectorSize
+	if int64(len(buff)) < length {
+		return 0, fmt.Errorf("buffer too small: need %d bytes, got %d", length, len(buff))
+	}
+	if sector+uint64(count) > vhd.GetSectorCount() {
+		return 0, fmt.Errorf("access beyond end of disk: sector %d, count %d", sector, count)
+	}
+	return length, nil
+}
+
+// locate splits a byte range at block boundaries, returning the block index,
+// the offset within the block and how many bytes fit in that block.
+func (vhd *VHDFile) locate(pos uint64, remaining int64) (uint32, int64, int64) {
+	blk := uint32(pos / uint64(vhd.blockSize))
+	off := int64(pos % uint64(vhd.blockSize))
+	return blk, off, min(remaining, int64(vhd.blockSize)-off)
+}
+
+func (vhd *VHDFile) blockDataOffset(blk uint32) int64 {
+	return int64(vhd.bat[blk])*sectorSize + vhd.bitmapSize
+}
+
+func (vhd *VHDFile) readBitmap(blk uint32) ([]byte, error) {
+	bitmap := make([]byte, vhd.bitmapSize)
+	if err := vhd.readFull(bitmap, int64(vhd.bat[blk])*sectorSize); err != nil {
+		return nil, err
+	}
+	return bitmap, nil
+}
+
+func (vhd *VHDFile) markWritten(blk uint32, first, count int64) error {
+	bitmap, err := vhd.readBitmap(blk)
+	if err != nil {
+		return err
+	}
+	dirty := false
+	for s := first; s < first+count; s++ {
+		if !bitmapIsSet(bitmap, s) {
+			bitmap[s/8] |= 0x80 >> (s % 8)
+			dirty = true
+		}
+	}
+	if !dirty {
+		return nil
+	}
+	_, err = vhd.file.WriteAt(bitmap, int64(vhd.bat[blk])*sectorSize)
+	return err
+}
+
+// allocate appends a zeroed block in place of the trailing footer, rewrites
+// the footer after it and records the block in the BAT.
+func (vhd *VHDFile) allocate(blk uint32) error {
+	off := vhd.footerOff
+	if err := vhd.file.Truncate(off + vhd.bitmapSize + int64(vhd.blockSize)); err != nil {
+		return fmt.Errorf("failed to grow image: %w", err)
+	}
+	if _, err := vhd.file.WriteAt(make([]byte, vhd.bitmapSize), off); err != nil {
+		return err
+	}
+	vhd.footerOff = off + vhd.bitmapSize + int64(vhd.blockSize)
+	if _, err := vhd.file.WriteAt(vhd.footer[:], vhd.footerOff); err != nil {
+		return err
+	}
+
+	vhd.bat[blk] = uint32(off / sectorSize)
+	var entry [4]byte
+	binary.BigEndian.PutUint32(entry[:], vhd.bat[blk])
+	_, err := vhd.file.WriteAt(entry[:], vhd.batOff+int64(blk)*4)
+	return err
+}
+
+func (vhd *VHDFile) readFull(buf []byte, off int64) error {
+	n, err := vhd.file.ReadAt(buf, off)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	return nil
+}
+
+// vhdChecksum computes the one's complement of the byte sum of buf, skipping
+// the four checksum bytes at skip.
+func vhdChecksum(buf []byte, skip int) uint32 {
+	var sum uint32
+	for i, b := range buf {
+		if i >= skip && i < skip+4 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// vhdGeometry derives the CHS geometry from the sector count, using the
+// algorithm given in the VHD specification.
+func vhdGeometry(total uint64) (cyl uint16, heads, spt uint8) {
+	if total > 65535*16*255 {
+		total = 65535 * 16 * 255
+	}
+	var h, s, cth uint64
+	if total >= 65535*16*63 {
+		s, h = 255, 16
+		cth = total / s
+	} else {
+		s = 17
+		cth = total / s
+		h = max((cth+1023)/1024, 4)
+		if cth >= h*1024 || h > 16 {
+			s, h = 31, 16
+			cth = total / s
+		}
+		if cth >= h*1024 {
+			s, h = 63, 16
+			cth = total / s
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(s)
+}
+
+func vhdBitmapSize(blockSize uint32) int64 {
+	return roundUpSector(int64(blockSize/sectorSize+7) / 8)
+}
+
+func roundUpSector(n int64) int64 {
+	return (n + sectorSize - 1) / sectorSize * sectorSize
+}
+
+func bitmapIsSet(bitmap []byte, bit int64) bool {
+	return bitmap[bit/8]&(0x80>>(bit%8)) != 0
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
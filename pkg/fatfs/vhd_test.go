@@ -0,0 +1,248 @@
+package fatfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OffBroadway/go-fatfs/pkg/fatfs"
+)
+
+// vhdSum is the one's complement byte sum of the VHD specification,
+// without the checksum field at skip.
+func vhdSum(buf []byte, skip int) uint32 {
+	var sum uint32
+	for i, b := range buf {
+		if i < skip || i >= skip+4 {
+			sum += uint32(b)
+		}
+	}
+	return ^sum
+}
+
+// checkVHDStructure checks the footers, the dynamic header and the BAT of
+// the dynamic image at path, and returns the BAT.
+func checkVHDStructure(t *testing.T, path string, size int64) []uint32 {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := raw[len(raw)-512:]
+	if !bytes.Equal(raw[:512], footer) {
+		t.Error("footer copies differ")
+	}
+	if string(footer[:8]) != "conectix" || binary.BigEndian.Uint32(footer[64:]) != vhdSum(footer, 64) {
+		t.Fatalf("bad footer: % x", footer[:72])
+	}
+	if typ := binary.BigEndian.Uint32(footer[60:]); typ != 3 {
+		t.Errorf("disk type %d, want dynamic", typ)
+	}
+	if got := binary.BigEndian.Uint64(footer[48:]); got != uint64(size) {
+		t.Errorf("current size %d, want %d", got, size)
+	}
+
+	header := raw[binary.BigEndian.Uint64(footer[16:]):][:1024]
+	if string(header[:8]) != "cxsparse" || binary.BigEndian.Uint32(header[36:]) != vhdSum(header, 36) {
+		t.Fatalf("bad dynamic header: % x", header[:40])
+	}
+	entries := binary.BigEndian.Uint32(header[28:])
+	blockSize := binary.BigEndian.Uint32(header[32:])
+	if uint64(entries)*uint64(blockSize) < uint64(size) {
+		t.Fatalf("%d blocks of %d bytes for %d bytes", entries, blockSize, size)
+	}
+	batOff := binary.BigEndian.Uint64(header[16:])
+	bat := make([]uint32, entries)
+	for i := range bat {
+		bat[i] = binary.BigEndian.Uint32(raw[batOff+uint64(i)*4:])
+		// a block is a sector of bitmap and its data, before the footer
+		if off := int64(bat[i]) * 512; bat[i] != 0xFFFFFFFF && off+512+int64(blockSize) > int64(len(raw)-512) {
+			t.Errorf("block %d at %d runs past the footer", i, off)
+		}
+	}
+	return bat
+}
+
+func TestVHDDynamic(t *testing.T) {
+	const size = 10 << 20 // five blocks of 2 MiB
+	path := filepath.Join(t.TempDir(), "disk.vhd")
+	vhd, err := fatfs.CreateVHD(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vhd.GetSectorCount() != size/512 {
+		t.Fatalf("%d sectors", vhd.GetSectorCount())
+	}
+	for i, off := range checkVHDStructure(t, path, size) {
+		if off != 0xFFFFFFFF {
+			t.Errorf("block %d allocated in a new image", i)
+		}
+	}
+
+	// data across the end of block 1, zeroes into block 3
+	data := bytes.Repeat([]byte("vhd!"), 4*512/4)
+	if err := vhd.WriteSectors(2*4096-2, 4, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhd.WriteSectors(3*4096, 8, make([]byte, 8*512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bat := checkVHDStructure(t, path, size)
+	for i, off := range bat {
+		if allocated := off != 0xFFFFFFFF; allocated != (i == 1 || i == 2) {
+			t.Errorf("block %d allocated: %v", i, allocated)
+		}
+	}
+
+	vhd, err = fatfs.OpenVHD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vhd.Close()
+	got := make([]byte, 4*512)
+	if err := vhd.ReadSectors(2*4096-2, 4, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data differs after reopening")
+	}
+	// sparse blocks, and the unwritten sectors of allocated ones, read as
+	// zeroes
+	for _, sector := range []uint64{0, 4096, 2*4096 + 2, 3 * 4096, 5*4096 - 1} {
+		buf := bytes.Repeat([]byte{0xAA}, 512)
+		if err := vhd.ReadSectors(sector, 1, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, make([]byte, 512)) {
+			t.Errorf("sector %d is not zero", sector)
+		}
+	}
+	if err := vhd.ReadSectors(5*4096, 1, got[:512]); err == nil {
+		t.Error("read past the end succeeded")
+	}
+}
+
+func TestVHDFileSystem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.vhd")
+	vhd, err := fatfs.CreateVHD(path, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := testTree()
+	if err := fatfs.BuildImage(vhd, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// only the blocks written to take space
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() >= 16<<20 {
+		t.Errorf("image of %d bytes is not sparse", info.Size())
+	}
+
+	vhd, err = fatfs.OpenVHD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vhd.Close()
+	checkTree(t, vhd, tree)
+}
+
+func TestVHDFixed(t *testing.T) {
+	const size = 4 << 20
+	disk := make([]byte, size+512)
+	footer := disk[size:]
+	copy(footer, "conectix")
+	binary.BigEndian.PutUint32(footer[8:], 2)
+	binary.BigEndian.PutUint32(footer[12:], 0x00010000)
+	binary.BigEndian.PutUint64(footer[16:], 0xFFFFFFFFFFFFFFFF)
+	binary.BigEndian.PutUint64(footer[40:], size)
+	binary.BigEndian.PutUint64(footer[48:], size)
+	// 8192 sectors: 120 cylinders, 4 heads, 17 sectors per track
+	binary.BigEndian.PutUint16(footer[56:], 120)
+	footer[58], footer[59] = 4, 17
+	binary.BigEndian.PutUint32(footer[60:], 2)
+	binary.BigEndian.PutUint32(footer[64:], vhdSum(footer, 64))
+	path := filepath.Join(t.TempDir(), "fixed.vhd")
+	if err := os.WriteFile(path, disk, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	vhd, err := fatfs.OpenVHD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vhd.GetSectorCount() != size/512 {
+		t.Fatalf("%d sectors", vhd.GetSectorCount())
+	}
+	tree := testTree()
+	if err := fatfs.BuildImage(vhd, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data sits in place before the untouched footer
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != len(disk) || !bytes.Equal(raw[size:], footer) {
+		t.Fatal("footer changed")
+	}
+	checkTree(t, fatfs.NewMemDeviceFromBytes(raw[:size]), tree)
+
+	vhd, err = fatfs.OpenVHD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vhd.Close()
+	checkTree(t, vhd, tree)
+
+	// a corrupt footer is refused
+	raw[size+20]++
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fatfs.OpenVHD(path); err == nil {
+		t.Error("opened an image with a bad footer checksum")
+	}
+}
+
+// CreateVHD records the CHS geometry of the VHD specification.
+func TestVHDGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		size            int64
+		cyl, heads, spt uint16
+	}{
+		{4 << 20, 120, 4, 17},
+		{40 << 20, 963, 5, 17},
+		{1 << 30, 2080, 16, 63},
+		{64 << 30, 32896, 16, 255},
+		{136 << 30, 65535, 16, 255},
+	} {
+		path := filepath.Join(t.TempDir(), "disk.vhd")
+		vhd, err := fatfs.CreateVHD(path, tc.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vhd.Close()
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cyl, heads, spt := binary.BigEndian.Uint16(raw[56:]), uint16(raw[58]), uint16(raw[59])
+		if cyl != tc.cyl || heads != tc.heads || spt != tc.spt {
+			t.Errorf("%d bytes: CHS %d/%d/%d, want %d/%d/%d", tc.size, cyl, heads, spt, tc.cyl, tc.heads, tc.spt)
+		}
+	}
+}
@@ -0,0 +1,1173 @@
+package fatfs
+
+/*
+#include "ff.h"
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"unicode/utf16"
+)
+
+// On-disk limits and offsets, named after their ff.c counterparts.
+const (
+	maxFAT12 = 0xFF5
+	maxFAT16 = 0xFFF5
+	maxFAT32 = 0x0FFFFFF5
+	maxEXFAT = 0x7FFFFFFD
+
+	dirEntrySize = 32
+
+	attrVolume = 0x08
+	attrLFN    = 0x0F
+
+	mbrTable    = 446
+	partEntSize = 16
+
+	exfatBitmap = 0x81
+	exfatUpcase = 0x82
+	exfatLabel  = 0x83
+	exfatFile   = 0x85
+	exfatStream = 0xC0
+	exfatName   = 0xC1
+
+	exfatNoFatChain = 0x02
+)
+
+// guidMSBasic is the GPT partition type of Microsoft basic data partitions,
+// in its on-disk byte order.
+var guidMSBasic = []byte{0xA2, 0xA0, 0xD0, 0xEB, 0xE5, 0xB9, 0x33, 0x44, 0x87, 0xC0, 0x68, 0xB6, 0xB7, 0x26, 0x99, 0xC7}
+
+// volume gives direct access to the on-disk structures of a FAT or exFAT
+// volume, parsed in Go rather than through FatFs, for tools that need to
+// see (or fix) more than the FatFs API exposes. The device must not be
+// mounted while a volume is in use.
+type volume struct {
+	dev   BlockDevice
+	ssize uint64
+	typ   Type
+
+	base      uint64 // first sector of the volume on the device
+	sectors   uint64 // size of the volume in sectors
+	csize     uint64 // sectors per cluster
+	nfats     int
+	fatStart  uint64 // first sector of the first FAT
+	fatSize   uint64 // sectors per FAT
+	dataStart uint64 // first sector of cluster 2
+	nclst     uint32 // number of data clusters, valid ones are 2..nclst+1
+
+	// FAT12/16 keep the root directory in a fixed area before the data
+	// area, FAT32 and exFAT in a cluster chain.
+	rootStart   uint64
+	rootEntries uint32
+	rootCluster uint32
+
+	fsinfo uint64 // FAT32 FSInfo sector, 0 if there is none
+
+	// exFAT allocation bitmap and up-case table.
+	bitmapCluster uint32
+	bitmapSize    uint64
+	upcaseCluster uint32
+	upcaseSize    uint64
+	upcaseSum     uint32
+
+	fat      []byte // raw contents of the first FAT
+	fatDirty map[uint64]bool
+
+	// codePage is the OEM code page of short names, which tells double
+	// byte characters apart; 0 stands for 437.
+	codePage int
+}
+
+// openVolume finds the volume FatFs would mount on dev, the same way
+// find_volume does, and loads its FAT. part selects a partition (1-based)
+// as with a forced partition number in FatFs, 0 searches for the first FAT
+// volume.
+func openVolume(dev BlockDevice, part int) (*volume, error) {
+	v := &volume{dev: dev, ssize: dev.GetSectorSize(), fatDirty: map[uint64]bool{}}
+	if v.ssize < sectorSize || v.ssize&(v.ssize-1) != 0 {
+		return nil, fmt.Errorf("unsupported sector size: %d", v.ssize)
+	}
+
+	base, boot, err := v.findVolume(part)
+	if err != nil {
+		return nil, err
+	}
+	v.base = base
+	if bytes.Equal(boot[:11], []byte("\xEB\x76\x90EXFAT   ")) {
+		err = v.parseExFAT(boot)
+	} else {
+		err = v.parseFAT(boot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v.fat, err = v.read(v.fatStart, v.fatSize); err != nil {
+		return nil, err
+	}
+	if v.typ == TypeEXFAT {
+		if err := v.findExFATMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func noFilesystem(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", FileResultNoFilesystem, fmt.Sprintf(format, args...))
+}
+
+// checkBootSector classifies a sector like check_fs: 0 is a FAT VBR, 1 an
+// exFAT VBR, 2 another boot sector (e.g. an MBR) and 3 anything else.
+func checkBootSector(b []byte) int {
+	sign := binary.LittleEndian.Uint16(b[510:])
+	if sign == 0xAA55 && bytes.Equal(b[:11], []byte("\xEB\x76\x90EXFAT   ")) {
+		return 1
+	}
+	if b[0] == 0xEB || b[0] == 0xE9 || b[0] == 0xE8 {
+		if sign == 0xAA55 && bytes.Equal(b[82:90], []byte("FAT32   ")) {
+			return 0
+		}
+		bps := binary.LittleEndian.Uint16(b[11:])
+		spc := b[13]
+		if bps&(bps-1) == 0 && bps >= 512 && bps <= 4096 &&
+			spc != 0 && spc&(spc-1) == 0 &&
+			binary.LittleEndian.Uint16(b[14:]) != 0 &&
+			b[16]-1 <= 1 &&
+			binary.LittleEndian.Uint16(b[17:]) != 0 &&
+			(binary.LittleEndian.Uint16(b[19:]) >= 128 || binary.LittleEndian.Uint32(b[32:]) >= 0x10000) &&
+			binary.LittleEndian.Uint16(b[22:]) != 0 {
+			return 0
+		}
+	}
+	if sign == 0xAA55 {
+		return 2
+	}
+	return 3
+}
+
+func (v *volume) findVolume(part int) (uint64, []byte, error) {
+	mbr, err := v.read(0, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	kind := checkBootSector(mbr)
+	if kind != 2 && (kind >= 3 || part == 0) {
+		if kind >= 3 {
+			return 0, nil, noFilesystem("no boot sector or partition table found")
+		}
+		return 0, mbr, nil
+	}
+
+	if mbr[mbrTable+4] == 0xEE {
+		return v.findGPTVolume(part)
+	}
+
+	if part > 4 {
+		return 0, nil, noFilesystem("partition %d does not exist, the MBR has 4 entries", part)
+	}
+	i := 0
+	if part > 0 {
+		i = part - 1
+	}
+	for ; i < 4; i++ {
+		lba := uint64(binary.LittleEndian.Uint32(mbr[mbrTable+i*partEntSize+8:]))
+		if lba != 0 {
+			boot, err := v.read(lba, 1)
+			if err != nil {
+				return 0, nil, err
+			}
+			if checkBootSector(boot) <= 1 {
+				return lba, boot, nil
+			}
+		}
+		if part != 0 {
+			return 0, nil, noFilesystem("partition %d is not a FAT volume", part)
+		}
+	}
+	return 0, nil, noFilesystem("no FAT volume found in the MBR partitions")
+}
+
+func (v *volume) findGPTVolume(part int) (uint64, []byte, error) {
+	hdr, err := v.read(1, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(hdr[:8], []byte("EFI PART")) || binary.LittleEndian.Uint32(hdr[12:]) != 92 {
+		return 0, nil, noFilesystem("bad GPT header")
+	}
+	sum := binary.LittleEndian.Uint32(hdr[16:])
+	hdrCopy := bytes.Clone(hdr[:92])
+	binary.LittleEndian.PutUint32(hdrCopy[16:], 0)
+	if crc32.ChecksumIEEE(hdrCopy) != sum {
+		return 0, nil, noFilesystem("bad GPT header checksum")
+	}
+
+	n := binary.LittleEndian.Uint32(hdr[80:])
+	esize := uint64(binary.LittleEndian.Uint32(hdr[84:]))
+	table := binary.LittleEndian.Uint64(hdr[72:])
+	if esize < 128 || esize > v.ssize || v.ssize%esize != 0 {
+		return 0, nil, noFilesystem("bad GPT entry size %d", esize)
+	}
+
+	found := 0
+	for i := uint64(0); i < uint64(n); i++ {
+		sect, err := v.read(table+i*esize/v.ssize, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		ent := sect[i*esize%v.ssize:]
+		if !bytes.Equal(ent[:16], guidMSBasic) {
+			continue
+		}
+		found++
+		lba := binary.LittleEndian.Uint64(ent[32:])
+		boot, err := v.read(lba, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		ok := checkBootSector(boot) <= 1
+		if part == 0 && ok {
+			return lba, boot, nil
+		}
+		if part != 0 && found == part {
+			if !ok {
+				return 0, nil, noFilesystem("partition %d is not a FAT volume", part)
+			}
+			return lba, boot, nil
+		}
+	}
+	return 0, nil, noFilesystem("no FAT volume found in the GPT partitions")
+}
+
+func (v *volume) parseFAT(b []byte) error {
+	if uint64(binary.LittleEndian.Uint16(b[11:])) != v.ssize {
+		return noFilesystem("sector size in the boot sector does not match the device")
+	}
+	fatSize := uint64(binary.LittleEndian.Uint16(b[22:]))
+	if fatSize == 0 {
+		fatSize = uint64(binary.LittleEndian.Uint32(b[36:]))
+	}
+	v.fatSize = fatSize
+	v.nfats = int(b[16])
+	if v.nfats != 1 && v.nfats != 2 {
+		return noFilesystem("bad number of FATs: %d", v.nfats)
+	}
+	v.csize = uint64(b[13])
+	if v.csize == 0 || v.csize&(v.csize-1) != 0 {
+		return noFilesystem("bad cluster size: %d sectors", v.csize)
+	}
+	v.rootEntries = uint32(binary.LittleEndian.Uint16(b[17:]))
+	if uint64(v.rootEntries)%(v.ssize/dirEntrySize) != 0 {
+		return noFilesystem("root directory size is not sector aligned")
+	}
+	v.sectors = uint64(binary.LittleEndian.Uint16(b[19:]))
+	if v.sectors == 0 {
+		v.sectors = uint64(binary.LittleEndian.Uint32(b[32:]))
+	}
+	reserved := uint64(binary.LittleEndian.Uint16(b[14:]))
+	if reserved == 0 {
+		return noFilesystem("no reserved sectors")
+	}
+
+	system := reserved + fatSize*uint64(v.nfats) + uint64(v.rootEntries)*dirEntrySize/v.ssize
+	if v.sectors < system {
+		return noFilesystem("volume too small for its FATs")
+	}
+	nclst := (v.sectors - system) / v.csize
+	switch {
+	case nclst == 0 || nclst > maxFAT32:
+		return noFilesystem("bad number of clusters: %d", nclst)
+	case nclst <= maxFAT12:
+		v.typ = TypeFAT12
+	case nclst <= maxFAT16:
+		v.typ = TypeFAT16
+	default:
+		v.typ = TypeFAT32
+	}
+	v.nclst = uint32(nclst)
+	v.fatStart = v.base + reserved
+	v.dataStart = v.base + system
+
+	var need uint64
+	n := uint64(v.nclst) + 2
+	if v.typ == TypeFAT32 {
+		if binary.LittleEndian.Uint16(b[42:]) != 0 {
+			return noFilesystem("unsupported FAT32 version")
+		}
+		if v.rootEntries != 0 {
+			return noFilesystem("FAT32 volume with a fixed root directory")
+		}
+		v.rootCluster = binary.LittleEndian.Uint32(b[44:])
+		if fsi := uint64(binary.LittleEndian.Uint16(b[48:])); fsi != 0 && fsi < reserved {
+			v.fsinfo = v.base + fsi
+		}
+		need = n * 4
+	} else {
+		if v.rootEntries == 0 {
+			return noFilesystem("FAT12/16 volume without a root directory")
+		}
+		v.rootStart = v.fatStart + fatSize*uint64(v.nfats)
+		if v.typ == TypeFAT16 {
+			need = n * 2
+		} else {
+			need = n*3/2 + n&1
+		}
+	}
+	if fatSize < (need+v.ssize-1)/v.ssize {
+		return noFilesystem("FAT too small for the number of clusters")
+	}
+	return nil
+}
+
+func (v *volume) parseExFAT(b []byte) error {
+	if !isZero(b[11:64]) {
+		return noFilesystem("exFAT boot sector has data in its zeroed area")
+	}
+	if binary.LittleEndian.Uint16(b[104:]) != 0x100 {
+		return noFilesystem("unsupported exFAT version")
+	}
+	if 1<<b[108] != v.ssize {
+		return noFilesystem("sector size in the boot sector does not match the device")
+	}
+	v.typ = TypeEXFAT
+	v.sectors = binary.LittleEndian.Uint64(b[72:])
+	v.fatSize = uint64(binary.LittleEndian.Uint32(b[84:]))
+	v.nfats = int(b[110])
+	if v.nfats != 1 {
+		return noFilesystem("unsupported number of FATs: %d", v.nfats)
+	}
+	if b[109] > 25 {
+		return noFilesystem("bad cluster size")
+	}
+	v.csize = 1 << b[109]
+	nclst := binary.LittleEndian.Uint32(b[92:])
+	if nclst == 0 || nclst > maxEXFAT {
+		return noFilesystem("bad number of clusters: %d", nclst)
+	}
+	v.nclst = nclst
+	v.fatStart = v.base + uint64(binary.LittleEndian.Uint32(b[80:]))
+	v.dataStart = v.base + uint64(binary.LittleEndian.Uint32(b[88:]))
+	if v.base+v.sectors < v.dataStart+uint64(nclst)*v.csize {
+		return noFilesystem("volume too small for its clusters")
+	}
+	if v.fatSize*v.ssize < (uint64(nclst)+2)*4 {
+		return noFilesystem("FAT too small for the number of clusters")
+	}
+	v.rootCluster = binary.LittleEndian.Uint32(b[96:])
+	return nil
+}
+
+// findExFATMetadata locates the allocation bitmap and up-case table in the
+// root directory.
+func (v *volume) findExFATMetadata() error {
+	if !v.validCluster(v.rootCluster) {
+		return noFilesystem("bad root directory cluster: %d", v.rootCluster)
+	}
+	clusters, err := v.chain(v.rootCluster)
+	if err != nil {
+		return err
+	}
+	d, err := v.readDir(v.clusterSectors(clusters))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < d.entries(); i++ {
+		ent := d.entry(i)
+		switch ent[0] {
+		case exfatBitmap:
+			if ent[1]&1 == 0 && v.bitmapCluster == 0 {
+				v.bitmapCluster = binary.LittleEndian.Uint32(ent[20:])
+				v.bitmapSize = binary.LittleEndian.Uint64(ent[24:])
+			}
+		case exfatUpcase:
+			v.upcaseSum = binary.LittleEndian.Uint32(ent[4:])
+			v.upcaseCluster = binary.LittleEndian.Uint32(ent[20:])
+			v.upcaseSize = binary.LittleEndian.Uint64(ent[24:])
+		}
+	}
+	if !v.validCluster(v.bitmapCluster) {
+		return noFilesystem("no allocation bitmap")
+	}
+	return nil
+}
+
+// updateBoot changes the boot sector with edit and writes it out, along
+// with its backup and, on exFAT, the boot region checksum.
+func (v *volume) updateBoot(edit func(boot []byte)) error {
+	if v.typ == TypeEXFAT {
+		region, err := v.read(v.base, 12)
+		if err != nil {
+			return err
+		}
+		edit(region[:v.ssize])
+		setExFATBootSum(region, v.ssize)
+		if err := v.write(v.base, region); err != nil {
+			return err
+		}
+		return v.write(v.base+12, region)
+	}
+
+	boot, err := v.read(v.base, 1)
+	if err != nil {
+		return err
+	}
+	edit(boot)
+	if err := v.write(v.base, boot); err != nil {
+		return err
+	}
+	if backup := uint64(binary.LittleEndian.Uint16(boot[50:])); v.typ == TypeFAT32 && backup != 0 && backup != 0xFFFF {
+		return v.write(v.base+backup, boot)
+	}
+	return nil
+}
+
+// read reads count sectors starting at sector.
+func (v *volume) read(sector, count uint64) ([]byte, error) {
+	buf := make([]byte, count*v.ssize)
+	// stay within what a single C call would ask for
+	const chunk = 1 << 16
+	for done := uint64(0); done < count; {
+		n := min(count-done, chunk)
+		if err := v.dev.ReadSectors(sector+done, uint32(n), buf[done*v.ssize:]); err != nil {
+			return nil, fmt.Errorf("read sector %d: %w", sector+done, err)
+		}
+		done += n
+	}
+	return buf, nil
+}
+
+// write writes data, a whole number of sectors, starting at sector.
+func (v *volume) write(sector uint64, data []byte) error {
+	count := uint64(len(data)) / v.ssize
+	const chunk = 1 << 16
+	for done := uint64(0); done < count; {
+		n := min(count-done, chunk)
+		if err := v.dev.WriteSectors(sector+done, uint32(n), data[done*v.ssize:]); err != nil {
+			return fmt.Errorf("write sector %d: %w", sector+done, err)
+		}
+		done += n
+	}
+	return nil
+}
+
+// clusterBytes returns the size of a cluster in bytes.
+func (v *volume) clusterBytes() uint64 {
+	return v.csize * v.ssize
+}
+
+// clusterSector returns the first sector of cluster cl.
+func (v *volume) clusterSector(cl uint32) uint64 {
+	return v.dataStart + uint64(cl-2)*v.csize
+}
+
+func (v *volume) validCluster(cl uint32) bool {
+	return cl >= 2 && cl < v.nclst+2
+}
+
+// fatEntry returns the FAT entry of cluster cl.
+func (v *volume) fatEntry(cl uint32) uint32 {
+	switch v.typ {
+	case TypeFAT12:
+		off := cl + cl/2
+		val := uint32(binary.LittleEndian.Uint16(v.fat[off:]))
+		if cl&1 != 0 {
+			return val >> 4
+		}
+		return val & 0xFFF
+	case TypeFAT16:
+		return uint32(binary.LittleEndian.Uint16(v.fat[cl*2:]))
+	case TypeFAT32:
+		return binary.LittleEndian.Uint32(v.fat[cl*4:]) & 0x0FFFFFFF
+	default:
+		return binary.LittleEndian.Uint32(v.fat[cl*4:])
+	}
+}
+
+// setFATEntry changes the FAT entry of cluster cl in memory, flushFAT writes
+// it out.
+func (v *volume) setFATEntry(cl, val uint32) {
+	var off, size uint64
+	switch v.typ {
+	case TypeFAT12:
+		off, size = uint64(cl+cl/2), 2
+		old := binary.LittleEndian.Uint16(v.fat[off:])
+		if cl&1 != 0 {
+			binary.LittleEndian.PutUint16(v.fat[off:], old&0x000F|uint16(val)<<4)
+		} else {
+			binary.LittleEndian.PutUint16(v.fat[off:], old&0xF000|uint16(val)&0xFFF)
+		}
+	case TypeFAT16:
+		off, size = uint64(cl)*2, 2
+		binary.LittleEndian.PutUint16(v.fat[off:], uint16(val))
+	case TypeFAT32:
+		off, size = uint64(cl)*4, 4
+		old := binary.LittleEndian.Uint32(v.fat[off:])
+		binary.LittleEndian.PutUint32(v.fat[off:], old&0xF0000000|val&0x0FFFFFFF)
+	default:
+		off, size = uint64(cl)*4, 4
+		binary.LittleEndian.PutUint32(v.fat[off:], val)
+	}
+	v.fatDirty[off/v.ssize] = true
+	v.fatDirty[(off+size-1)/v.ssize] = true
+}
+
+// flushFAT writes the changed FAT sectors to every FAT copy.
+func (v *volume) flushFAT() error {
+	for s := range v.fatDirty {
+		data := v.fat[s*v.ssize : (s+1)*v.ssize]
+		for i := 0; i < v.nfats; i++ {
+			if err := v.write(v.fatStart+uint64(i)*v.fatSize+s, data); err != nil {
+				return err
+			}
+		}
+	}
+	clear(v.fatDirty)
+	return nil
+}
+
+// eoc returns the end of chain mark written by FatFs.
+func (v *volume) eoc() uint32 {
+	switch v.typ {
+	case TypeFAT12:
+		return 0xFFF
+	case TypeFAT16:
+		return 0xFFFF
+	case TypeFAT32:
+		return 0x0FFFFFFF
+	default:
+		return 0xFFFFFFFF
+	}
+}
+
+// isEOC reports whether val ends a cluster chain.
+func (v *volume) isEOC(val uint32) bool {
+	switch v.typ {
+	case TypeFAT12:
+		return val >= 0xFF8
+	case TypeFAT16:
+		return val >= 0xFFF8
+	case TypeFAT32:
+		return val >= 0x0FFFFFF8
+	default:
+		return val >= 0xFFFFFFF8
+	}
+}
+
+// badCluster returns the FAT entry value marking a bad cluster.
+func (v *volume) badCluster() uint32 {
+	return v.eoc() - 8
+}
+
+// chain follows the FAT from first and returns the clusters of the chain.
+func (v *volume) chain(first uint32) ([]uint32, error) {
+	var clusters []uint32
+	for cl := first; ; {
+		if !v.validCluster(cl) {
+			return clusters, fmt.Errorf("%w: chain from cluster %d leads to invalid cluster %d", FileResultIntErr, first, cl)
+		}
+		if len(clusters) > int(v.nclst) {
+			return clusters, fmt.Errorf("%w: chain from cluster %d loops", FileResultIntErr, first)
+		}
+		clusters = append(clusters, cl)
+		next := v.fatEntry(cl)
+		if v.isEOC(next) {
+			return clusters, nil
+		}
+		cl = next
+	}
+}
+
+// contiguous returns the clusters of an n cluster run starting at first,
+// as used by exFAT files without a FAT chain.
+func contiguous(first uint32, n uint64) []uint32 {
+	clusters := make([]uint32, n)
+	for i := range clusters {
+		clusters[i] = first + uint32(i)
+	}
+	return clusters
+}
+
+// clusterSectors lists the sectors of the given clusters, in order.
+func (v *volume) clusterSectors(clusters []uint32) []uint64 {
+	sectors := make([]uint64, 0, uint64(len(clusters))*v.csize)
+	for _, cl := range clusters {
+		for s := uint64(0); s < v.csize; s++ {
+			sectors = append(sectors, v.clusterSector(cl)+s)
+		}
+	}
+	return sectors
+}
+
+// rootSectors lists the sectors of the fixed FAT12/16 root directory.
+func (v *volume) rootSectors() []uint64 {
+	n := uint64(v.rootEntries) * dirEntrySize / v.ssize
+	sectors := make([]uint64, n)
+	for i := range sectors {
+		sectors[i] = v.rootStart + uint64(i)
+	}
+	return sectors
+}
+
+// dirData is the raw contents of a directory and the sectors it lives in.
+type dirData struct {
+	sectors []uint64
+	data    []byte
+	dirty   bool
+}
+
+func (v *volume) readDir(sectors []uint64) (*dirData, error) {
+	d := &dirData{sectors: sectors, data: make([]byte, 0, uint64(len(sectors))*v.ssize)}
+	// read runs of consecutive sectors at once
+	for i := 0; i < len(sectors); {
+		j := i + 1
+		for j < len(sectors) && sectors[j] == sectors[j-1]+1 {
+			j++
+		}
+		buf, err := v.read(sectors[i], uint64(j-i))
+		if err != nil {
+			return nil, err
+		}
+		d.data = append(d.data, buf...)
+		i = j
+	}
+	return d, nil
+}
+
+// writeDir writes a changed directory back.
+func (v *volume) writeDir(d *dirData) error {
+	if !d.dirty {
+		return nil
+	}
+	for i, s := range d.sectors {
+		if err := v.write(s, d.data[uint64(i)*v.ssize:uint64(i+1)*v.ssize]); err != nil {
+			return err
+		}
+	}
+	d.dirty = false
+	return nil
+}
+
+func (d *dirData) entries() int {
+	return len(d.data) / dirEntrySize
+}
+
+func (d *dirData) entry(i int) []byte {
+	return d.data[i*dirEntrySize : (i+1)*dirEntrySize]
+}
+
+// dirEnt is a file or directory found in a directory.
+type dirEnt struct {
+	name       string
+	attr       byte
+	cluster    uint32
+	size       uint64
+	validSize  uint64 // exFAT valid data length
+	noFatChain bool   // exFAT contiguous file without a FAT chain
+
+	// The entry occupies slots [first, first+n) of the directory, the
+	// cluster and size are stored in slot main.
+	first, n, main int
+}
+
+func (e *dirEnt) isDir() bool {
+	return e.attr&C.AM_DIR != 0
+}
+
+// dirIssue is a malformed entry found while parsing a directory.
+type dirIssue struct {
+	name     string
+	first, n int
+	msg      string
+	// fixable issues are repaired by rewriting the entry, the others by
+	// deleting it, except for kept ones: the entry is still in use and
+	// only reported.
+	fixable bool
+	keep    bool
+}
+
+// parseDir decodes the entries of a directory. Dot entries of FAT
+// directories are returned, deleted and volume label entries are not.
+func (v *volume) parseDir(d *dirData, upcase []uint16) ([]dirEnt, []dirIssue) {
+	if v.typ == TypeEXFAT {
+		return v.parseExFATDir(d, upcase)
+	}
+	return v.parseFATDir(d)
+}
+
+func (v *volume) parseFATDir(d *dirData) ([]dirEnt, []dirIssue) {
+	var (
+		ents   []dirEnt
+		issues []dirIssue
+
+		lfn      []uint16
+		lfnFirst = -1
+		lfnOrd   byte
+		lfnSum   byte
+	)
+	orphan := func(i int, msg string) {
+		if lfnFirst >= 0 {
+			issues = append(issues, dirIssue{first: lfnFirst, n: i - lfnFirst, msg: msg})
+			lfnFirst = -1
+		}
+	}
+
+	for i := 0; i < d.entries(); i++ {
+		ent := d.entry(i)
+		if ent[0] == 0 {
+			orphan(i, "long name entries without a short name entry")
+			break
+		}
+		if ent[0] == 0xE5 {
+			orphan(i, "long name entries without a short name entry")
+			continue
+		}
+
+		if ent[11]&0x3F == attrLFN {
+			ord := ent[0]
+			if ord&0x40 != 0 {
+				orphan(i, "incomplete long name")
+				lfnFirst, lfnOrd, lfnSum = i, ord&0x3F, ent[13]
+				lfn = make([]uint16, 13*int(lfnOrd))
+			} else if lfnFirst < 0 || ord != lfnOrd || ent[13] != lfnSum {
+				orphan(i, "incomplete long name")
+				issues = append(issues, dirIssue{first: i, n: 1, msg: "long name entry out of sequence"})
+				continue
+			}
+			if lfnOrd == 0 || lfnOrd > 20 {
+				issues = append(issues, dirIssue{first: lfnFirst, n: i - lfnFirst + 1, msg: "bad long name sequence number"})
+				lfnFirst = -1
+				continue
+			}
+			part := lfn[13*(int(lfnOrd)-1):]
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part[j] = binary.LittleEndian.Uint16(ent[off:])
+			}
+			lfnOrd--
+			continue
+		}
+
+		if ent[11]&attrVolume != 0 && ent[11]&C.AM_DIR == 0 {
+			orphan(i, "long name entries without a short name entry")
+			continue
+		}
+
+		e := dirEnt{
+			attr:    ent[11],
+			cluster: uint32(binary.LittleEndian.Uint16(ent[26:])),
+			size:    uint64(binary.LittleEndian.Uint32(ent[28:])),
+			first:   i,
+			n:       1,
+			main:    i,
+		}
+		if v.typ == TypeFAT32 {
+			e.cluster |= uint32(binary.LittleEndian.Uint16(ent[20:])) << 16
+		}
+		e.name = sfnName(ent)
+
+		if lfnFirst >= 0 {
+			if lfnOrd == 0 && sfnSum(ent) == lfnSum {
+				e.first, e.n = lfnFirst, i-lfnFirst+1
+				e.name = lfnName(lfn)
+			} else {
+				orphan(i, "long name does not belong to the following entry")
+			}
+			lfnFirst = -1
+		}
+
+		if msg := checkSFN(ent); msg != "" {
+			issues = append(issues, dirIssue{name: e.name, first: e.first, n: e.n, msg: msg})
+			continue
+		}
+		// a name with odd characters still refers to its data, so the
+		// entry is kept
+		if msg := checkSFNChars(ent, v.codePage); msg != "" {
+			issues = append(issues, dirIssue{name: e.name, first: e.first, n: e.n, msg: msg, keep: true})
+		}
+		ents = append(ents, e)
+	}
+	return ents, issues
+}
+
+// checkSFN returns what is wrong with a short name entry, if anything.
+func checkSFN(ent []byte) string {
+	if ent[11]&0xC0 != 0 {
+		return fmt.Sprintf("reserved attribute bits set: %#02x", ent[11])
+	}
+	if ent[0] == '.' {
+		name := string(ent[:11])
+		if name != ".          " && name != "..         " || ent[11]&C.AM_DIR == 0 {
+			return "bad dot entry"
+		}
+		return ""
+	}
+	return ""
+}
+
+// checkSFNChars returns what is wrong with the characters of a short name
+// in code page cp, if anything. The second byte of a double byte character
+// may be any of the bytes not allowed on their own.
+func checkSFNChars(ent []byte, cp int) string {
+	if ent[0] == '.' {
+		return "" // dot entries are checked by checkSFN
+	}
+	if ent[0] == ' ' {
+		return "short name starts with a space"
+	}
+	for i := 0; i < 11; i++ {
+		c := ent[i]
+		if i == 0 && c == 0x05 {
+			c = 0xE5 // stored as 0x05 as 0xE5 marks deleted entries
+		}
+		// a character does not span the name and the extension
+		if i != 7 && i != 10 && dbcsLead(cp, c) && dbcsTrail(cp, ent[i+1]) {
+			i++
+			continue
+		}
+		if c < 0x20 || bytes.IndexByte([]byte(`"*+,./:;<=>?[\]|`), c) >= 0 {
+			return fmt.Sprintf("invalid character %#02x in short name", c)
+		}
+	}
+	return ""
+}
+
+// dbcsRanges are the double byte character ranges of the DBCS code pages,
+// as in the Dc tables of ff.c: two lead byte ranges, then three trail byte
+// ranges, unused ones zero.
+var dbcsRanges = map[int][10]byte{
+	932: {0x81, 0x9F, 0xE0, 0xFC, 0x40, 0x7E, 0x80, 0xFC, 0x00, 0x00},
+	936: {0x81, 0xFE, 0x00, 0x00, 0x40, 0x7E, 0x80, 0xFE, 0x00, 0x00},
+	949: {0x81, 0xFE, 0x00, 0x00, 0x41, 0x5A, 0x61, 0x7A, 0x81, 0xFE},
+	950: {0x81, 0xFE, 0x00, 0x00, 0x40, 0x7E, 0xA1, 0xFE, 0x00, 0x00},
+}
+
+// dbcsLead reports whether c starts a double byte character in code page
+// cp.
+func dbcsLead(cp int, c byte) bool {
+	r, ok := dbcsRanges[cp]
+	return ok && (c >= r[0] && c <= r[1] || c >= r[2] && c <= r[3] && r[2] != 0)
+}
+
+// dbcsTrail reports whether c can end a double byte character in code
+// page cp.
+func dbcsTrail(cp int, c byte) bool {
+	r, ok := dbcsRanges[cp]
+	return ok && (c >= r[4] && c <= r[5] || c >= r[6] && c <= r[7] || c >= r[8] && c <= r[9] && r[8] != 0)
+}
+
+// sfnSum is the checksum of a short name stored in its long name entries.
+func sfnSum(ent []byte) byte {
+	var sum byte
+	for _, c := range ent[:11] {
+		sum = sum>>1 + sum<<7 + c
+	}
+	return sum
+}
+
+func sfnName(ent []byte) string {
+	base := bytes.TrimRight(ent[:8], " ")
+	ext := bytes.TrimRight(ent[8:11], " ")
+	if len(base) > 0 && base[0] == 0x05 {
+		base = append([]byte{0xE5}, base[1:]...)
+	}
+	// NT lower case flags
+	if ent[12]&0x08 != 0 {
+		base = bytes.ToLower(base)
+	}
+	if ent[12]&0x10 != 0 {
+		ext = bytes.ToLower(ext)
+	}
+	if len(ext) == 0 {
+		return string(base)
+	}
+	return string(base) + "." + string(ext)
+}
+
+func lfnName(lfn []uint16) string {
+	for i, c := range lfn {
+		if c == 0 {
+			lfn = lfn[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(lfn))
+}
+
+func (v *volume) parseExFATDir(d *dirData, upcase []uint16) ([]dirEnt, []dirIssue) {
+	var (
+		ents   []dirEnt
+		issues []dirIssue
+	)
+	for i := 0; i < d.entries(); i++ {
+		ent := d.entry(i)
+		if ent[0] == 0 {
+			break
+		}
+		if ent[0]&0x80 == 0 || ent[0] != exfatFile {
+			if ent[0]&0xC0 == 0xC0 {
+				issues = append(issues, dirIssue{first: i, n: 1, msg: "secondary entry outside an entry set"})
+			}
+			continue
+		}
+
+		n := int(ent[1]) + 1
+		if n < 3 || n > 19 || i+n > d.entries() {
+			issues = append(issues, dirIssue{first: i, n: 1, msg: "bad secondary entry count"})
+			continue
+		}
+		set := d.data[i*dirEntrySize : (i+n)*dirEntrySize]
+		stream := set[dirEntrySize:]
+		e := dirEnt{
+			attr:       byte(binary.LittleEndian.Uint16(ent[4:])),
+			first:      i,
+			n:          n,
+			main:       i + 1,
+			cluster:    binary.LittleEndian.Uint32(stream[20:]),
+			size:       binary.LittleEndian.Uint64(stream[24:]),
+			validSize:  binary.LittleEndian.Uint64(stream[8:]),
+			noFatChain: stream[1]&exfatNoFatChain != 0,
+		}
+		if stream[0] != exfatStream {
+			issues = append(issues, dirIssue{first: i, n: n, msg: "entry set without a stream extension"})
+			i += n - 1
+			continue
+		}
+
+		nameLen := int(stream[3])
+		var name []uint16
+		bad := ""
+		for j := 2; j < n; j++ {
+			sec := set[j*dirEntrySize:]
+			if sec[0] != exfatName {
+				if sec[0]&0xC0 != 0xC0 {
+					bad = fmt.Sprintf("unexpected entry type %#02x in entry set", sec[0])
+				}
+				break
+			}
+			for k := 2; k < dirEntrySize && len(name) < nameLen; k += 2 {
+				name = append(name, binary.LittleEndian.Uint16(sec[k:]))
+			}
+		}
+		e.name = string(utf16.Decode(name))
+		switch {
+		case bad != "":
+		case nameLen == 0:
+			bad = "empty file name"
+		case len(name) < nameLen:
+			bad = "file name is longer than its entries"
+		}
+		if bad != "" {
+			issues = append(issues, dirIssue{name: e.name, first: i, n: n, msg: bad})
+			i += n - 1
+			continue
+		}
+
+		if sum := exfatSetSum(set); sum != binary.LittleEndian.Uint16(set[2:]) {
+			issues = append(issues, dirIssue{name: e.name, first: i, n: n, fixable: true, msg: "bad entry set checksum"})
+		} else if hash := exfatNameHash(name, upcase); hash != binary.LittleEndian.Uint16(stream[4:]) {
+			issues = append(issues, dirIssue{name: e.name, first: i, n: n, fixable: true, msg: "bad file name hash"})
+		}
+		ents = append(ents, e)
+		i += n - 1
+	}
+	return ents, issues
+}
+
+// exfatSetSum computes the checksum of an exFAT directory entry set.
+func exfatSetSum(set []byte) uint16 {
+	var sum uint16
+	for i, b := range set {
+		if i == 2 || i == 3 {
+			continue
+		}
+		sum = sum<<15 | sum>>1
+		sum += uint16(b)
+	}
+	return sum
+}
+
+// exfatNameHash computes the name hash stored in a stream extension entry,
+// using the volume's up-case table.
+func exfatNameHash(name []uint16, upcase []uint16) uint16 {
+	var sum uint16
+	for _, c := range name {
+		if int(c) < len(upcase) {
+			c = upcase[c]
+		}
+		sum = sum<<15 | sum>>1
+		sum += c & 0xFF
+		sum = sum<<15 | sum>>1
+		sum += c >> 8
+	}
+	return sum
+}
+
+// setEntry stores the cluster and size of e into the directory and, on
+// exFAT, updates the entry set checksum.
+func (v *volume) setEntry(d *dirData, e *dirEnt) {
+	ent := d.entry(e.main)
+	if v.typ == TypeEXFAT {
+		binary.LittleEndian.PutUint32(ent[20:], e.cluster)
+		binary.LittleEndian.PutUint64(ent[24:], e.size)
+		binary.LittleEndian.PutUint64(ent[8:], e.validSize)
+		if e.noFatChain {
+			ent[1] |= exfatNoFatChain
+		} else {
+			ent[1] &^= exfatNoFatChain
+		}
+		v.fixEntrySet(d, e.first, e.n, nil)
+	} else {
+		binary.LittleEndian.PutUint16(ent[26:], uint16(e.cluster))
+		if v.typ == TypeFAT32 {
+			binary.LittleEndian.PutUint16(ent[20:], uint16(e.cluster>>16))
+		}
+		binary.LittleEndian.PutUint32(ent[28:], uint32(e.size))
+	}
+	d.dirty = true
+}
+
+// fixEntrySet recomputes the name hash, if upcase is given, and checksum of
+// an exFAT entry set.
+func (v *volume) fixEntrySet(d *dirData, first, n int, upcase []uint16) {
+	set := d.data[first*dirEntrySize : (first+n)*dirEntrySize]
+	if upcase != nil {
+		stream := set[dirEntrySize:]
+		nameLen := int(stream[3])
+		var name []uint16
+		for j := 2; j < n && len(name) < nameLen; j++ {
+			sec := set[j*dirEntrySize:]
+			for k := 2; k < dirEntrySize && len(name) < nameLen; k += 2 {
+				name = append(name, binary.LittleEndian.Uint16(sec[k:]))
+			}
+		}
+		binary.LittleEndian.PutUint16(stream[4:], exfatNameHash(name, upcase))
+	}
+	binary.LittleEndian.PutUint16(set[2:], exfatSetSum(set))
+	d.dirty = true
+}
+
+// deleteEntry marks the slots [first, first+n) as deleted.
+func (v *volume) deleteEntry(d *dirData, first, n int) {
+	for i := first; i < first+n; i++ {
+		ent := d.entry(i)
+		if v.typ == TypeEXFAT {
+			ent[0] &^= 0x80
+		} else {
+			ent[0] = 0xE5
+		}
+	}
+	d.dirty = true
+}
+
+// readUpcase loads and expands the exFAT up-case table. It returns the
+// table and the checksum of its on-disk form.
+func (v *volume) readUpcase() ([]uint16, uint32, error) {
+	if !v.validCluster(v.upcaseCluster) || v.upcaseSize == 0 || v.upcaseSize > 2*0x10000 {
+		return nil, 0, errors.New("bad up-case table location")
+	}
+	clusters, err := v.chain(v.upcaseCluster)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(clusters))*v.clusterBytes() < v.upcaseSize {
+		return nil, 0, errors.New("up-case table chain shorter than the table")
+	}
+	d, err := v.readDir(v.clusterSectors(clusters))
+	if err != nil {
+		return nil, 0, err
+	}
+	raw := d.data[:v.upcaseSize]
+
+	var sum uint32
+	for _, b := range raw {
+		sum = sum<<31 | sum>>1
+		sum += uint32(b)
+	}
+
+	table := make([]uint16, 0x10000)
+	for i := range table {
+		table[i] = uint16(i)
+	}
+	ch := 0
+	for i := 0; i+1 < len(raw) && ch < len(table); i += 2 {
+		val := binary.LittleEndian.Uint16(raw[i:])
+		if val == 0xFFFF && i+3 < len(raw) {
+			// a run of characters that map to themselves
+			ch += int(binary.LittleEndian.Uint16(raw[i+2:]))
+			i += 2
+			continue
+		}
+		table[ch] = val
+		ch++
+	}
+	return table, sum, nil
+}
+
+// defaultUpcase builds the compressed up-case table f_mkfs writes, with its
+// checksum.
+func defaultUpcase() ([]byte, uint32) {
+	var (
+		table []byte
+		sum   uint32
+	)
+	put := func(ch uint16) {
+		for _, b := range []byte{byte(ch), byte(ch >> 8)} {
+			table = append(table, b)
+			sum = sum<<31 | sum>>1
+			sum += uint32(b)
+		}
+	}
+	upper := func(ch uint32) uint16 {
+		return uint16(C.ff_wtoupper(C.DWORD(ch)))
+	}
+
+	for si := uint32(0); si < 0x10000; {
+		if upper(si) != uint16(si) {
+			put(upper(si))
+			si++
+			continue
+		}
+		j := uint32(1)
+		for si+j < 0x10000 && upper(si+j) == uint16(si+j) {
+			j++
+		}
+		if j >= 128 {
+			put(0xFFFF)
+			put(uint16(j))
+			si += j
+			continue
+		}
+		for ; j > 0; j-- {
+			put(uint16(si))
+			si++
+		}
+	}
+	return table, sum
+}
+
+// defaultUpcaseTable expands the up-case table of FatFs.
+func defaultUpcaseTable() []uint16 {
+	table := make([]uint16, 0x10000)
+	for i := range table {
+		table[i] = uint16(C.ff_wtoupper(C.DWORD(i)))
+	}
+	return table
+}
+
+// readBitmap loads the exFAT allocation bitmap.
+func (v *volume) readBitmap() ([]byte, []uint32, error) {
+	clusters, err := v.chain(v.bitmapCluster)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := v.readDir(v.clusterSectors(clusters))
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.data, clusters, nil
+}
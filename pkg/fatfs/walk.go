@@ -0,0 +1,126 @@
+package fatfs
+
+/*
+#include <stdlib.h>
+#include "ff.h"
+
+FF_DIR* allocate_dir(void);
+*/
+import "C"
+import (
+	"io/fs"
+	"iter"
+	pathpkg "path"
+	"sort"
+	"unsafe"
+)
+
+// Walk walks the file tree rooted at root like filepath.WalkDir, calling fn
+// for each file or directory including root, in lexical order. The
+// fs.DirEntry passed to fn is a *FileInfo whose Sys method returns the
+// *FileStat of the entry. Directories are read straight from FatFs, without
+// a stat per entry. fn may return fs.SkipDir or fs.SkipAll as for
+// filepath.WalkDir, and errors reading a directory are passed to a second
+// call of fn for that directory.
+func (f *FatFs) Walk(root string, fn fs.WalkDirFunc) error {
+	Logger.Println("CALL Walk", root)
+	info, err := f.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = f.walkDir(root, info.(*FileInfo), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (f *FatFs) walkDir(path string, d *FileInfo, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			// successfully skipped directory
+			err = nil
+		}
+		return err
+	}
+
+	infos, err := f.readDir(path)
+	if err != nil {
+		// second call, to report the error reading the directory
+		err = fn(path, d, err)
+		if err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, info := range infos {
+		if err := f.walkDir(pathpkg.Join(path, info.Name()), info, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readDir returns the entries of the directory name sorted by name.
+func (f *FatFs) readDir(name string) ([]*FileInfo, error) {
+	cpath := C.CString(f.fatPath(name))
+	defer C.free(unsafe.Pointer(cpath))
+
+	dp := C.allocate_dir()
+	if dp == nil {
+		return nil, FileResultNotEnoughCore
+	}
+	defer C.free(unsafe.Pointer(dp))
+	if err := errval(C.f_opendir(dp, cpath)); err != nil {
+		return nil, err
+	}
+	defer C.f_closedir(dp)
+
+	loc := f.Location()
+	var infos []*FileInfo
+	for {
+		info := C.FILINFO{}
+		if err := errval(C.f_readdir(dp, &info)); err != nil {
+			return infos, err
+		}
+		if info.fname[0] == 0 {
+			break
+		}
+		infos = append(infos, newFileInfo(&info, loc))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+	return infos, nil
+}
+
+// WalkEntry is a file or directory visited by WalkSeq.
+type WalkEntry struct {
+	Path string
+	// Info is nil if root could not be read.
+	Info *FileInfo
+}
+
+// WalkSeq returns an iterator over the file tree rooted at root, in the
+// order of Walk. An error reading a directory is yielded with the
+// directory's entry after the directory itself, and the walk goes on;
+// stopping the iteration ends the walk. Use Walk to skip directories.
+func (f *FatFs) WalkSeq(root string) iter.Seq2[WalkEntry, error] {
+	return func(yield func(WalkEntry, error) bool) {
+		f.Walk(root, func(path string, d fs.DirEntry, err error) error {
+			ent := WalkEntry{Path: path}
+			if d != nil {
+				ent.Info = d.(*FileInfo)
+			}
+			if !yield(ent, err) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+	}
+}